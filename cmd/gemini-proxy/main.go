@@ -1,12 +1,27 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"gemini-anti-truncate-go/internal/auth"
+	"gemini-anti-truncate-go/internal/concurrency"
 	"gemini-anti-truncate-go/internal/config"
 	"gemini-anti-truncate-go/internal/handler"
+	"gemini-anti-truncate-go/internal/keypool"
+	"gemini-anti-truncate-go/internal/lifecycle"
+	"gemini-anti-truncate-go/internal/metrics"
+	"gemini-anti-truncate-go/internal/ratelimit"
+	"gemini-anti-truncate-go/internal/retry"
+	"gemini-anti-truncate-go/internal/tracing"
+	"gemini-anti-truncate-go/internal/upstream"
 	"gemini-anti-truncate-go/internal/util"
+	"gemini-anti-truncate-go/internal/version"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -15,22 +30,150 @@ func main() {
 	// Load application configuration from environment variables
 	config.Load()
 
+	// Log with slog, in the format and from the level of LOG_FORMAT and LOG_LEVEL
+	if err := util.SetupLogger(os.Stderr); err != nil {
+		log.Fatalf("Failed to set up logging: %v", err)
+	}
+
+	// Load the retry policy, from RETRY_POLICY_FILE or RETRY_POLICY if set
+	policy, err := retry.LoadPolicy()
+	if err != nil {
+		log.Fatalf("Failed to load retry policy: %v", err)
+	}
+	retry.SetPolicy(policy)
+
+	// Load the upstream key pools, from GEMINI_API_KEY and KEY_POOL_FILE
+	keys, err := keypool.Load()
+	if err != nil {
+		log.Fatalf("Failed to load key pools: %v", err)
+	}
+	keypool.SetRegistry(keys)
+	for _, name := range keys.Pools() {
+		healthy, _, _ := keys.Pool(name).Stats()
+		util.Info(context.Background(), "Key pool loaded", "pool", name, "keys", healthy)
+	}
+
+	// Load the proxy access tokens, from PROXY_TOKENS and PROXY_TOKENS_FILE
+	authenticator, err := auth.Load()
+	if err != nil {
+		log.Fatalf("Failed to load proxy access tokens: %v", err)
+	}
+	for _, client := range authenticator.Clients() {
+		if keys.Pool(client.Pool) == nil {
+			log.Fatalf("Client %q uses key pool %q, which is not configured", client.ID, client.Pool)
+		}
+	}
+	util.Info(context.Background(), "Proxy authentication configured", "enabled", authenticator.Enabled(), "clients", len(authenticator.Clients()))
+
+	// Set up the rate limits of clients, keys and models from RATE_LIMIT_*
+	limiter := ratelimit.Load()
+	ratelimit.SetLimiter(limiter)
+	util.Info(context.Background(), "Rate limiting configured", "enabled", limiter.Enabled())
+
+	// Set up the concurrency gates from MAX_CONCURRENT, MAX_CONCURRENT_PER_MODEL and QUEUE_*
+	gates, err := concurrency.Load()
+	if err != nil {
+		log.Fatalf("Failed to load concurrency limits: %v", err)
+	}
+	concurrency.SetLimiter(gates)
+
+	// Share one pooled upstream client, tuned by UPSTREAM_*, between all handlers
+	upstream.SetClient(upstream.LoadClient())
+
+	// Export spans of requests and upstream attempts to OTEL_EXPORTER_OTLP_ENDPOINT, if set
+	tracer, err := tracing.Load()
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+	tracing.SetTracer(tracer)
+	util.Info(context.Background(), "Tracing configured", "enabled", tracer.Enabled())
+
 	// Initialize the router
 	r := mux.NewRouter()
 
+	// Every request gets an ID, taken from X-Request-Id or generated, that is echoed in the
+	// response headers and attached to the request's log lines. Every request is traced,
+	// continuing the client's trace if it sent a traceparent header.
+	r.Use(util.RequestIDMiddleware, tracing.Middleware)
+
 	// The primary route that captures all relevant Gemini API paths.
 	// This single route will handle both stream and non-stream requests,
 	// which are then differentiated within the ProxyHandler.
-	r.HandleFunc("/v1beta/models/{model:.+}", handler.ProxyHandler).Methods("POST")
+	// Clients are authenticated before the request reaches the ProxyHandler.
+	r.Handle("/v1beta/models/{model:.+}", authenticator.Middleware(http.HandlerFunc(handler.ProxyHandler))).Methods("POST")
+
+	// Queue depth and wait times of the concurrency gates, for monitoring
+	r.HandleFunc("/stats/queue", handler.QueueStatsHandler).Methods("GET")
+
+	// Prometheus metrics on requests, retries, truncations, latency and the gates above
+	r.Handle("/metrics", metrics.Default.Handler()).Methods("GET")
+
+	// Liveness, readiness and build information, for orchestrators
+	r.HandleFunc("/healthz", handler.HealthzHandler).Methods("GET")
+	r.HandleFunc("/readyz", handler.ReadyzHandler).Methods("GET")
+	r.HandleFunc("/version", handler.VersionHandler).Methods("GET")
 
 	// Define the server address
 	addr := fmt.Sprintf(":%d", config.AppConfig.Port)
+	server := &http.Server{
+		Addr:         addr,
+		Handler:      r,
+		ReadTimeout:  config.AppConfig.ReadTimeout,
+		WriteTimeout: config.AppConfig.WriteTimeout,
+		IdleTimeout:  config.AppConfig.IdleTimeout,
+	}
+	lc := lifecycle.New()
+	lifecycle.SetLifecycle(lc)
 
-	util.Infof("Starting Gemini Anti-Truncate Proxy Server on %s", addr)
-	util.Infof("Debug mode is %t", config.AppConfig.DebugMode)
+	info := version.Get()
+	util.Info(context.Background(), "Starting Gemini Anti-Truncate Proxy Server", "version", info.Version, "commit", info.Commit, "addr", addr)
+	util.Info(context.Background(), "Logging configured", "level", config.AppConfig.LogLevel, "debug_mode", config.AppConfig.DebugMode)
 
-	// Start the HTTP server
-	if err := http.ListenAndServe(addr, r); err != nil {
+	// Start the HTTP server, and shut it down gracefully on SIGTERM or SIGINT. A second signal
+	// ends the process at once.
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	select {
+	case err := <-serverErr:
 		log.Fatalf("Failed to start server: %v", err)
+	case sig := <-signals:
+		signal.Stop(signals)
+		util.Info(context.Background(), "Shutting down", "signal", sig.String(), "grace_period", config.AppConfig.ShutdownGracePeriod)
+	}
+	shutdown(server, lc, tracer)
+}
+
+// shutdownFinalTimeout is how long requests get to end their responses once the grace period is over.
+const shutdownFinalTimeout = 5 * time.Second
+
+// shutdown stops the server. New connections are refused and idle ones closed at once, while
+// the requests in flight get SHUTDOWN_GRACE_PERIOD to finish. After that, the remaining requests
+// are asked to end their responses: anti-truncate streams with a terminal error event, passthrough
+// responses where they are. The connections still open after shutdownFinalTimeout are closed.
+// Queued spans are exported last.
+func shutdown(server *http.Server, lc *lifecycle.Lifecycle, tracer *tracing.Tracer) {
+	lc.Drain()
+	ctx, cancel := context.WithTimeout(context.Background(), config.AppConfig.ShutdownGracePeriod)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		util.Info(ctx, "Grace period is over, ending the requests still in flight")
+		lc.Stop()
+		finalCtx, cancelFinal := context.WithTimeout(context.Background(), shutdownFinalTimeout)
+		defer cancelFinal()
+		if err := server.Shutdown(finalCtx); err != nil {
+			util.Error(finalCtx, "Closing the connections still open", "error", err)
+			server.Close()
+		}
+	}
+
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), shutdownFinalTimeout)
+	defer cancelFlush()
+	if err := tracer.Shutdown(flushCtx); err != nil {
+		util.Error(flushCtx, "Failed to export the last spans", "error", err)
 	}
+	util.Info(context.Background(), "Server stopped")
 }
@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"gemini-anti-truncate-go/internal/config"
+	"gemini-anti-truncate-go/internal/util"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// DefaultPool is the key pool of clients that do not name one.
+const DefaultPool = "default"
+
+// Client is the identity of a proxy user, established by its access token.
+type Client struct {
+	ID   string `json:"id"`
+	Pool string `json:"pool,omitempty"` // Upstream key pool the client's requests use
+
+	// Rate limits of this client, overriding RATE_LIMIT_CLIENT_RPM and RATE_LIMIT_CLIENT_TPM when set
+	RequestsPerMinute int `json:"requestsPerMinute,omitempty"`
+	TokensPerMinute   int `json:"tokensPerMinute,omitempty"`
+}
+
+// fileClient is an entry of PROXY_TOKENS_FILE. Only the SHA-256 of the token is stored.
+type fileClient struct {
+	Client
+	TokenSHA256 string `json:"tokenSha256"`
+}
+
+// Authenticator maps proxy access tokens to client identities. Tokens are looked up by their
+// SHA-256 hash, so the tokens themselves need not be kept in memory or on disk.
+type Authenticator struct {
+	clients map[[sha256.Size]byte]*Client
+}
+
+// Load builds the authenticator from PROXY_TOKENS, a comma-separated list of id:token or
+// id:token:pool entries, and PROXY_TOKENS_FILE, a JSON file of hashed tokens. Without either,
+// authentication is disabled and clients keep using their own Gemini keys.
+func Load() (*Authenticator, error) {
+	a := &Authenticator{clients: make(map[[sha256.Size]byte]*Client)}
+
+	for _, entry := range config.AppConfig.ProxyTokens {
+		fields := strings.Split(entry, ":")
+		if len(fields) < 2 || len(fields) > 3 || fields[0] == "" || fields[1] == "" {
+			return nil, fmt.Errorf("invalid proxy token entry %q, expected id:token or id:token:pool", entry)
+		}
+		client := &Client{ID: fields[0], Pool: DefaultPool}
+		if len(fields) == 3 && fields[2] != "" {
+			client.Pool = fields[2]
+		}
+		if err := a.add(sha256.Sum256([]byte(fields[1])), client); err != nil {
+			return nil, err
+		}
+	}
+
+	if path := config.AppConfig.ProxyTokensFile; path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read proxy tokens file: %w", err)
+		}
+		var file struct {
+			Clients []fileClient `json:"clients"`
+		}
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("invalid proxy tokens file: %w", err)
+		}
+		for _, entry := range file.Clients {
+			var hash [sha256.Size]byte
+			if n, err := hex.Decode(hash[:], []byte(entry.TokenSHA256)); err != nil || n != sha256.Size {
+				return nil, fmt.Errorf("invalid tokenSha256 for client %q", entry.ID)
+			}
+			if entry.ID == "" {
+				return nil, fmt.Errorf("proxy tokens file has a client without an id")
+			}
+			client := entry.Client
+			if client.Pool == "" {
+				client.Pool = DefaultPool
+			}
+			if err := a.add(hash, &client); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return a, nil
+}
+
+// add registers a client under the hash of its token.
+func (a *Authenticator) add(hash [sha256.Size]byte, client *Client) error {
+	if existing, ok := a.clients[hash]; ok {
+		return fmt.Errorf("clients %q and %q share a proxy token", existing.ID, client.ID)
+	}
+	a.clients[hash] = client
+	return nil
+}
+
+// Enabled reports whether any access tokens are configured.
+func (a *Authenticator) Enabled() bool {
+	return len(a.clients) > 0
+}
+
+// Authenticate returns the client a token belongs to.
+func (a *Authenticator) Authenticate(token string) (*Client, bool) {
+	if token == "" {
+		return nil, false
+	}
+	client, ok := a.clients[sha256.Sum256([]byte(token))]
+	return client, ok
+}
+
+// Clients returns all configured clients, sorted by ID.
+func (a *Authenticator) Clients() []*Client {
+	clients := make([]*Client, 0, len(a.clients))
+	for _, client := range a.clients {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+	return clients
+}
+
+// Middleware rejects requests without a valid access token and attaches the client identity
+// to the context of the others. The token is read from the same places as a Gemini key (see
+// util.GetAPIKey), so the official SDKs can pass it as their API key. When authentication is
+// disabled, requests pass through unchanged.
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.Enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		client, ok := a.Authenticate(util.GetAPIKey(r))
+		if !ok {
+			util.Error(r.Context(), "Rejected request: invalid or missing proxy access token", "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+			util.SendJSONError(w, "Invalid or missing proxy access token. Please provide it in 'Authorization: Bearer <token>' or 'X-Goog-Api-Key: <token>' header, or in the 'key' query parameter.", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), client)))
+	})
+}
+
+// HashToken returns the hex SHA-256 of a token, as stored in PROXY_TOKENS_FILE.
+func HashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx that carries the client.
+func NewContext(ctx context.Context, client *Client) context.Context {
+	return context.WithValue(ctx, contextKey{}, client)
+}
+
+// FromContext returns the authenticated client of a request, or nil if authentication is disabled.
+func FromContext(ctx context.Context) *Client {
+	client, _ := ctx.Value(contextKey{}).(*Client)
+	return client
+}
+
+// Name identifies the client of a request in logs.
+func Name(ctx context.Context) string {
+	if client := FromContext(ctx); client != nil {
+		return client.ID
+	}
+	return "anonymous"
+}
@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"gemini-anti-truncate-go/internal/config"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Initialize config for tests
+func init() {
+	config.Load()
+}
+
+func TestLoad(t *testing.T) {
+	defer func(cfg config.Config) { *config.AppConfig = cfg }(*config.AppConfig)
+
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	os.WriteFile(path, []byte(`{"clients": [
+		{"id": "batch-team", "tokenSha256": "`+HashToken("batch-token")+`", "pool": "batch"}
+	]}`), 0o600)
+	config.AppConfig.ProxyTokens = []string{"alice:alice-token", "bob:bob-token:premium"}
+	config.AppConfig.ProxyTokensFile = path
+
+	a, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !a.Enabled() {
+		t.Error("Expected authentication to be enabled")
+	}
+
+	tests := []struct {
+		token string
+		id    string
+		pool  string
+	}{
+		{"alice-token", "alice", DefaultPool},
+		{"bob-token", "bob", "premium"},
+		{"batch-token", "batch-team", "batch"},
+	}
+	for _, tt := range tests {
+		client, ok := a.Authenticate(tt.token)
+		if !ok {
+			t.Errorf("Expected token %q to be accepted", tt.token)
+			continue
+		}
+		if client.ID != tt.id || client.Pool != tt.pool {
+			t.Errorf("Expected client %s in pool %s, got %s in pool %s", tt.id, tt.pool, client.ID, client.Pool)
+		}
+	}
+	if _, ok := a.Authenticate("unknown"); ok {
+		t.Error("Expected an unknown token to be rejected")
+	}
+	if _, ok := a.Authenticate(""); ok {
+		t.Error("Expected an empty token to be rejected")
+	}
+	if clients := a.Clients(); len(clients) != 3 || clients[0].ID != "alice" {
+		t.Errorf("Expected 3 clients sorted by ID, got %v", clients)
+	}
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	defer func(cfg config.Config) { *config.AppConfig = cfg }(*config.AppConfig)
+
+	for _, tokens := range [][]string{{"no-token"}, {":token"}, {"a:b:c:d"}, {"a:same", "b:same"}} {
+		config.AppConfig.ProxyTokens = tokens
+		if _, err := Load(); err == nil {
+			t.Errorf("Expected an error for %v", tokens)
+		}
+	}
+
+	config.AppConfig.ProxyTokens = nil
+	config.AppConfig.ProxyTokensFile = filepath.Join(t.TempDir(), "tokens.json")
+	os.WriteFile(config.AppConfig.ProxyTokensFile, []byte(`{"clients": [{"id": "a", "tokenSha256": "not-hex"}]}`), 0o600)
+	if _, err := Load(); err == nil {
+		t.Error("Expected an error for an invalid hash")
+	}
+
+	// Without tokens, authentication is disabled
+	config.AppConfig.ProxyTokensFile = ""
+	a, err := Load()
+	if err != nil || a.Enabled() {
+		t.Errorf("Expected authentication to be disabled, got %v", err)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	defer func(cfg config.Config) { *config.AppConfig = cfg }(*config.AppConfig)
+	config.AppConfig.ProxyTokens = []string{"alice:alice-token"}
+	a, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var seen string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = Name(r.Context())
+	})
+	handler := a.Middleware(next)
+
+	// A valid token attaches the identity
+	req := httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:generateContent?key=alice-token", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || seen != "alice" {
+		t.Errorf("Expected the request to pass as alice, got %d as '%s'", rr.Code, seen)
+	}
+
+	// A Gemini key is not a proxy token
+	seen = ""
+	req = httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:generateContent", nil)
+	req.Header.Set("X-Goog-Api-Key", "AIza-real-key")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized || seen != "" {
+		t.Errorf("Expected status code %d, got %d", http.StatusUnauthorized, rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), "proxy access token") {
+		t.Errorf("Expected error message about the access token, got '%s'", rr.Body.String())
+	}
+
+	// Without tokens, requests pass through anonymously
+	disabled := &Authenticator{}
+	req = httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:generateContent", nil)
+	rr = httptest.NewRecorder()
+	disabled.Middleware(next).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || seen != "anonymous" {
+		t.Errorf("Expected the request to pass anonymously, got %d as '%s'", rr.Code, seen)
+	}
+}
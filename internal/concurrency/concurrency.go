@@ -0,0 +1,284 @@
+package concurrency
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"gemini-anti-truncate-go/internal/config"
+	"gemini-anti-truncate-go/internal/gemini"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrQueueFull is returned when a request finds the wait queue at its maximum length.
+	ErrQueueFull = errors.New("too many requests are waiting")
+	// ErrQueueTimeout is returned when a request waited longer than the maximum wait time.
+	ErrQueueTimeout = errors.New("timed out waiting for a free slot")
+)
+
+// GlobalGate is the name of the gate all requests pass.
+const GlobalGate = "global"
+
+// OtherGate is the name of the model gate shared by the models that have no gate of their own.
+const OtherGate = "other"
+
+// Gate bounds the number of requests in flight. Requests beyond the limit wait in a FIFO
+// queue of bounded length, for a bounded time.
+type Gate struct {
+	name     string
+	limit    int // Zero for no limit
+	maxQueue int
+	maxWait  time.Duration
+
+	mu      sync.Mutex
+	active  int
+	waiters *list.List // Of *waiter, oldest first
+
+	admitted  int64
+	rejected  int64
+	timedOut  int64
+	waited    int64
+	waitTotal time.Duration
+	waitMax   time.Duration
+}
+
+// waiter is a request queued at a gate. ready is closed when it is handed a slot.
+type waiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+// Stats is a snapshot of a gate, for monitoring.
+type Stats struct {
+	Name      string        `json:"name"`
+	Limit     int           `json:"limit"`
+	Active    int           `json:"active"`
+	Queued    int           `json:"queued"`
+	MaxQueue  int           `json:"maxQueue"`
+	Admitted  int64         `json:"admitted"` // Requests that got a slot, with or without waiting
+	Rejected  int64         `json:"rejected"` // Requests turned away because the queue was full
+	TimedOut  int64         `json:"timedOut"` // Requests that gave up after the maximum wait
+	Waited    int64         `json:"waited"`   // Requests that got a slot after waiting in the queue
+	WaitTotal time.Duration `json:"waitTotalNs"`
+	WaitMax   time.Duration `json:"waitMaxNs"`
+}
+
+// NewGate creates a gate that lets limit requests in at once, zero meaning no limit.
+func NewGate(name string, limit, maxQueue int, maxWait time.Duration) *Gate {
+	return &Gate{name: name, limit: limit, maxQueue: maxQueue, maxWait: maxWait, waiters: list.New()}
+}
+
+// Acquire waits for a slot, for at most the gate's maximum wait, and returns the function
+// that gives it back. It fails with ErrQueueFull, ErrQueueTimeout or the context's error.
+func (g *Gate) Acquire(ctx context.Context) (func(), error) {
+	g.mu.Lock()
+	if g.limit <= 0 || (g.active < g.limit && g.waiters.Len() == 0) {
+		g.active++
+		g.admitted++
+		g.mu.Unlock()
+		return g.release, nil
+	}
+	if g.waiters.Len() >= g.maxQueue {
+		g.rejected++
+		g.mu.Unlock()
+		return nil, ErrQueueFull
+	}
+	w := &waiter{ready: make(chan struct{})}
+	elem := g.waiters.PushBack(w)
+	g.mu.Unlock()
+
+	start := time.Now()
+	var timeout <-chan time.Time
+	if g.maxWait > 0 {
+		timer := time.NewTimer(g.maxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var err error
+	select {
+	case <-w.ready:
+	case <-timeout:
+		err = ErrQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !w.granted {
+		g.waiters.Remove(elem)
+		if err == ErrQueueTimeout {
+			g.timedOut++
+		}
+		return nil, err
+	}
+	// The slot was handed over, possibly while the wait ran out; take it either way.
+	wait := time.Since(start)
+	g.admitted++
+	g.waited++
+	g.waitTotal += wait
+	g.waitMax = max(g.waitMax, wait)
+	return g.release, nil
+}
+
+// release gives a slot back, handing it to the oldest waiter if there is one.
+func (g *Gate) release() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.limit > 0 {
+		if front := g.waiters.Front(); front != nil {
+			w := g.waiters.Remove(front).(*waiter)
+			w.granted = true
+			close(w.ready)
+			return
+		}
+	}
+	g.active--
+}
+
+// Stats returns a snapshot of the gate.
+func (g *Gate) Stats() Stats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return Stats{
+		Name:      g.name,
+		Limit:     g.limit,
+		Active:    g.active,
+		Queued:    g.waiters.Len(),
+		MaxQueue:  g.maxQueue,
+		Admitted:  g.admitted,
+		Rejected:  g.rejected,
+		TimedOut:  g.timedOut,
+		Waited:    g.waited,
+		WaitTotal: g.waitTotal,
+		WaitMax:   g.waitMax,
+	}
+}
+
+// Limiter combines the global gate with one gate per model.
+type Limiter struct {
+	global    *Gate
+	perModel  int
+	overrides map[string]int // Model -> limit, taking precedence over perModel
+	maxQueue  int
+	maxWait   time.Duration
+
+	mu     sync.Mutex
+	models map[string]*Gate
+}
+
+// NewLimiter creates a limiter from a global limit and a limit per model, zero meaning no limit.
+func NewLimiter(global, perModel int, overrides map[string]int, maxQueue int, maxWait time.Duration) *Limiter {
+	return &Limiter{
+		global:    NewGate(GlobalGate, global, maxQueue, maxWait),
+		perModel:  perModel,
+		overrides: overrides,
+		maxQueue:  maxQueue,
+		maxWait:   maxWait,
+		models:    make(map[string]*Gate),
+	}
+}
+
+// Load creates the limiter from the MAX_CONCURRENT*, MODEL_CONCURRENCY and QUEUE_* configuration.
+func Load() (*Limiter, error) {
+	overrides := make(map[string]int)
+	for _, entry := range config.AppConfig.ModelConcurrency {
+		model, limit, ok := strings.Cut(entry, "=")
+		n, err := strconv.Atoi(strings.TrimSpace(limit))
+		if !ok || err != nil || n < 0 || strings.TrimSpace(model) == "" {
+			return nil, fmt.Errorf("invalid model concurrency %q, expected model=limit", entry)
+		}
+		overrides[strings.TrimSpace(model)] = n
+	}
+	return NewLimiter(config.AppConfig.MaxConcurrent, config.AppConfig.MaxConcurrentPerModel, overrides,
+		config.AppConfig.QueueMaxLength, config.AppConfig.QueueMaxWait), nil
+}
+
+// Acquire waits for a slot of the model's gate and then of the global gate, and returns the
+// function that gives both back. The narrower gate comes first, so a request never holds a
+// global slot while it waits for its model.
+func (l *Limiter) Acquire(ctx context.Context, model string) (func(), error) {
+	releaseModel := func() {}
+	if g := l.gate(model); g != nil {
+		var err error
+		if releaseModel, err = g.Acquire(ctx); err != nil {
+			return nil, err
+		}
+	}
+	releaseGlobal, err := l.global.Acquire(ctx)
+	if err != nil {
+		releaseModel()
+		return nil, err
+	}
+	return func() {
+		releaseGlobal()
+		releaseModel()
+	}, nil
+}
+
+// gate returns the gate of a model, creating it on first use, or nil if the model has no limit.
+// Only target models and models with a limit of their own get a gate each; any other model name
+// a client sends goes through the OtherGate, so that the number of gates stays bounded.
+func (l *Limiter) gate(model string) *Gate {
+	limit := l.perModel
+	if override, ok := l.overrides[model]; ok {
+		limit = override
+	} else if !slices.Contains(gemini.TargetModels, model) {
+		model = OtherGate
+	}
+	if limit <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	g, ok := l.models[model]
+	if !ok {
+		g = NewGate(model, limit, l.maxQueue, l.maxWait)
+		l.models[model] = g
+	}
+	return g
+}
+
+// Stats returns snapshots of the global gate and of every model gate, sorted by model.
+func (l *Limiter) Stats() []Stats {
+	l.mu.Lock()
+	gates := make([]*Gate, 0, len(l.models))
+	for _, g := range l.models {
+		gates = append(gates, g)
+	}
+	l.mu.Unlock()
+	sort.Slice(gates, func(i, j int) bool { return gates[i].name < gates[j].name })
+
+	stats := []Stats{l.global.Stats()}
+	for _, g := range gates {
+		stats = append(stats, g.Stats())
+	}
+	return stats
+}
+
+var current atomic.Pointer[Limiter]
+
+// SetLimiter installs the limiter returned by Current.
+func SetLimiter(l *Limiter) {
+	current.Store(l)
+}
+
+// Current returns the installed limiter, or one without limits if none was installed.
+func Current() *Limiter {
+	if l := current.Load(); l != nil {
+		return l
+	}
+	return unlimited
+}
+
+// unlimited is used until a limiter is installed. It is shared so that its statistics add up.
+var unlimited = NewLimiter(0, 0, nil, 0, 0)
@@ -0,0 +1,174 @@
+package concurrency
+
+import (
+	"context"
+	"gemini-anti-truncate-go/internal/config"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Initialize config for tests
+func init() {
+	config.Load()
+}
+
+func TestGate_FIFO(t *testing.T) {
+	g := NewGate("test", 1, 10, time.Second)
+	release, err := g.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var mu sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	for i := 1; i <= 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			release, err := g.Acquire(context.Background())
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+			release()
+		}(i)
+		// Let the waiter queue up before the next one
+		for g.Stats().Queued != i {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	release()
+	wg.Wait()
+
+	if len(order) != 3 || order[0] != 1 || order[1] != 2 || order[2] != 3 {
+		t.Errorf("Expected waiters to be served in order [1 2 3], got %v", order)
+	}
+	stats := g.Stats()
+	if stats.Admitted != 4 || stats.Waited != 3 || stats.Active != 0 || stats.Queued != 0 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+	if stats.WaitTotal <= 0 || stats.WaitMax <= 0 {
+		t.Errorf("Expected the wait time to be recorded, got %+v", stats)
+	}
+}
+
+func TestGate_QueueFullAndTimeout(t *testing.T) {
+	g := NewGate("test", 1, 1, 20*time.Millisecond)
+	release, _ := g.Acquire(context.Background())
+	defer release()
+
+	done := make(chan error)
+	go func() {
+		_, err := g.Acquire(context.Background())
+		done <- err
+	}()
+	for g.Stats().Queued != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The queue holds a single request
+	if _, err := g.Acquire(context.Background()); err != ErrQueueFull {
+		t.Errorf("Expected ErrQueueFull, got %v", err)
+	}
+	// The queued request gives up after the maximum wait
+	if err := <-done; err != ErrQueueTimeout {
+		t.Errorf("Expected ErrQueueTimeout, got %v", err)
+	}
+
+	stats := g.Stats()
+	if stats.Rejected != 1 || stats.TimedOut != 1 || stats.Queued != 0 || stats.Active != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestGate_ContextCanceled(t *testing.T) {
+	g := NewGate("test", 1, 1, time.Minute)
+	release, _ := g.Acquire(context.Background())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := g.Acquire(ctx); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+
+	// The canceled waiter left the queue, so the slot is free again after the release
+	release()
+	if stats := g.Stats(); stats.Active != 0 || stats.Queued != 0 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestLimiter_PerModel(t *testing.T) {
+	l := NewLimiter(2, 1, map[string]int{"gemini-2.5-flash": 0}, 0, time.Second)
+
+	releasePro, err := l.Acquire(context.Background(), "gemini-2.5-pro")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// The model's single slot is taken, and nothing may queue
+	if _, err := l.Acquire(context.Background(), "gemini-2.5-pro"); err != ErrQueueFull {
+		t.Errorf("Expected ErrQueueFull for the model, got %v", err)
+	}
+	// Another model has no limit of its own, but the global limit of 2 applies
+	releaseFlash, err := l.Acquire(context.Background(), "gemini-2.5-flash")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := l.Acquire(context.Background(), "gemini-2.5-flash"); err != ErrQueueFull {
+		t.Errorf("Expected ErrQueueFull for the global gate, got %v", err)
+	}
+
+	stats := l.Stats()
+	if len(stats) != 2 || stats[0].Name != GlobalGate || stats[0].Active != 2 || stats[1].Name != "gemini-2.5-pro" || stats[1].Active != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+
+	releasePro()
+	releaseFlash()
+	if stats := l.Stats(); stats[0].Active != 0 || stats[1].Active != 0 {
+		t.Errorf("Expected all slots to be released, got %+v", stats)
+	}
+}
+
+func TestLimiter_UnknownModelsShareAGate(t *testing.T) {
+	l := NewLimiter(0, 1, nil, 0, time.Second)
+
+	release, err := l.Acquire(context.Background(), "made-up-model-1")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// Models that are not configured share one gate instead of getting a gate each
+	if _, err := l.Acquire(context.Background(), "made-up-model-2"); err != ErrQueueFull {
+		t.Errorf("Expected ErrQueueFull for the shared gate, got %v", err)
+	}
+
+	stats := l.Stats()
+	if len(stats) != 2 || stats[1].Name != OtherGate || stats[1].Active != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+	release()
+}
+
+func TestLoad(t *testing.T) {
+	defer func(cfg config.Config) { *config.AppConfig = cfg }(*config.AppConfig)
+
+	config.AppConfig.ModelConcurrency = []string{"gemini-2.5-pro=4", "gemini-2.5-flash = 8"}
+	l, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if l.overrides["gemini-2.5-pro"] != 4 || l.overrides["gemini-2.5-flash"] != 8 {
+		t.Errorf("Unexpected overrides: %v", l.overrides)
+	}
+
+	config.AppConfig.ModelConcurrency = []string{"gemini-2.5-pro"}
+	if _, err := Load(); err == nil {
+		t.Error("Expected an error for an entry without a limit")
+	}
+}
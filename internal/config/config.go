@@ -1,17 +1,81 @@
 package config
 
 import (
+	"bytes"
+	"encoding/json"
 	"gemini-anti-truncate-go/internal/gemini"
+	"net/url"
 	"os"
+	"reflect"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // Config holds all configuration for the application.
 type Config struct {
-	UpstreamURLBase string
-	MaxRetries      int
-	DebugMode       bool
-	Port            int
+	UpstreamURLBase string `json:"upstreamUrlBase"`
+	MaxRetries      int    `json:"maxRetries"` // Default for MaxErrorRetries and MaxContinuations
+	DebugMode       bool   `json:"debugMode"`  // Shorthand for LogLevel "debug"
+	Port            int    `json:"port"`
+	LogLevel        string `json:"logLevel"`  // debug, info, warn or error
+	LogFormat       string `json:"logFormat"` // text or json
+
+	MaxErrorRetries  int           `json:"maxErrorRetries"`  // Retries of upstream errors (HTTP and transport) per request
+	MaxContinuations int           `json:"maxContinuations"` // Continuations of truncated answers per request
+	RequestDeadline  time.Duration `json:"requestDeadline"`  // Wall-clock limit for all attempts of a request, 0 for none
+
+	RetryBaseDelay time.Duration `json:"retryBaseDelay"` // Delay before the first retry of a failed upstream request
+	RetryMaxDelay  time.Duration `json:"retryMaxDelay"`  // Cap on the exponential backoff delay
+	RetryJitter    float64       `json:"retryJitter"`    // Fraction of each delay that is randomized, between 0 and 1
+
+	RetryPolicyFile string `json:"retryPolicyFile"` // Path of a JSON retry policy, see internal/retry
+	RetryPolicy     string `json:"retryPolicy"`     // Inline JSON retry policy, used when no file is given
+
+	GeminiAPIKeys   []string      `json:"geminiApiKeys"`   // Server-side keys of the default key pool, see internal/keypool
+	KeyPoolFile     string        `json:"keyPoolFile"`     // Path of a JSON file with named key pools and the client tokens that use them
+	KeyPoolStrategy string        `json:"keyPoolStrategy"` // How keys are picked from a pool: round_robin or least_recently_limited
+	KeyQuarantine   time.Duration `json:"keyQuarantine"`   // How long a rate-limited key is left out of its pool
+
+	ProxyTokens     []string `json:"proxyTokens"`     // Proxy access tokens as id:token or id:token:pool, see internal/auth
+	ProxyTokensFile string   `json:"proxyTokensFile"` // Path of a JSON file of client identities and hashed access tokens
+
+	// Token-bucket rate limits on upstream attempts, see internal/ratelimit. Zero disables a limit.
+	ClientRequestsPerMinute int `json:"clientRequestsPerMinute"`
+	ClientTokensPerMinute   int `json:"clientTokensPerMinute"`
+	KeyRequestsPerMinute    int `json:"keyRequestsPerMinute"`
+	KeyTokensPerMinute      int `json:"keyTokensPerMinute"`
+	ModelRequestsPerMinute  int `json:"modelRequestsPerMinute"`
+	ModelTokensPerMinute    int `json:"modelTokensPerMinute"`
+
+	MaxConcurrent         int           `json:"maxConcurrent"`         // Client requests in flight at once, 0 for no limit
+	MaxConcurrentPerModel int           `json:"maxConcurrentPerModel"` // The same per model, 0 for no limit
+	ModelConcurrency      []string      `json:"modelConcurrency"`      // Per-model overrides as model=limit
+	QueueMaxLength        int           `json:"queueMaxLength"`        // Requests that may wait for a free slot at each gate
+	QueueMaxWait          time.Duration `json:"queueMaxWait"`          // How long a request waits for a free slot before it is rejected
+
+	OTLPEndpoint     string   `json:"otlpEndpoint"`     // Base URL of the OTLP/HTTP collector traces are exported to; tracing is off without it
+	OTLPHeaders      []string `json:"otlpHeaders"`      // Extra headers of export requests as key=value
+	ServiceName      string   `json:"serviceName"`      // service.name of the exported spans
+	TraceSampleRatio float64  `json:"traceSampleRatio"` // Fraction of new traces that are sampled, between 0 and 1
+
+	ReadinessProbeUpstream bool          `json:"readinessProbeUpstream"` // Whether /readyz lists the upstream's models to check that it is reachable
+	ReadinessProbeInterval time.Duration `json:"readinessProbeInterval"` // How long the result of an upstream probe is reused
+
+	ReadTimeout         time.Duration `json:"readTimeout"`         // Limit for reading a client request, body included
+	WriteTimeout        time.Duration `json:"writeTimeout"`        // Limit for writing a response, streams included; 0 for none
+	IdleTimeout         time.Duration `json:"idleTimeout"`         // How long an idle keep-alive connection is kept open
+	ShutdownGracePeriod time.Duration `json:"shutdownGracePeriod"` // How long requests in flight may run on after SIGTERM or SIGINT
+
+	UpstreamDialTimeout           time.Duration `json:"upstreamDialTimeout"`           // Limit for opening a TCP connection to the upstream
+	UpstreamTLSHandshakeTimeout   time.Duration `json:"upstreamTlsHandshakeTimeout"`   // Limit for the TLS handshake with the upstream
+	UpstreamResponseHeaderTimeout time.Duration `json:"upstreamResponseHeaderTimeout"` // Limit for the upstream response headers once a request is sent
+	UpstreamIdleConnTimeout       time.Duration `json:"upstreamIdleConnTimeout"`       // How long an idle upstream connection is kept in the pool
+	UpstreamStreamIdleTimeout     time.Duration `json:"upstreamStreamIdleTimeout"`     // Silence on an HTTP/2 connection after which it is health-checked with a ping
+	UpstreamMaxIdleConnsPerHost   int           `json:"upstreamMaxIdleConnsPerHost"`   // Idle upstream connections kept in the pool
+
+	StreamFirstChunkTimeout time.Duration `json:"streamFirstChunkTimeout"` // Wait for the first data of an upstream stream before it is treated as stalled; 0 for none
+	StreamChunkTimeout      time.Duration `json:"streamChunkTimeout"`      // Silence between data of an upstream stream before it is treated as stalled; 0 for none
 }
 
 // AppConfig is a global variable holding the application's configuration.
@@ -19,12 +83,150 @@ var AppConfig *Config
 
 // Load loads configuration from environment variables and populates the AppConfig global variable.
 func Load() {
+	maxRetries := getEnvAsInt("MAX_RETRIES", gemini.DefaultMaxRetries)
 	AppConfig = &Config{
 		UpstreamURLBase: getEnv("UPSTREAM_URL_BASE", gemini.DefaultUpstreamURL),
-		MaxRetries:      getEnvAsInt("MAX_RETRIES", gemini.DefaultMaxRetries),
+		MaxRetries:      maxRetries,
 		DebugMode:       getEnvAsBool("DEBUG_MODE", false),
 		Port:            getEnvAsInt("HTTP_PORT", gemini.DefaultHTTPPort),
+		LogLevel:        getEnv("LOG_LEVEL", "info"),
+		LogFormat:       getEnv("LOG_FORMAT", "text"),
+
+		MaxErrorRetries:  getEnvAsInt("MAX_ERROR_RETRIES", maxRetries),
+		MaxContinuations: getEnvAsInt("MAX_CONTINUATIONS", maxRetries),
+		RequestDeadline:  getEnvAsDuration("REQUEST_DEADLINE", gemini.DefaultRequestDeadline),
+
+		RetryBaseDelay: getEnvAsDuration("RETRY_BASE_DELAY", gemini.DefaultRetryBaseDelay),
+		RetryMaxDelay:  getEnvAsDuration("RETRY_MAX_DELAY", gemini.DefaultRetryMaxDelay),
+		RetryJitter:    getEnvAsFloat("RETRY_JITTER", gemini.DefaultRetryJitter),
+
+		RetryPolicyFile: getEnv("RETRY_POLICY_FILE", ""),
+		RetryPolicy:     getEnv("RETRY_POLICY", ""),
+
+		GeminiAPIKeys:   getEnvAsList("GEMINI_API_KEY"),
+		KeyPoolFile:     getEnv("KEY_POOL_FILE", ""),
+		KeyPoolStrategy: getEnv("KEY_POOL_STRATEGY", gemini.DefaultKeyPoolStrategy),
+		KeyQuarantine:   getEnvAsDuration("KEY_QUARANTINE", gemini.DefaultKeyQuarantine),
+
+		ProxyTokens:     getEnvAsList("PROXY_TOKENS"),
+		ProxyTokensFile: getEnv("PROXY_TOKENS_FILE", ""),
+
+		ClientRequestsPerMinute: getEnvAsInt("RATE_LIMIT_CLIENT_RPM", 0),
+		ClientTokensPerMinute:   getEnvAsInt("RATE_LIMIT_CLIENT_TPM", 0),
+		KeyRequestsPerMinute:    getEnvAsInt("RATE_LIMIT_KEY_RPM", 0),
+		KeyTokensPerMinute:      getEnvAsInt("RATE_LIMIT_KEY_TPM", 0),
+		ModelRequestsPerMinute:  getEnvAsInt("RATE_LIMIT_MODEL_RPM", 0),
+		ModelTokensPerMinute:    getEnvAsInt("RATE_LIMIT_MODEL_TPM", 0),
+
+		MaxConcurrent:         getEnvAsInt("MAX_CONCURRENT", 0),
+		MaxConcurrentPerModel: getEnvAsInt("MAX_CONCURRENT_PER_MODEL", 0),
+		ModelConcurrency:      getEnvAsList("MODEL_CONCURRENCY"),
+		QueueMaxLength:        getEnvAsInt("QUEUE_MAX_LENGTH", gemini.DefaultQueueMaxLength),
+		QueueMaxWait:          getEnvAsDuration("QUEUE_MAX_WAIT", gemini.DefaultQueueMaxWait),
+
+		OTLPEndpoint:     getEnv("OTEL_EXPORTER_OTLP_ENDPOINT", ""),
+		OTLPHeaders:      getEnvAsList("OTEL_EXPORTER_OTLP_HEADERS"),
+		ServiceName:      getEnv("OTEL_SERVICE_NAME", gemini.DefaultServiceName),
+		TraceSampleRatio: getEnvAsFloat("TRACE_SAMPLE_RATIO", gemini.DefaultTraceSampleRatio),
+
+		ReadinessProbeUpstream: getEnvAsBool("READINESS_PROBE_UPSTREAM", false),
+		ReadinessProbeInterval: getEnvAsDuration("READINESS_PROBE_INTERVAL", gemini.DefaultReadinessProbeInterval),
+
+		ReadTimeout:         getEnvAsDuration("SERVER_READ_TIMEOUT", gemini.DefaultReadTimeout),
+		WriteTimeout:        getEnvAsDuration("SERVER_WRITE_TIMEOUT", gemini.DefaultWriteTimeout),
+		IdleTimeout:         getEnvAsDuration("SERVER_IDLE_TIMEOUT", gemini.DefaultIdleTimeout),
+		ShutdownGracePeriod: getEnvAsDuration("SHUTDOWN_GRACE_PERIOD", gemini.DefaultShutdownGracePeriod),
+
+		UpstreamDialTimeout:           getEnvAsDuration("UPSTREAM_DIAL_TIMEOUT", gemini.DefaultUpstreamDialTimeout),
+		UpstreamTLSHandshakeTimeout:   getEnvAsDuration("UPSTREAM_TLS_HANDSHAKE_TIMEOUT", gemini.DefaultUpstreamTLSHandshakeTimeout),
+		UpstreamResponseHeaderTimeout: getEnvAsDuration("UPSTREAM_RESPONSE_HEADER_TIMEOUT", gemini.DefaultUpstreamResponseHeaderTimeout),
+		UpstreamIdleConnTimeout:       getEnvAsDuration("UPSTREAM_IDLE_CONN_TIMEOUT", gemini.DefaultUpstreamIdleConnTimeout),
+		UpstreamStreamIdleTimeout:     getEnvAsDuration("UPSTREAM_STREAM_IDLE_TIMEOUT", gemini.DefaultUpstreamStreamIdleTimeout),
+		UpstreamMaxIdleConnsPerHost:   getEnvAsInt("UPSTREAM_MAX_IDLE_CONNS_PER_HOST", gemini.DefaultUpstreamMaxIdleConnsPerHost),
+
+		StreamFirstChunkTimeout: getEnvAsDuration("STREAM_FIRST_CHUNK_TIMEOUT", gemini.DefaultStreamFirstChunkTimeout),
+		StreamChunkTimeout:      getEnvAsDuration("STREAM_CHUNK_TIMEOUT", gemini.DefaultStreamChunkTimeout),
+	}
+}
+
+// MarshalJSON encodes the configuration under the names of its json tags, with durations in the
+// format they are configured in, such as "1m30s", rather than in nanoseconds.
+func (c Config) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	v := reflect.ValueOf(c)
+	for i := 0; i < v.NumField(); i++ {
+		value := v.Field(i).Interface()
+		if d, ok := value.(time.Duration); ok {
+			value = d.String()
+		}
+		name, _ := json.Marshal(v.Type().Field(i).Tag.Get("json"))
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(encoded)
 	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// redacted replaces secrets in the effective configuration.
+const redacted = "[REDACTED]"
+
+// Redacted returns a copy of the configuration that is safe to show: upstream API keys, proxy
+// access tokens, exporter header values and passwords in URLs are replaced, while the client IDs,
+// pools and header names around them are kept. The query values of URLs are replaced as well,
+// as they may carry an API key.
+func (c Config) Redacted() Config {
+	c.UpstreamURLBase = redactURL(c.UpstreamURLBase)
+	c.OTLPEndpoint = redactURL(c.OTLPEndpoint)
+	c.GeminiAPIKeys = make([]string, len(c.GeminiAPIKeys))
+	for i := range c.GeminiAPIKeys {
+		c.GeminiAPIKeys[i] = redacted
+	}
+	tokens := make([]string, len(c.ProxyTokens))
+	for i, entry := range c.ProxyTokens {
+		// id:token or id:token:pool
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) < 2 {
+			tokens[i] = redacted
+			continue
+		}
+		parts[1] = redacted
+		tokens[i] = strings.Join(parts, ":")
+	}
+	c.ProxyTokens = tokens
+	headers := make([]string, len(c.OTLPHeaders))
+	for i, entry := range c.OTLPHeaders {
+		name, _, _ := strings.Cut(entry, "=")
+		headers[i] = name + "=" + redacted
+	}
+	c.OTLPHeaders = headers
+	return c
+}
+
+// redactURL replaces the password of a URL's user info with "xxxxx" and the values of its query
+// parameters, such as ?key=..., with [REDACTED].
+func redactURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil {
+		return value
+	}
+	if u.RawQuery != "" {
+		params := strings.Split(u.RawQuery, "&")
+		for i, param := range params {
+			name, _, _ := strings.Cut(param, "=")
+			params[i] = name + "=" + redacted
+		}
+		u.RawQuery = strings.Join(params, "&")
+	}
+	return u.Redacted()
 }
 
 // getEnv retrieves a string value from an environment variable or returns a default value.
@@ -52,3 +254,32 @@ func getEnvAsBool(key string, defaultValue bool) bool {
 	}
 	return defaultValue
 }
+
+// getEnvAsFloat retrieves a floating-point value from an environment variable or returns a default value.
+func getEnvAsFloat(key string, defaultValue float64) float64 {
+	valueStr := getEnv(key, "")
+	if value, err := strconv.ParseFloat(valueStr, 64); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+// getEnvAsDuration retrieves a duration such as "500ms" or "2s" from an environment variable or returns a default value.
+func getEnvAsDuration(key string, defaultValue time.Duration) time.Duration {
+	valueStr := getEnv(key, "")
+	if value, err := time.ParseDuration(valueStr); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+// getEnvAsList retrieves a comma-separated list from an environment variable, leaving out blank entries.
+func getEnvAsList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(getEnv(key, ""), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
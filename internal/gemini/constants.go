@@ -1,5 +1,7 @@
 package gemini
 
+import "time"
+
 const (
 	FinishToken          = "[RESPONSE_FINISHED]"
 	UserPromptSuffix     = "\n\n(Note: If you are done, please end your response with " + FinishToken + ")"
@@ -8,6 +10,37 @@ const (
 	DefaultMaxRetries    = 20
 	DefaultHTTPPort      = 8080
 	TokenLookbehindChars = len(FinishToken) + 5 // A little buffer for lookbehind
+
+	DefaultRequestDeadline = 10 * time.Minute
+	DefaultRetryBaseDelay  = 500 * time.Millisecond
+	DefaultRetryMaxDelay   = 30 * time.Second
+	DefaultRetryJitter     = 0.5
+
+	DefaultKeyPoolStrategy = "round_robin"
+	DefaultKeyQuarantine   = time.Minute
+
+	DefaultQueueMaxLength = 100
+	DefaultQueueMaxWait   = 30 * time.Second
+
+	DefaultServiceName      = "gemini-anti-truncate-proxy"
+	DefaultTraceSampleRatio = 1.0
+
+	DefaultReadinessProbeInterval = 30 * time.Second
+
+	DefaultReadTimeout         = time.Minute
+	DefaultWriteTimeout        = 15 * time.Minute // Longer than DefaultRequestDeadline, so that streams are not cut off
+	DefaultIdleTimeout         = 2 * time.Minute
+	DefaultShutdownGracePeriod = 30 * time.Second
+
+	DefaultUpstreamDialTimeout           = 10 * time.Second
+	DefaultUpstreamTLSHandshakeTimeout   = 10 * time.Second
+	DefaultUpstreamResponseHeaderTimeout = 5 * time.Minute // Streams only; a non-stream answer only gets its headers once it is generated
+	DefaultUpstreamIdleConnTimeout       = 90 * time.Second
+	DefaultUpstreamStreamIdleTimeout     = 30 * time.Second
+	DefaultUpstreamMaxIdleConnsPerHost   = 32
+
+	DefaultStreamFirstChunkTimeout = 2 * time.Minute // Long enough for a model that thinks before answering
+	DefaultStreamChunkTimeout      = time.Minute
 )
 
 var TargetModels = []string{
@@ -20,5 +53,51 @@ var TargetModels = []string{
 	"gemini-2.5-pro",
 }
 
+// RetryableStatus and FatalStatus were the hard-coded status lists of the first releases.
+//
+// Deprecated: upstream errors are now classified by the retry policy in internal/retry.
 var RetryableStatus = []int{503, 403, 429}
 var FatalStatus = []int{500}
+
+// Finish reasons reported in Candidate.FinishReason.
+const (
+	FinishReasonUnspecified           = "FINISH_REASON_UNSPECIFIED"
+	FinishReasonStop                  = "STOP"
+	FinishReasonMaxTokens             = "MAX_TOKENS"
+	FinishReasonSafety                = "SAFETY"
+	FinishReasonRecitation            = "RECITATION"
+	FinishReasonLanguage              = "LANGUAGE"
+	FinishReasonOther                 = "OTHER"
+	FinishReasonBlocklist             = "BLOCKLIST"
+	FinishReasonProhibitedContent     = "PROHIBITED_CONTENT"
+	FinishReasonSPII                  = "SPII"
+	FinishReasonMalformedFunctionCall = "MALFORMED_FUNCTION_CALL"
+	FinishReasonImageSafety           = "IMAGE_SAFETY"
+	FinishReasonUnexpectedToolCall    = "UNEXPECTED_TOOL_CALL"
+	FinishReasonTooManyToolCalls      = "TOO_MANY_TOOL_CALLS"
+)
+
+// statusNames maps HTTP status codes to the google.rpc.Code names used in the status
+// field of Gemini error objects.
+var statusNames = map[int]string{
+	400: "INVALID_ARGUMENT",
+	401: "UNAUTHENTICATED",
+	403: "PERMISSION_DENIED",
+	404: "NOT_FOUND",
+	409: "ABORTED",
+	429: "RESOURCE_EXHAUSTED",
+	499: "CANCELLED",
+	500: "INTERNAL",
+	501: "UNIMPLEMENTED",
+	502: "UNAVAILABLE",
+	503: "UNAVAILABLE",
+	504: "DEADLINE_EXCEEDED",
+}
+
+// StatusName returns the Gemini error status for an HTTP status code, e.g. RESOURCE_EXHAUSTED for 429.
+func StatusName(code int) string {
+	if name, ok := statusNames[code]; ok {
+		return name
+	}
+	return "UNKNOWN"
+}
@@ -0,0 +1,409 @@
+package gemini
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// The Gemini API evolves faster than the structs in this package, so every type that is
+// decoded from a client request or an upstream response remembers the raw JSON it came
+// from. When such a value is marshalled again, the raw object is used as the base and only
+// the members whose modelled value actually changed are patched. Unknown fields (toolConfig,
+// cachedContent, usageMetadata, ...) and untouched members therefore round-trip byte-for-byte.
+
+// unmarshalPreserving decodes data into v and keeps a private copy of the raw bytes.
+func unmarshalPreserving(data []byte, v interface{}, raw *json.RawMessage) error {
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+	*raw = append(json.RawMessage(nil), data...)
+	return nil
+}
+
+// marshalPreserving encodes v (a type without its own MarshalJSON) on top of raw.
+// Members of raw that are unknown to v are kept untouched, members whose value is
+// unchanged keep their original bytes, changed members are replaced, new members are
+// appended and known members that are now omitted are removed.
+func marshalPreserving(v interface{}, raw json.RawMessage) ([]byte, error) {
+	fresh, err := encodeJSON(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) == 0 {
+		return fresh, nil
+	}
+
+	freshMembers, _, err := objectMembers(fresh)
+	if err != nil {
+		return nil, err
+	}
+	out := raw
+	if _, _, err := objectMembers(out); err != nil {
+		// Not an object: nothing to preserve.
+		return fresh, nil
+	}
+
+	present := make(map[string]bool, len(freshMembers))
+	for _, fm := range freshMembers {
+		present[fm.key] = true
+		if out, err = setMember(out, fm.key, fresh[fm.valueStart:fm.valueEnd]); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, key := range jsonKeys(reflect.TypeOf(v)) {
+		if present[key] {
+			continue
+		}
+		if out, err = deleteMember(out, key); err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+// encodeJSON marshals v without HTML escaping, so patched text stays readable.
+func encodeJSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+var jsonKeysCache sync.Map // reflect.Type -> []string
+
+// jsonKeys returns the JSON member names modelled by a struct type.
+func jsonKeys(t reflect.Type) []string {
+	if cached, ok := jsonKeysCache.Load(t); ok {
+		return cached.([]string)
+	}
+	var keys []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		keys = append(keys, name)
+	}
+	jsonKeysCache.Store(t, keys)
+	return keys
+}
+
+// rawMember locates a single member of a raw JSON object.
+type rawMember struct {
+	key        string
+	start      int // offset of the opening quote of the key
+	valueStart int
+	valueEnd   int
+}
+
+var errNotObject = errors.New("raw JSON value is not an object")
+
+// objectMembers lists the members of a raw JSON object and returns the offset of its closing brace.
+func objectMembers(data []byte) ([]rawMember, int, error) {
+	i := skipSpace(data, 0)
+	if i >= len(data) || data[i] != '{' {
+		return nil, 0, errNotObject
+	}
+	i++
+
+	var members []rawMember
+	for {
+		i = skipSpace(data, i)
+		if i >= len(data) {
+			return nil, 0, errors.New("unexpected end of JSON object")
+		}
+		if data[i] == '}' {
+			return members, i, nil
+		}
+
+		keyEnd, err := scanValue(data, i)
+		if err != nil {
+			return nil, 0, err
+		}
+		var key string
+		if err := json.Unmarshal(data[i:keyEnd], &key); err != nil {
+			return nil, 0, err
+		}
+
+		colon := skipSpace(data, keyEnd)
+		if colon >= len(data) || data[colon] != ':' {
+			return nil, 0, fmt.Errorf("expected ':' after key %q", key)
+		}
+		valueStart := skipSpace(data, colon+1)
+		valueEnd, err := scanValue(data, valueStart)
+		if err != nil {
+			return nil, 0, err
+		}
+		members = append(members, rawMember{key: key, start: i, valueStart: valueStart, valueEnd: valueEnd})
+
+		i = skipSpace(data, valueEnd)
+		if i < len(data) && data[i] == ',' {
+			i++
+		}
+	}
+}
+
+// setMember replaces the value of key in a raw JSON object (see mergeJSON), or appends the
+// member if it is missing.
+func setMember(data []byte, key string, value []byte) ([]byte, error) {
+	members, closing, err := objectMembers(data)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range members {
+		if m.key != key {
+			continue
+		}
+		old := data[m.valueStart:m.valueEnd]
+		return splice(data, m.valueStart, m.valueEnd, mergeJSON(old, value)), nil
+	}
+
+	// A zero value that was simply absent from the original stays absent.
+	if isZeroJSON(value) {
+		return data, nil
+	}
+
+	quotedKey, err := json.Marshal(key)
+	if err != nil {
+		return nil, err
+	}
+	member := append(append(quotedKey, ':'), value...)
+	if len(members) > 0 {
+		last := members[len(members)-1]
+		return splice(data, last.valueEnd, last.valueEnd, append([]byte{','}, member...)), nil
+	}
+	return splice(data, closing, closing, member), nil
+}
+
+// deleteMember removes key from a raw JSON object if it is present with a non-zero value.
+func deleteMember(data []byte, key string) ([]byte, error) {
+	members, _, err := objectMembers(data)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, m := range members {
+		if m.key != key {
+			continue
+		}
+		// An explicit zero value in the original is just as absent as an omitted one.
+		if isZeroJSON(data[m.valueStart:m.valueEnd]) {
+			return data, nil
+		}
+		switch {
+		case k > 0:
+			return splice(data, members[k-1].valueEnd, m.valueEnd, nil), nil
+		case len(members) > 1:
+			return splice(data, m.start, members[1].start, nil), nil
+		default:
+			return splice(data, m.start, m.valueEnd, nil), nil
+		}
+	}
+	return data, nil
+}
+
+// mergeJSON returns a value equal to fresh that reuses the bytes of raw wherever the two
+// agree: objects are patched member by member and arrays of the same length element by
+// element, so untouched siblings of a changed value keep their original formatting.
+func mergeJSON(raw, fresh []byte) []byte {
+	if jsonEqual(raw, fresh) {
+		return raw
+	}
+
+	if rawMembers, _, err := objectMembers(raw); err == nil {
+		if freshMembers, _, err := objectMembers(fresh); err == nil {
+			out := raw
+			present := make(map[string]bool, len(freshMembers))
+			for _, fm := range freshMembers {
+				present[fm.key] = true
+				if out, err = setMember(out, fm.key, fresh[fm.valueStart:fm.valueEnd]); err != nil {
+					return fresh
+				}
+			}
+			for _, rm := range rawMembers {
+				if present[rm.key] {
+					continue
+				}
+				if out, err = deleteMember(out, rm.key); err != nil {
+					return fresh
+				}
+			}
+			return out
+		}
+	}
+
+	rawElems, rawErr := arrayElements(raw)
+	freshElems, freshErr := arrayElements(fresh)
+	if rawErr == nil && freshErr == nil && len(rawElems) == len(freshElems) {
+		out := raw
+		// Patch from the back so that earlier offsets stay valid.
+		for k := len(rawElems) - 1; k >= 0; k-- {
+			re, fe := rawElems[k], freshElems[k]
+			out = splice(out, re[0], re[1], mergeJSON(raw[re[0]:re[1]], fresh[fe[0]:fe[1]]))
+		}
+		return out
+	}
+
+	return fresh
+}
+
+// arrayElements returns the [start, end) offsets of the elements of a raw JSON array.
+func arrayElements(data []byte) ([][2]int, error) {
+	i := skipSpace(data, 0)
+	if i >= len(data) || data[i] != '[' {
+		return nil, errors.New("raw JSON value is not an array")
+	}
+	i++
+
+	var elems [][2]int
+	for {
+		i = skipSpace(data, i)
+		if i >= len(data) {
+			return nil, errors.New("unexpected end of JSON array")
+		}
+		if data[i] == ']' {
+			return elems, nil
+		}
+		end, err := scanValue(data, i)
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, [2]int{i, end})
+		i = skipSpace(data, end)
+		if i < len(data) && data[i] == ',' {
+			i++
+		}
+	}
+}
+
+// splice returns a new slice with data[start:end] replaced by insert. data is never modified.
+func splice(data []byte, start, end int, insert []byte) []byte {
+	out := make([]byte, 0, len(data)-(end-start)+len(insert))
+	out = append(out, data[:start]...)
+	out = append(out, insert...)
+	return append(out, data[end:]...)
+}
+
+// jsonEqual reports whether two raw JSON values are equal, ignoring formatting.
+func jsonEqual(a, b []byte) bool {
+	if bytes.Equal(a, b) {
+		return true
+	}
+	var compactA, compactB bytes.Buffer
+	if json.Compact(&compactA, a) == nil && json.Compact(&compactB, b) == nil && bytes.Equal(compactA.Bytes(), compactB.Bytes()) {
+		return true
+	}
+	var va, vb interface{}
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return false
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+// isZeroJSON reports whether a raw JSON value is null, false, 0, "", [] or {}.
+func isZeroJSON(value []byte) bool {
+	var v interface{}
+	if err := json.Unmarshal(value, &v); err != nil {
+		return false
+	}
+	switch v := v.(type) {
+	case nil:
+		return true
+	case bool:
+		return !v
+	case float64:
+		return v == 0
+	case string:
+		return v == ""
+	case []interface{}:
+		return len(v) == 0
+	case map[string]interface{}:
+		return len(v) == 0
+	}
+	return false
+}
+
+// skipSpace returns the offset of the next non-whitespace byte.
+func skipSpace(data []byte, i int) int {
+	for i < len(data) {
+		switch data[i] {
+		case ' ', '\t', '\n', '\r':
+			i++
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// scanValue returns the offset just past the JSON value starting at i.
+// The input is assumed to have been validated by encoding/json already.
+func scanValue(data []byte, i int) (int, error) {
+	if i >= len(data) {
+		return 0, errors.New("unexpected end of JSON input")
+	}
+
+	switch data[i] {
+	case '"':
+		for j := i + 1; j < len(data); j++ {
+			switch data[j] {
+			case '\\':
+				j++
+			case '"':
+				return j + 1, nil
+			}
+		}
+		return 0, errors.New("unterminated JSON string")
+
+	case '{', '[':
+		depth := 0
+		for j := i; j < len(data); j++ {
+			switch data[j] {
+			case '"':
+				end, err := scanValue(data, j)
+				if err != nil {
+					return 0, err
+				}
+				j = end - 1
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+				if depth == 0 {
+					return j + 1, nil
+				}
+			}
+		}
+		return 0, errors.New("unterminated JSON container")
+
+	default:
+		// Numbers, true, false and null run until the next delimiter.
+		j := i
+		for j < len(data) {
+			switch data[j] {
+			case ',', '}', ']', ' ', '\t', '\n', '\r':
+				return j, nil
+			}
+			j++
+		}
+		return j, nil
+	}
+}
@@ -0,0 +1,126 @@
+package gemini
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestGoldenRoundTrip checks that every request and response in the golden corpus
+// survives a decode/encode round trip byte-for-byte, including unmodelled fields.
+func TestGoldenRoundTrip(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "golden", "*.json"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("Failed to find golden files: %v", err)
+	}
+
+	for _, file := range files {
+		original, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", file, err)
+		}
+		original = bytes.TrimRight(original, "\n")
+
+		var marshaler json.Marshaler
+		if strings.HasPrefix(filepath.Base(file), "request_") {
+			var req GenerateContentRequest
+			if err := json.Unmarshal(original, &req); err != nil {
+				t.Fatalf("Failed to decode %s: %v", file, err)
+			}
+			marshaler = req
+		} else {
+			var resp GenerateContentResponse
+			if err := json.Unmarshal(original, &resp); err != nil {
+				t.Fatalf("Failed to decode %s: %v", file, err)
+			}
+			marshaler = resp
+		}
+
+		roundTripped, err := marshaler.MarshalJSON()
+		if err != nil {
+			t.Fatalf("Failed to encode %s: %v", file, err)
+		}
+		if !bytes.Equal(roundTripped, original) {
+			t.Errorf("%s did not round-trip byte-for-byte.\nExpected: %s\nGot:      %s", file, original, roundTripped)
+		}
+	}
+}
+
+func TestMarshalPreserving_PatchesOnlyChangedFields(t *testing.T) {
+	original, err := os.ReadFile(filepath.Join("testdata", "golden", "request_tools.json"))
+	if err != nil {
+		t.Fatalf("Failed to read golden file: %v", err)
+	}
+
+	var req GenerateContentRequest
+	if err := json.Unmarshal(original, &req); err != nil {
+		t.Fatalf("Failed to decode request: %v", err)
+	}
+
+	req.SystemInstruction.Parts[0].Text = "You are a <careful> weather bot."
+	patched, err := req.MarshalJSON()
+	if err != nil {
+		t.Fatalf("Failed to encode request: %v", err)
+	}
+
+	expected := strings.Replace(string(bytes.TrimRight(original, "\n")), "You are a weather bot.", "You are a <careful> weather bot.", 1)
+	if string(patched) != expected {
+		t.Errorf("Expected only the system instruction text to change.\nExpected: %s\nGot:      %s", expected, patched)
+	}
+
+	// Moving the instruction to the official field removes the camelCase member
+	req.SetSystemInstruction(req.GetSystemInstruction())
+	patched, err = req.MarshalJSON()
+	if err != nil {
+		t.Fatalf("Failed to encode request: %v", err)
+	}
+	if strings.Contains(string(patched), `"systemInstruction"`) || !strings.Contains(string(patched), `"system_instruction":{"parts":[{"text":"You are a <careful> weather bot."}]}`) {
+		t.Errorf("Expected the system instruction to move to 'system_instruction', got %s", patched)
+	}
+	if !strings.Contains(string(patched), `"toolConfig":{"functionCallingConfig":{"mode":"AUTO"}}`) {
+		t.Errorf("Expected toolConfig to be preserved, got %s", patched)
+	}
+}
+
+func TestMarshalPreserving_NewValues(t *testing.T) {
+	// Values built in code have no raw JSON and marshal as usual
+	part := Part{Text: "hello"}
+	data, err := json.Marshal(part)
+	if err != nil {
+		t.Fatalf("Failed to marshal part: %v", err)
+	}
+	if string(data) != `{"text":"hello"}` {
+		t.Errorf("Expected '{\"text\":\"hello\"}', got '%s'", data)
+	}
+}
+
+func TestPart_MultimodalFields(t *testing.T) {
+	original, err := os.ReadFile(filepath.Join("testdata", "golden", "request_tools.json"))
+	if err != nil {
+		t.Fatalf("Failed to read golden file: %v", err)
+	}
+	var req GenerateContentRequest
+	if err := json.Unmarshal(original, &req); err != nil {
+		t.Fatalf("Failed to decode request: %v", err)
+	}
+
+	call := req.Contents[1].Parts[0]
+	if call.FunctionCall == nil || call.FunctionCall.Name != "get_weather" || call.ThoughtSignature != "c2lnbmF0dXJl" {
+		t.Errorf("Expected a function call with a thought signature, got %+v", call)
+	}
+	if call.IsText() {
+		t.Error("Expected a function call part not to be a text part")
+	}
+
+	response := req.Contents[2].Parts[0]
+	if response.FunctionResponse == nil || response.FunctionResponse.Response["sky"] != "clear" {
+		t.Errorf("Expected a function response, got %+v", response)
+	}
+
+	if !req.Contents[0].Parts[0].IsText() {
+		t.Error("Expected a plain text part to be a text part")
+	}
+}
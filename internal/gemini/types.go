@@ -1,5 +1,7 @@
 package gemini
 
+import "encoding/json"
+
 // GenerateContentRequest represents the request body for the generateContent endpoint.
 type GenerateContentRequest struct {
 	Contents           []Content          `json:"contents"`
@@ -8,6 +10,8 @@ type GenerateContentRequest struct {
 	GenerationConfig   *GenerationConfig  `json:"generationConfig,omitempty"`
 	SafetySettings     []SafetySetting    `json:"safetySettings,omitempty"`
 	Tools              []Tool             `json:"tools,omitempty"`
+
+	raw json.RawMessage // Original JSON, see rawjson.go
 }
 
 // GetSystemInstruction provides a unified way to get the system instruction,
@@ -30,6 +34,8 @@ func (r *GenerateContentRequest) SetSystemInstruction(si *SystemInstruction) {
 type SystemInstruction struct {
 	Role  string `json:"role,omitempty"`
 	Parts []Part `json:"parts"`
+
+	raw json.RawMessage // Original JSON, see rawjson.go
 }
 
 // GenerateContentResponse represents the full response for a non-streaming request,
@@ -37,6 +43,8 @@ type SystemInstruction struct {
 type GenerateContentResponse struct {
 	Candidates     []Candidate    `json:"candidates"`
 	PromptFeedback PromptFeedback `json:"promptFeedback,omitempty"`
+
+	raw json.RawMessage // Original JSON, see rawjson.go
 }
 
 // Candidate represents a single response candidate from the model.
@@ -46,26 +54,102 @@ type Candidate struct {
 	Index            int               `json:"index"`
 	SafetyRatings    []SafetyRating    `json:"safetyRatings,omitempty"`
 	CitationMetadata *CitationMetadata `json:"citationMetadata,omitempty"`
+
+	raw json.RawMessage // Original JSON, see rawjson.go
 }
 
 // Content represents a message in the conversation history.
 type Content struct {
 	Parts []Part `json:"parts"`
 	Role  string `json:"role"` // "user", "model", or "tool"
+
+	raw json.RawMessage // Original JSON, see rawjson.go
 }
 
 // Part represents a single part of a Content message.
+// It is a union: apart from the thought flags, exactly one of the data fields is set.
 type Part struct {
-	Text         string        `json:"text,omitempty"`
-	FunctionCall *FunctionCall `json:"functionCall,omitempty"`
+	Text                string               `json:"text,omitempty"`
+	InlineData          *Blob                `json:"inlineData,omitempty"`
+	FileData            *FileData            `json:"fileData,omitempty"`
+	FunctionCall        *FunctionCall        `json:"functionCall,omitempty"`
+	FunctionResponse    *FunctionResponse    `json:"functionResponse,omitempty"`
+	ExecutableCode      *ExecutableCode      `json:"executableCode,omitempty"`
+	CodeExecutionResult *CodeExecutionResult `json:"codeExecutionResult,omitempty"`
+	VideoMetadata       *VideoMetadata       `json:"videoMetadata,omitempty"`
 	// This field is used internally by the proxy to identify and handle "thought" blocks from the model.
 	Thought bool `json:"thought,omitempty"`
+	// ThoughtSignature is an opaque token that must be sent back with the part in later turns.
+	ThoughtSignature string `json:"thoughtSignature,omitempty"`
+
+	raw json.RawMessage // Original JSON, see rawjson.go
+}
+
+// IsText reports whether the part carries nothing but (possibly thought) text.
+// Such parts can be freely split, merged and rewritten by the proxy.
+func (p Part) IsText() bool {
+	return p.InlineData == nil && p.FileData == nil && p.FunctionCall == nil &&
+		p.FunctionResponse == nil && p.ExecutableCode == nil && p.CodeExecutionResult == nil &&
+		p.VideoMetadata == nil && p.ThoughtSignature == ""
+}
+
+// Blob holds inline media bytes, such as an image, audio clip or PDF.
+type Blob struct {
+	MIMEType string `json:"mimeType"`
+	Data     string `json:"data"` // Base64 encoded, kept as-is
+
+	raw json.RawMessage // Original JSON, see rawjson.go
+}
+
+// FileData references media uploaded through the File API or available at a URI.
+type FileData struct {
+	MIMEType string `json:"mimeType,omitempty"`
+	FileURI  string `json:"fileUri"`
+
+	raw json.RawMessage // Original JSON, see rawjson.go
 }
 
 // FunctionCall represents a function call requested by the model.
 type FunctionCall struct {
+	ID   string                 `json:"id,omitempty"`
 	Name string                 `json:"name"`
 	Args map[string]interface{} `json:"args"`
+
+	raw json.RawMessage // Original JSON, see rawjson.go
+}
+
+// FunctionResponse carries the result of a function call back to the model.
+type FunctionResponse struct {
+	ID       string                 `json:"id,omitempty"`
+	Name     string                 `json:"name"`
+	Response map[string]interface{} `json:"response"`
+
+	raw json.RawMessage // Original JSON, see rawjson.go
+}
+
+// ExecutableCode is code generated by the model for the code execution tool.
+type ExecutableCode struct {
+	Language string `json:"language"`
+	Code     string `json:"code"`
+
+	raw json.RawMessage // Original JSON, see rawjson.go
+}
+
+// CodeExecutionResult is the outcome of running ExecutableCode.
+type CodeExecutionResult struct {
+	Outcome string `json:"outcome"`
+	Output  string `json:"output,omitempty"`
+
+	raw json.RawMessage // Original JSON, see rawjson.go
+}
+
+// VideoMetadata describes the portion of a video part to use.
+type VideoMetadata struct {
+	StartOffset string  `json:"startOffset,omitempty"`
+	EndOffset   string  `json:"endOffset,omitempty"`
+	FPS         float64 `json:"fps,omitempty"`
+
+	raw json.RawMessage // Original JSON, see rawjson.go
 }
 
 // GenerationConfig specifies model parameters for the generation.
@@ -78,34 +162,46 @@ type GenerationConfig struct {
 	StopSequences    []string    `json:"stopSequences,omitempty"`
 	ResponseMIMEType string      `json:"responseMimeType,omitempty"`
 	ResponseSchema   interface{} `json:"responseSchema,omitempty"` // Can be complex, so interface{} is used.
+
+	raw json.RawMessage // Original JSON, see rawjson.go
 }
 
 // SafetySetting configures the safety thresholds for different categories.
 type SafetySetting struct {
 	Category  string `json:"category"`
 	Threshold string `json:"threshold"`
+
+	raw json.RawMessage // Original JSON, see rawjson.go
 }
 
 // Tool represents a tool definition that the model can use.
 type Tool struct {
 	FunctionDeclarations []interface{} `json:"functionDeclarations,omitempty"` // Can be complex.
+
+	raw json.RawMessage // Original JSON, see rawjson.go
 }
 
 // PromptFeedback provides feedback on the prompt, such as safety ratings.
 type PromptFeedback struct {
 	BlockReason   string         `json:"blockReason,omitempty"`
 	SafetyRatings []SafetyRating `json:"safetyRatings,omitempty"`
+
+	raw json.RawMessage // Original JSON, see rawjson.go
 }
 
 // SafetyRating provides the safety rating for a piece of content.
 type SafetyRating struct {
 	Category    string `json:"category"`
 	Probability string `json:"probability"`
+
+	raw json.RawMessage // Original JSON, see rawjson.go
 }
 
 // CitationMetadata contains citation information for the generated content.
 type CitationMetadata struct {
 	CitationSources []CitationSource `json:"citationSources"`
+
+	raw json.RawMessage // Original JSON, see rawjson.go
 }
 
 // CitationSource provides a single citation source with its URI and license.
@@ -114,6 +210,8 @@ type CitationSource struct {
 	EndIndex   int    `json:"endIndex,omitempty"`
 	URI        string `json:"uri,omitempty"`
 	License    string `json:"license,omitempty"`
+
+	raw json.RawMessage // Original JSON, see rawjson.go
 }
 
 // ErrorResponse represents a standard error from the Gemini API.
@@ -0,0 +1,246 @@
+package gemini
+
+// The methods in this file route every API type through unmarshalPreserving and
+// marshalPreserving (see rawjson.go), so fields that are not modelled here survive a
+// decode/encode round trip. Each method converts to a local type without methods to
+// avoid recursing into itself.
+
+// UnmarshalJSON decodes a GenerateContentRequest and remembers its raw JSON.
+func (r *GenerateContentRequest) UnmarshalJSON(data []byte) error {
+	type plain GenerateContentRequest
+	return unmarshalPreserving(data, (*plain)(r), &r.raw)
+}
+
+// MarshalJSON encodes a GenerateContentRequest, patching only the changed fields of its raw JSON.
+func (r GenerateContentRequest) MarshalJSON() ([]byte, error) {
+	type plain GenerateContentRequest
+	return marshalPreserving(plain(r), r.raw)
+}
+
+// UnmarshalJSON decodes a SystemInstruction and remembers its raw JSON.
+func (si *SystemInstruction) UnmarshalJSON(data []byte) error {
+	type plain SystemInstruction
+	return unmarshalPreserving(data, (*plain)(si), &si.raw)
+}
+
+// MarshalJSON encodes a SystemInstruction, patching only the changed fields of its raw JSON.
+func (si SystemInstruction) MarshalJSON() ([]byte, error) {
+	type plain SystemInstruction
+	return marshalPreserving(plain(si), si.raw)
+}
+
+// UnmarshalJSON decodes a GenerateContentResponse and remembers its raw JSON.
+func (r *GenerateContentResponse) UnmarshalJSON(data []byte) error {
+	type plain GenerateContentResponse
+	return unmarshalPreserving(data, (*plain)(r), &r.raw)
+}
+
+// MarshalJSON encodes a GenerateContentResponse, patching only the changed fields of its raw JSON.
+func (r GenerateContentResponse) MarshalJSON() ([]byte, error) {
+	type plain GenerateContentResponse
+	return marshalPreserving(plain(r), r.raw)
+}
+
+// UnmarshalJSON decodes a Candidate and remembers its raw JSON.
+func (c *Candidate) UnmarshalJSON(data []byte) error {
+	type plain Candidate
+	return unmarshalPreserving(data, (*plain)(c), &c.raw)
+}
+
+// MarshalJSON encodes a Candidate, patching only the changed fields of its raw JSON.
+func (c Candidate) MarshalJSON() ([]byte, error) {
+	type plain Candidate
+	return marshalPreserving(plain(c), c.raw)
+}
+
+// UnmarshalJSON decodes a Content and remembers its raw JSON.
+func (c *Content) UnmarshalJSON(data []byte) error {
+	type plain Content
+	return unmarshalPreserving(data, (*plain)(c), &c.raw)
+}
+
+// MarshalJSON encodes a Content, patching only the changed fields of its raw JSON.
+func (c Content) MarshalJSON() ([]byte, error) {
+	type plain Content
+	return marshalPreserving(plain(c), c.raw)
+}
+
+// UnmarshalJSON decodes a Part and remembers its raw JSON.
+func (p *Part) UnmarshalJSON(data []byte) error {
+	type plain Part
+	return unmarshalPreserving(data, (*plain)(p), &p.raw)
+}
+
+// MarshalJSON encodes a Part, patching only the changed fields of its raw JSON.
+func (p Part) MarshalJSON() ([]byte, error) {
+	type plain Part
+	return marshalPreserving(plain(p), p.raw)
+}
+
+// UnmarshalJSON decodes a FunctionCall and remembers its raw JSON.
+func (fc *FunctionCall) UnmarshalJSON(data []byte) error {
+	type plain FunctionCall
+	return unmarshalPreserving(data, (*plain)(fc), &fc.raw)
+}
+
+// MarshalJSON encodes a FunctionCall, patching only the changed fields of its raw JSON.
+func (fc FunctionCall) MarshalJSON() ([]byte, error) {
+	type plain FunctionCall
+	return marshalPreserving(plain(fc), fc.raw)
+}
+
+// UnmarshalJSON decodes a GenerationConfig and remembers its raw JSON.
+func (gc *GenerationConfig) UnmarshalJSON(data []byte) error {
+	type plain GenerationConfig
+	return unmarshalPreserving(data, (*plain)(gc), &gc.raw)
+}
+
+// MarshalJSON encodes a GenerationConfig, patching only the changed fields of its raw JSON.
+func (gc GenerationConfig) MarshalJSON() ([]byte, error) {
+	type plain GenerationConfig
+	return marshalPreserving(plain(gc), gc.raw)
+}
+
+// UnmarshalJSON decodes a SafetySetting and remembers its raw JSON.
+func (ss *SafetySetting) UnmarshalJSON(data []byte) error {
+	type plain SafetySetting
+	return unmarshalPreserving(data, (*plain)(ss), &ss.raw)
+}
+
+// MarshalJSON encodes a SafetySetting, patching only the changed fields of its raw JSON.
+func (ss SafetySetting) MarshalJSON() ([]byte, error) {
+	type plain SafetySetting
+	return marshalPreserving(plain(ss), ss.raw)
+}
+
+// UnmarshalJSON decodes a Tool and remembers its raw JSON.
+func (t *Tool) UnmarshalJSON(data []byte) error {
+	type plain Tool
+	return unmarshalPreserving(data, (*plain)(t), &t.raw)
+}
+
+// MarshalJSON encodes a Tool, patching only the changed fields of its raw JSON.
+func (t Tool) MarshalJSON() ([]byte, error) {
+	type plain Tool
+	return marshalPreserving(plain(t), t.raw)
+}
+
+// UnmarshalJSON decodes a PromptFeedback and remembers its raw JSON.
+func (pf *PromptFeedback) UnmarshalJSON(data []byte) error {
+	type plain PromptFeedback
+	return unmarshalPreserving(data, (*plain)(pf), &pf.raw)
+}
+
+// MarshalJSON encodes a PromptFeedback, patching only the changed fields of its raw JSON.
+func (pf PromptFeedback) MarshalJSON() ([]byte, error) {
+	type plain PromptFeedback
+	return marshalPreserving(plain(pf), pf.raw)
+}
+
+// UnmarshalJSON decodes a SafetyRating and remembers its raw JSON.
+func (sr *SafetyRating) UnmarshalJSON(data []byte) error {
+	type plain SafetyRating
+	return unmarshalPreserving(data, (*plain)(sr), &sr.raw)
+}
+
+// MarshalJSON encodes a SafetyRating, patching only the changed fields of its raw JSON.
+func (sr SafetyRating) MarshalJSON() ([]byte, error) {
+	type plain SafetyRating
+	return marshalPreserving(plain(sr), sr.raw)
+}
+
+// UnmarshalJSON decodes a CitationMetadata and remembers its raw JSON.
+func (cm *CitationMetadata) UnmarshalJSON(data []byte) error {
+	type plain CitationMetadata
+	return unmarshalPreserving(data, (*plain)(cm), &cm.raw)
+}
+
+// MarshalJSON encodes a CitationMetadata, patching only the changed fields of its raw JSON.
+func (cm CitationMetadata) MarshalJSON() ([]byte, error) {
+	type plain CitationMetadata
+	return marshalPreserving(plain(cm), cm.raw)
+}
+
+// UnmarshalJSON decodes a CitationSource and remembers its raw JSON.
+func (cs *CitationSource) UnmarshalJSON(data []byte) error {
+	type plain CitationSource
+	return unmarshalPreserving(data, (*plain)(cs), &cs.raw)
+}
+
+// MarshalJSON encodes a CitationSource, patching only the changed fields of its raw JSON.
+func (cs CitationSource) MarshalJSON() ([]byte, error) {
+	type plain CitationSource
+	return marshalPreserving(plain(cs), cs.raw)
+}
+
+// UnmarshalJSON decodes a Blob and remembers its raw JSON.
+func (b *Blob) UnmarshalJSON(data []byte) error {
+	type plain Blob
+	return unmarshalPreserving(data, (*plain)(b), &b.raw)
+}
+
+// MarshalJSON encodes a Blob, patching only the changed fields of its raw JSON.
+func (b Blob) MarshalJSON() ([]byte, error) {
+	type plain Blob
+	return marshalPreserving(plain(b), b.raw)
+}
+
+// UnmarshalJSON decodes a FileData and remembers its raw JSON.
+func (fd *FileData) UnmarshalJSON(data []byte) error {
+	type plain FileData
+	return unmarshalPreserving(data, (*plain)(fd), &fd.raw)
+}
+
+// MarshalJSON encodes a FileData, patching only the changed fields of its raw JSON.
+func (fd FileData) MarshalJSON() ([]byte, error) {
+	type plain FileData
+	return marshalPreserving(plain(fd), fd.raw)
+}
+
+// UnmarshalJSON decodes a FunctionResponse and remembers its raw JSON.
+func (fr *FunctionResponse) UnmarshalJSON(data []byte) error {
+	type plain FunctionResponse
+	return unmarshalPreserving(data, (*plain)(fr), &fr.raw)
+}
+
+// MarshalJSON encodes a FunctionResponse, patching only the changed fields of its raw JSON.
+func (fr FunctionResponse) MarshalJSON() ([]byte, error) {
+	type plain FunctionResponse
+	return marshalPreserving(plain(fr), fr.raw)
+}
+
+// UnmarshalJSON decodes a ExecutableCode and remembers its raw JSON.
+func (ec *ExecutableCode) UnmarshalJSON(data []byte) error {
+	type plain ExecutableCode
+	return unmarshalPreserving(data, (*plain)(ec), &ec.raw)
+}
+
+// MarshalJSON encodes a ExecutableCode, patching only the changed fields of its raw JSON.
+func (ec ExecutableCode) MarshalJSON() ([]byte, error) {
+	type plain ExecutableCode
+	return marshalPreserving(plain(ec), ec.raw)
+}
+
+// UnmarshalJSON decodes a CodeExecutionResult and remembers its raw JSON.
+func (cr *CodeExecutionResult) UnmarshalJSON(data []byte) error {
+	type plain CodeExecutionResult
+	return unmarshalPreserving(data, (*plain)(cr), &cr.raw)
+}
+
+// MarshalJSON encodes a CodeExecutionResult, patching only the changed fields of its raw JSON.
+func (cr CodeExecutionResult) MarshalJSON() ([]byte, error) {
+	type plain CodeExecutionResult
+	return marshalPreserving(plain(cr), cr.raw)
+}
+
+// UnmarshalJSON decodes a VideoMetadata and remembers its raw JSON.
+func (vm *VideoMetadata) UnmarshalJSON(data []byte) error {
+	type plain VideoMetadata
+	return unmarshalPreserving(data, (*plain)(vm), &vm.raw)
+}
+
+// MarshalJSON encodes a VideoMetadata, patching only the changed fields of its raw JSON.
+func (vm VideoMetadata) MarshalJSON() ([]byte, error) {
+	type plain VideoMetadata
+	return marshalPreserving(plain(vm), vm.raw)
+}
@@ -1,15 +1,35 @@
 package handler
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"gemini-anti-truncate-go/internal/auth"
+	"gemini-anti-truncate-go/internal/concurrency"
 	"gemini-anti-truncate-go/internal/config"
 	"gemini-anti-truncate-go/internal/gemini"
+	"gemini-anti-truncate-go/internal/keypool"
+	"gemini-anti-truncate-go/internal/lifecycle"
+	"gemini-anti-truncate-go/internal/metrics"
+	"gemini-anti-truncate-go/internal/ratelimit"
+	"gemini-anti-truncate-go/internal/retry"
+	"gemini-anti-truncate-go/internal/tracing"
+	"gemini-anti-truncate-go/internal/util"
+	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
 )
 
 // Initialize config for tests
@@ -170,4 +190,1768 @@ func TestPassthroughRequest(t *testing.T) {
 	if !strings.Contains(rr.Body.String(), "Hello, world!") {
 		t.Errorf("Expected response to contain 'Hello, world!', got '%s'", rr.Body.String())
 	}
-}
\ No newline at end of file
+}
+
+func TestHandleNonStream_StitchesContinuations(t *testing.T) {
+	responses := []string{
+		`{"candidates": [{"content": {"parts": [{"text": "Once upon a time, "}], "role": "model"}, "finishReason": "STOP", "index": 0}]}`,
+		`{"candidates": [{"content": {"parts": [{"text": "there was a proxy. "}], "role": "model"}, "finishReason": "STOP", "index": 0}]}`,
+		`{"candidates": [{"content": {"parts": [{"text": "The end.[RESPONSE_FINISHED]"}], "role": "model"}, "finishReason": "STOP", "index": 0}]}`,
+	}
+	var received []gemini.GenerateContentRequest
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req gemini.GenerateContentRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		received = append(received, req)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, responses[len(received)-1])
+	}))
+	defer upstreamServer.Close()
+
+	originalUpstreamURL := config.AppConfig.UpstreamURLBase
+	config.AppConfig.UpstreamURLBase = upstreamServer.URL
+	defer func() {
+		config.AppConfig.UpstreamURLBase = originalUpstreamURL
+	}()
+
+	initialReq := &gemini.GenerateContentRequest{
+		Contents: []gemini.Content{{Role: "user", Parts: []gemini.Part{{Text: "Tell me a story"}}}},
+	}
+	req := httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:generateContent", nil)
+	rr := httptest.NewRecorder()
+
+	HandleNonStream(rr, req, initialReq, "test-key")
+
+	if len(received) != 3 {
+		t.Fatalf("Expected 3 upstream attempts, got %d", len(received))
+	}
+
+	// The last continuation must carry the text of every previous attempt
+	lastReq := received[2]
+	modelTurn := lastReq.Contents[len(lastReq.Contents)-2]
+	if modelTurn.Role != "model" || modelTurn.Parts[0].Text != "Once upon a time, there was a proxy. " {
+		t.Errorf("Expected continuation to carry all previous text, got %+v", modelTurn)
+	}
+
+	var response gemini.GenerateContentResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	cand := response.Candidates[0]
+	if cand.Content.Parts[0].Text != "Once upon a time, there was a proxy. The end." {
+		t.Errorf("Expected stitched text, got '%s'", cand.Content.Parts[0].Text)
+	}
+	if cand.FinishReason != "STOP" {
+		t.Errorf("Expected finish reason 'STOP', got '%s'", cand.FinishReason)
+	}
+}
+
+func TestProxyHandler_PassthroughKeepsRawBody(t *testing.T) {
+	body := `{
+  "contents": [{"role": "user", "parts": [{"text": "Hi"}, {"inlineData": {"mimeType": "image/png", "data": "AAAA"}}]}],
+  "toolConfig": {"functionCallingConfig": {"mode": "AUTO"}},
+  "generationConfig": {"responseModalities": ["TEXT"], "temperature": 1.0}
+}`
+	var forwarded string
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		forwarded = string(data)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, `{"candidates": []}`)
+	}))
+	defer upstreamServer.Close()
+
+	originalUpstreamURL := config.AppConfig.UpstreamURLBase
+	config.AppConfig.UpstreamURLBase = upstreamServer.URL
+	defer func() {
+		config.AppConfig.UpstreamURLBase = originalUpstreamURL
+	}()
+
+	req := httptest.NewRequest("POST", "/v1beta/models/gemini-pro-vision:generateContent", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer test-key")
+	req = mux.SetURLVars(req, map[string]string{"model": "gemini-pro-vision:generateContent"})
+	rr := httptest.NewRecorder()
+
+	ProxyHandler(rr, req)
+
+	if forwarded != body {
+		t.Errorf("Expected the passthrough body to be forwarded byte-for-byte.\nExpected: %s\nGot:      %s", body, forwarded)
+	}
+}
+
+func TestHandleStream_ForwardsQueryString(t *testing.T) {
+	var upstreamURL string
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamURL = r.URL.String()
+		if r.Header.Get("X-Goog-Api-Key") != "query-key" {
+			t.Errorf("Expected the query key to be sent as X-Goog-Api-Key, got '%s'", r.Header.Get("X-Goog-Api-Key"))
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "data: {\"candidates\": [{\"content\": {\"parts\": [{\"text\": \"Done.[RESPONSE_FINISHED]\"}], \"role\": \"model\"}, \"finishReason\": \"STOP\", \"index\": 0}]}\n\n")
+	}))
+	defer upstreamServer.Close()
+
+	originalUpstreamURL := config.AppConfig.UpstreamURLBase
+	config.AppConfig.UpstreamURLBase = upstreamServer.URL + "/"
+	defer func() {
+		config.AppConfig.UpstreamURLBase = originalUpstreamURL
+	}()
+
+	body := `{"contents": [{"role": "user", "parts": [{"text": "Hi"}]}]}`
+	req := httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:streamGenerateContent?alt=sse&key=query-key", strings.NewReader(body))
+	req = mux.SetURLVars(req, map[string]string{"model": "gemini-2.5-pro:streamGenerateContent"})
+	rr := httptest.NewRecorder()
+
+	ProxyHandler(rr, req)
+
+	if upstreamURL != "/v1beta/models/gemini-2.5-pro:streamGenerateContent?alt=sse" {
+		t.Errorf("Expected path and alt=sse to be forwarded without the key, got '%s'", upstreamURL)
+	}
+	if !strings.Contains(rr.Body.String(), "Done.") {
+		t.Errorf("Expected the stream to be forwarded, got '%s'", rr.Body.String())
+	}
+}
+
+func TestHandleStream_JSONArrayContinuation(t *testing.T) {
+	attempts := []string{
+		"[{\"candidates\": [{\"content\": {\"parts\": [{\"text\": \"Part one, \"}], \"role\": \"model\"}, \"index\": 0}]}\n]",
+		"[{\"candidates\": [{\"content\": {\"parts\": [{\"text\": \"part two.[RESPONSE_FINISHED]\"}], \"role\": \"model\"}, \"finishReason\": \"STOP\", \"index\": 0}]}\n]",
+	}
+	calls := 0
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("alt") != "" {
+			t.Errorf("Expected no alt parameter upstream, got '%s'", r.URL.RawQuery)
+		}
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, attempts[calls])
+		calls++
+	}))
+	defer upstreamServer.Close()
+
+	originalUpstreamURL := config.AppConfig.UpstreamURLBase
+	config.AppConfig.UpstreamURLBase = upstreamServer.URL
+	defer func() {
+		config.AppConfig.UpstreamURLBase = originalUpstreamURL
+	}()
+
+	initialReq := &gemini.GenerateContentRequest{
+		Contents: []gemini.Content{{Role: "user", Parts: []gemini.Part{{Text: "Hi"}}}},
+	}
+	req := httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:streamGenerateContent", nil)
+	rr := httptest.NewRecorder()
+
+	HandleStream(rr, req, initialReq, "test-key")
+
+	if calls != 2 {
+		t.Fatalf("Expected 2 upstream attempts, got %d", calls)
+	}
+
+	var chunks []gemini.GenerateContentResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &chunks); err != nil {
+		t.Fatalf("Expected a single valid JSON array across attempts, got '%s': %v", rr.Body.String(), err)
+	}
+	var text string
+	for _, chunk := range chunks {
+		for _, part := range chunk.Candidates[0].Content.Parts {
+			text += part.Text
+		}
+	}
+	if text != "Part one, part two." {
+		t.Errorf("Expected 'Part one, part two.', got '%s'", text)
+	}
+}
+
+func TestHandleNonStream_TerminalFinishReasonIsNotRetried(t *testing.T) {
+	body := `{"candidates": [{"content": {"parts": [{"text": "I can't help"}], "role": "model"}, "finishReason": "SAFETY", "index": 0}]}`
+	calls := 0
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, body)
+	}))
+	defer upstreamServer.Close()
+
+	originalUpstreamURL := config.AppConfig.UpstreamURLBase
+	config.AppConfig.UpstreamURLBase = upstreamServer.URL
+	defer func() {
+		config.AppConfig.UpstreamURLBase = originalUpstreamURL
+	}()
+
+	initialReq := &gemini.GenerateContentRequest{
+		Contents: []gemini.Content{{Role: "user", Parts: []gemini.Part{{Text: "Hi"}}}},
+	}
+	req := httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:generateContent", nil)
+	rr := httptest.NewRecorder()
+
+	HandleNonStream(rr, req, initialReq, "test-key")
+
+	if calls != 1 {
+		t.Errorf("Expected 1 upstream attempt, got %d", calls)
+	}
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+	if rr.Body.String() != body {
+		t.Errorf("Expected the upstream response to be forwarded unchanged, got '%s'", rr.Body.String())
+	}
+}
+
+func TestHandleNonStream_MaxTokensFollowsPolicy(t *testing.T) {
+	body := `{"candidates": [{"content": {"parts": [{"text": "The first half"}], "role": "model"}, "finishReason": "MAX_TOKENS", "index": 0}]}`
+	calls := 0
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if calls == 1 {
+			fmt.Fprint(w, body)
+			return
+		}
+		fmt.Fprint(w, `{"candidates": [{"content": {"parts": [{"text": " and the rest.[RESPONSE_FINISHED]"}], "role": "model"}, "finishReason": "STOP", "index": 0}]}`)
+	}))
+	defer upstreamServer.Close()
+
+	originalUpstreamURL := config.AppConfig.UpstreamURLBase
+	config.AppConfig.UpstreamURLBase = upstreamServer.URL
+	defer func() {
+		config.AppConfig.UpstreamURLBase = originalUpstreamURL
+	}()
+
+	initialReq := &gemini.GenerateContentRequest{
+		Contents: []gemini.Content{{Role: "user", Parts: []gemini.Part{{Text: "Hi"}}}},
+	}
+
+	// By default, an answer that reached the token limit is returned as it is
+	req := httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:generateContent", nil)
+	rr := httptest.NewRecorder()
+	HandleNonStream(rr, req, initialReq, "test-key")
+	if calls != 1 {
+		t.Errorf("Expected 1 upstream attempt, got %d", calls)
+	}
+	if rr.Code != http.StatusOK || rr.Body.String() != body {
+		t.Errorf("Expected the upstream response to be forwarded unchanged, got %d '%s'", rr.Code, rr.Body.String())
+	}
+
+	// A policy can ask for a continuation instead
+	policy, err := retry.ParsePolicy([]byte(`{"rules": [{"outcome": ["max-tokens"], "action": "retry"}]}`))
+	if err != nil {
+		t.Fatalf("Failed to parse policy: %v", err)
+	}
+	retry.SetPolicy(policy)
+	defer retry.SetPolicy(nil)
+
+	calls = 0
+	req = httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:generateContent", nil)
+	rr = httptest.NewRecorder()
+	HandleNonStream(rr, req, initialReq, "test-key")
+	if calls != 2 {
+		t.Errorf("Expected 2 upstream attempts, got %d", calls)
+	}
+	if !strings.Contains(rr.Body.String(), "The first half and the rest.") {
+		t.Errorf("Expected the continuation to be stitched, got '%s'", rr.Body.String())
+	}
+}
+
+func TestHandleStream_TerminalFinishReasonIsNotRetried(t *testing.T) {
+	calls := 0
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, `data: {"candidates": [{"content": {"parts": [{"text": "Quoted"}], "role": "model"}, "finishReason": "RECITATION", "index": 0}]}`+"\n\n")
+	}))
+	defer upstreamServer.Close()
+
+	originalUpstreamURL := config.AppConfig.UpstreamURLBase
+	config.AppConfig.UpstreamURLBase = upstreamServer.URL
+	defer func() {
+		config.AppConfig.UpstreamURLBase = originalUpstreamURL
+	}()
+
+	initialReq := &gemini.GenerateContentRequest{
+		Contents: []gemini.Content{{Role: "user", Parts: []gemini.Part{{Text: "Hi"}}}},
+	}
+	req := httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:streamGenerateContent?alt=sse", nil)
+	rr := httptest.NewRecorder()
+
+	HandleStream(rr, req, initialReq, "test-key")
+
+	if calls != 1 {
+		t.Errorf("Expected 1 upstream attempt, got %d", calls)
+	}
+	if !strings.Contains(rr.Body.String(), `"finishReason": "RECITATION"`) {
+		t.Errorf("Expected the finish reason to reach the client, got '%s'", rr.Body.String())
+	}
+}
+
+func TestHandleNonStream_BlockedPromptIsNotRetried(t *testing.T) {
+	body := `{"promptFeedback": {"blockReason": "SAFETY"}, "usageMetadata": {"promptTokenCount": 4}}`
+	calls := 0
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, body)
+	}))
+	defer upstreamServer.Close()
+
+	originalUpstreamURL := config.AppConfig.UpstreamURLBase
+	config.AppConfig.UpstreamURLBase = upstreamServer.URL
+	defer func() {
+		config.AppConfig.UpstreamURLBase = originalUpstreamURL
+	}()
+
+	initialReq := &gemini.GenerateContentRequest{
+		Contents: []gemini.Content{{Role: "user", Parts: []gemini.Part{{Text: "Hi"}}}},
+	}
+	req := httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:generateContent", nil)
+	rr := httptest.NewRecorder()
+
+	HandleNonStream(rr, req, initialReq, "test-key")
+
+	if calls != 1 {
+		t.Errorf("Expected 1 upstream attempt, got %d", calls)
+	}
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+	if rr.Body.String() != body {
+		t.Errorf("Expected the blocked response to be forwarded unchanged, got '%s'", rr.Body.String())
+	}
+}
+
+func TestHandleStream_BlockedPromptIsNotRetried(t *testing.T) {
+	calls := 0
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, `[{"promptFeedback": {"blockReason": "OTHER"}}]`)
+	}))
+	defer upstreamServer.Close()
+
+	originalUpstreamURL := config.AppConfig.UpstreamURLBase
+	config.AppConfig.UpstreamURLBase = upstreamServer.URL
+	defer func() {
+		config.AppConfig.UpstreamURLBase = originalUpstreamURL
+	}()
+
+	initialReq := &gemini.GenerateContentRequest{
+		Contents: []gemini.Content{{Role: "user", Parts: []gemini.Part{{Text: "Hi"}}}},
+	}
+	req := httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:streamGenerateContent", nil)
+	rr := httptest.NewRecorder()
+
+	HandleStream(rr, req, initialReq, "test-key")
+
+	if calls != 1 {
+		t.Errorf("Expected 1 upstream attempt, got %d", calls)
+	}
+	if rr.Body.String() != `[{"promptFeedback": {"blockReason": "OTHER"}}]` {
+		t.Errorf("Expected the blocked response to be forwarded, got '%s'", rr.Body.String())
+	}
+}
+
+func TestHandleNonStream_BacksOffOnRetryableStatus(t *testing.T) {
+	var callTimes []time.Time
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callTimes = append(callTimes, time.Now())
+		w.Header().Set("Content-Type", "application/json")
+		if len(callTimes) == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"error": {"code": 429, "status": "RESOURCE_EXHAUSTED", "details": [{"@type": "type.googleapis.com/google.rpc.RetryInfo", "retryDelay": "0.2s"}]}}`)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, `{"candidates": [{"content": {"parts": [{"text": "Done.[RESPONSE_FINISHED]"}], "role": "model"}, "finishReason": "STOP", "index": 0}]}`)
+	}))
+	defer upstreamServer.Close()
+
+	originalUpstreamURL := config.AppConfig.UpstreamURLBase
+	config.AppConfig.UpstreamURLBase = upstreamServer.URL
+	defer func() {
+		config.AppConfig.UpstreamURLBase = originalUpstreamURL
+	}()
+
+	initialReq := &gemini.GenerateContentRequest{
+		Contents: []gemini.Content{{Role: "user", Parts: []gemini.Part{{Text: "Hi"}}}},
+	}
+	req := httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:generateContent", nil)
+	rr := httptest.NewRecorder()
+
+	HandleNonStream(rr, req, initialReq, "test-key")
+
+	if len(callTimes) != 2 {
+		t.Fatalf("Expected 2 upstream attempts, got %d", len(callTimes))
+	}
+	if waited := callTimes[1].Sub(callTimes[0]); waited < 200*time.Millisecond {
+		t.Errorf("Expected the RetryInfo delay to be honored, retried after %v", waited)
+	}
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+}
+
+func TestHandleNonStream_ForwardsTooLongServerDelay(t *testing.T) {
+	calls := 0
+	errorBody := `{"error": {"code": 429, "status": "RESOURCE_EXHAUSTED", "details": [{"@type": "type.googleapis.com/google.rpc.RetryInfo", "retryDelay": "3600s"}]}}`
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, errorBody)
+	}))
+	defer upstreamServer.Close()
+
+	originalUpstreamURL := config.AppConfig.UpstreamURLBase
+	config.AppConfig.UpstreamURLBase = upstreamServer.URL
+	defer func() {
+		config.AppConfig.UpstreamURLBase = originalUpstreamURL
+	}()
+
+	initialReq := &gemini.GenerateContentRequest{
+		Contents: []gemini.Content{{Role: "user", Parts: []gemini.Part{{Text: "Hi"}}}},
+	}
+	req := httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:generateContent", nil)
+	rr := httptest.NewRecorder()
+
+	start := time.Now()
+	HandleNonStream(rr, req, initialReq, "test-key")
+
+	// A delay longer than the backoff cap is not waited for: the 429 is passed on right away
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the handler to fail right away, took %v", elapsed)
+	}
+	if calls != 1 {
+		t.Errorf("Expected 1 upstream attempt, got %d", calls)
+	}
+	if rr.Code != http.StatusTooManyRequests || rr.Body.String() != errorBody {
+		t.Errorf("Expected the upstream 429 to be forwarded, got %d '%s'", rr.Code, rr.Body.String())
+	}
+	if rr.Header().Get("Retry-After") != "3600" {
+		t.Errorf("Expected Retry-After '3600', got '%s'", rr.Header().Get("Retry-After"))
+	}
+}
+
+func TestHandleStream_StopsRetryingWhenClientLeaves(t *testing.T) {
+	calls := 0
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Retry-After", "20")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer upstreamServer.Close()
+
+	originalUpstreamURL := config.AppConfig.UpstreamURLBase
+	config.AppConfig.UpstreamURLBase = upstreamServer.URL
+	defer func() {
+		config.AppConfig.UpstreamURLBase = originalUpstreamURL
+	}()
+
+	initialReq := &gemini.GenerateContentRequest{
+		Contents: []gemini.Content{{Role: "user", Parts: []gemini.Part{{Text: "Hi"}}}},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	time.AfterFunc(100*time.Millisecond, cancel)
+	req := httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:streamGenerateContent?alt=sse", nil).WithContext(ctx)
+	rr := httptest.NewRecorder()
+
+	start := time.Now()
+	HandleStream(rr, req, initialReq, "test-key")
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the handler to give up when the request context ended, took %v", elapsed)
+	}
+	if calls != 1 {
+		t.Errorf("Expected 1 upstream attempt, got %d", calls)
+	}
+}
+
+func TestHandleNonStream_ForbiddenIsNotRetried(t *testing.T) {
+	calls := 0
+	errorBody := `{"error": {"code": 403, "message": "API key not valid", "status": "PERMISSION_DENIED"}}`
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, errorBody)
+	}))
+	defer upstreamServer.Close()
+
+	originalUpstreamURL := config.AppConfig.UpstreamURLBase
+	config.AppConfig.UpstreamURLBase = upstreamServer.URL
+	defer func() {
+		config.AppConfig.UpstreamURLBase = originalUpstreamURL
+	}()
+
+	initialReq := &gemini.GenerateContentRequest{
+		Contents: []gemini.Content{{Role: "user", Parts: []gemini.Part{{Text: "Hi"}}}},
+	}
+	req := httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:generateContent", nil)
+	rr := httptest.NewRecorder()
+
+	HandleNonStream(rr, req, initialReq, "bad-key")
+
+	// The default policy switches keys on 403, and with a single key there is nothing to switch to
+	if calls != 1 {
+		t.Errorf("Expected 1 upstream attempt, got %d", calls)
+	}
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Expected status code %d, got %d", http.StatusForbidden, rr.Code)
+	}
+	if rr.Body.String() != errorBody {
+		t.Errorf("Expected the upstream error to be forwarded, got '%s'", rr.Body.String())
+	}
+}
+
+func TestHandleNonStream_PolicySwitchesModel(t *testing.T) {
+	var paths []string
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(r.URL.Path, "gemini-2.5-pro") {
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"error": {"code": 429, "status": "RESOURCE_EXHAUSTED"}}`)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, `{"candidates": [{"content": {"parts": [{"text": "Done.[RESPONSE_FINISHED]"}], "role": "model"}, "finishReason": "STOP", "index": 0}]}`)
+	}))
+	defer upstreamServer.Close()
+
+	originalUpstreamURL := config.AppConfig.UpstreamURLBase
+	config.AppConfig.UpstreamURLBase = upstreamServer.URL
+	defer func() {
+		config.AppConfig.UpstreamURLBase = originalUpstreamURL
+	}()
+
+	policy, err := retry.ParsePolicy([]byte(`{
+		"rules": [{"errorStatus": ["RESOURCE_EXHAUSTED"], "action": "switch_model"}],
+		"fallbackModels": ["gemini-2.5-flash"]
+	}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	retry.SetPolicy(policy)
+	defer retry.SetPolicy(nil)
+
+	initialReq := &gemini.GenerateContentRequest{
+		Contents: []gemini.Content{{Role: "user", Parts: []gemini.Part{{Text: "Hi"}}}},
+	}
+	req := httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:generateContent", nil)
+	rr := httptest.NewRecorder()
+
+	HandleNonStream(rr, req, initialReq, "test-key")
+
+	expectedPaths := []string{"/v1beta/models/gemini-2.5-pro:generateContent", "/v1beta/models/gemini-2.5-flash:generateContent"}
+	if strings.Join(paths, ",") != strings.Join(expectedPaths, ",") {
+		t.Errorf("Expected upstream paths %v, got %v", expectedPaths, paths)
+	}
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+}
+
+func TestHandleNonStream_SeparateBudgets(t *testing.T) {
+	responses := []struct {
+		status int
+		body   string
+	}{
+		{http.StatusServiceUnavailable, `{"error": {"code": 503, "status": "UNAVAILABLE"}}`},
+		{http.StatusOK, `{"candidates": [{"content": {"parts": [{"text": "One, "}], "role": "model"}, "finishReason": "STOP", "index": 0}]}`},
+		{http.StatusServiceUnavailable, `{"error": {"code": 503, "status": "UNAVAILABLE"}}`},
+		{http.StatusOK, `{"candidates": [{"content": {"parts": [{"text": "two, "}], "role": "model"}, "finishReason": "STOP", "index": 0}]}`},
+		{http.StatusOK, `{"candidates": [{"content": {"parts": [{"text": "three.[RESPONSE_FINISHED]"}], "role": "model"}, "finishReason": "STOP", "index": 0}]}`},
+	}
+	calls := 0
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := responses[calls]
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(response.status)
+		fmt.Fprint(w, response.body)
+	}))
+	defer upstreamServer.Close()
+
+	originalUpstreamURL := config.AppConfig.UpstreamURLBase
+	originalErrorRetries, originalContinuations := config.AppConfig.MaxErrorRetries, config.AppConfig.MaxContinuations
+	config.AppConfig.UpstreamURLBase = upstreamServer.URL
+	config.AppConfig.MaxErrorRetries, config.AppConfig.MaxContinuations = 2, 2
+	defer func() {
+		config.AppConfig.UpstreamURLBase = originalUpstreamURL
+		config.AppConfig.MaxErrorRetries, config.AppConfig.MaxContinuations = originalErrorRetries, originalContinuations
+	}()
+
+	initialReq := &gemini.GenerateContentRequest{
+		Contents: []gemini.Content{{Role: "user", Parts: []gemini.Part{{Text: "Count to three"}}}},
+	}
+	req := httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:generateContent", nil)
+	rr := httptest.NewRecorder()
+
+	HandleNonStream(rr, req, initialReq, "test-key")
+
+	// Two error retries and two continuations fit in their own budgets, although together they exceed either one
+	if calls != 5 {
+		t.Errorf("Expected 5 upstream attempts, got %d", calls)
+	}
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	if !strings.Contains(rr.Body.String(), "One, two, three.") {
+		t.Errorf("Expected the stitched answer, got '%s'", rr.Body.String())
+	}
+
+	// One more continuation than the budget allows fails the request
+	calls = 0
+	config.AppConfig.MaxContinuations = 1
+	rr = httptest.NewRecorder()
+	HandleNonStream(rr, req, initialReq, "test-key")
+	if rr.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected status code %d, got %d", http.StatusGatewayTimeout, rr.Code)
+	}
+}
+
+func TestHandleNonStream_Deadline(t *testing.T) {
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Reading the body lets the server notice when the proxy gives up on the connection
+		io.ReadAll(r.Body)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer upstreamServer.Close()
+
+	originalUpstreamURL := config.AppConfig.UpstreamURLBase
+	originalDeadline := config.AppConfig.RequestDeadline
+	config.AppConfig.UpstreamURLBase = upstreamServer.URL
+	config.AppConfig.RequestDeadline = 100 * time.Millisecond
+	defer func() {
+		config.AppConfig.UpstreamURLBase = originalUpstreamURL
+		config.AppConfig.RequestDeadline = originalDeadline
+	}()
+
+	initialReq := &gemini.GenerateContentRequest{
+		Contents: []gemini.Content{{Role: "user", Parts: []gemini.Part{{Text: "Hi"}}}},
+	}
+	req := httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:generateContent", nil)
+	rr := httptest.NewRecorder()
+
+	start := time.Now()
+	HandleNonStream(rr, req, initialReq, "test-key")
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the deadline to stop the request, took %v", elapsed)
+	}
+	if rr.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected status code %d, got %d", http.StatusGatewayTimeout, rr.Code)
+	}
+}
+
+func TestHandleStream_TerminalErrorEvent(t *testing.T) {
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("proxy_stream_errors") {
+			t.Errorf("Expected the opt-in parameter not to be forwarded, got '%s'", r.URL.RawQuery)
+		}
+		var req gemini.GenerateContentRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if len(req.Contents) > 1 {
+			// The continuation is rejected
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": {"code": 400, "message": "Request contains an invalid argument.", "status": "INVALID_ARGUMENT"}}`)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, `data: {"candidates": [{"content": {"parts": [{"text": "Half an answer"}], "role": "model"}, "finishReason": "STOP", "index": 0}]}`+"\n\n")
+	}))
+	defer upstreamServer.Close()
+
+	originalUpstreamURL := config.AppConfig.UpstreamURLBase
+	config.AppConfig.UpstreamURLBase = upstreamServer.URL
+	defer func() {
+		config.AppConfig.UpstreamURLBase = originalUpstreamURL
+	}()
+
+	initialReq := &gemini.GenerateContentRequest{
+		Contents: []gemini.Content{{Role: "user", Parts: []gemini.Part{{Text: "Hi"}}}},
+	}
+
+	testCases := []struct {
+		name      string
+		target    string
+		header    string
+		wantError bool
+	}{
+		{"query parameter", "/v1beta/models/gemini-2.5-pro:streamGenerateContent?alt=sse&proxy_stream_errors=true", "", true},
+		{"header", "/v1beta/models/gemini-2.5-pro:streamGenerateContent?alt=sse", "1", true},
+		{"not requested", "/v1beta/models/gemini-2.5-pro:streamGenerateContent?alt=sse", "", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", tc.target, nil)
+			if tc.header != "" {
+				req.Header.Set("X-Proxy-Stream-Errors", tc.header)
+			}
+			rr := httptest.NewRecorder()
+
+			HandleStream(rr, req, initialReq, "test-key")
+
+			events := strings.Split(strings.TrimSpace(rr.Body.String()), "\n\n")
+			if !tc.wantError {
+				if len(events) != 1 || strings.Contains(rr.Body.String(), `"error"`) {
+					t.Errorf("Expected the stream to stop without an error chunk, got '%s'", rr.Body.String())
+				}
+				return
+			}
+
+			if len(events) != 2 {
+				t.Fatalf("Expected 2 events, got %d: '%s'", len(events), rr.Body.String())
+			}
+			var chunk struct {
+				Candidates []gemini.Candidate `json:"candidates"`
+				Error      struct {
+					Code   int    `json:"code"`
+					Status string `json:"status"`
+				} `json:"error"`
+			}
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(events[1], "data: ")), &chunk); err != nil {
+				t.Fatalf("Failed to parse error chunk '%s': %v", events[1], err)
+			}
+			if chunk.Error.Code != 400 || chunk.Error.Status != "INVALID_ARGUMENT" {
+				t.Errorf("Expected the upstream error object, got %+v", chunk.Error)
+			}
+			if len(chunk.Candidates) != 1 || chunk.Candidates[0].FinishReason != "OTHER" {
+				t.Errorf("Expected a synthetic finish reason 'OTHER', got %+v", chunk.Candidates)
+			}
+		})
+	}
+}
+
+func TestHandleStream_ForwardsUpstreamErrorBeforeStreamStarts(t *testing.T) {
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error": {"code": 400, "message": "API key not valid.", "status": "INVALID_ARGUMENT"}}`)
+	}))
+	defer upstreamServer.Close()
+
+	originalUpstreamURL := config.AppConfig.UpstreamURLBase
+	config.AppConfig.UpstreamURLBase = upstreamServer.URL
+	defer func() {
+		config.AppConfig.UpstreamURLBase = originalUpstreamURL
+	}()
+
+	initialReq := &gemini.GenerateContentRequest{
+		Contents: []gemini.Content{{Role: "user", Parts: []gemini.Part{{Text: "Hi"}}}},
+	}
+	req := httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:streamGenerateContent?alt=sse", nil)
+	rr := httptest.NewRecorder()
+
+	HandleStream(rr, req, initialReq, "test-key")
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+	}
+	if contentType := rr.Header().Get("Content-Type"); contentType != "application/json; charset=UTF-8" {
+		t.Errorf("Expected the upstream content type, got '%s'", contentType)
+	}
+	if !strings.Contains(rr.Body.String(), "API key not valid.") {
+		t.Errorf("Expected the upstream error body, got '%s'", rr.Body.String())
+	}
+}
+
+func TestHandleStream_ReturnsPartialOnUpstreamError(t *testing.T) {
+	calls := 0
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls > 1 {
+			// The continuation fails
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{"error": {"code": 500, "message": "Internal error", "status": "INTERNAL"}}`)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, `data: {"candidates": [{"content": {"parts": [{"text": "Half an answer"}], "role": "model"}, "finishReason": "STOP", "index": 0}]}`+"\n\n")
+	}))
+	defer upstreamServer.Close()
+
+	originalUpstreamURL := config.AppConfig.UpstreamURLBase
+	config.AppConfig.UpstreamURLBase = upstreamServer.URL
+	defer func() {
+		config.AppConfig.UpstreamURLBase = originalUpstreamURL
+	}()
+
+	policy, err := retry.ParsePolicy([]byte(`{"rules": [
+		{"status": [500], "action": "return_partial"},
+		{"outcome": ["truncated-retry"], "action": "retry"}
+	]}`))
+	if err != nil {
+		t.Fatalf("Failed to parse policy: %v", err)
+	}
+	retry.SetPolicy(policy)
+	defer retry.SetPolicy(nil)
+
+	initialReq := &gemini.GenerateContentRequest{
+		Contents: []gemini.Content{{Role: "user", Parts: []gemini.Part{{Text: "Hi"}}}},
+	}
+	req := httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:streamGenerateContent?alt=sse", nil)
+	req.Header.Set("X-Proxy-Stream-Errors", "1")
+	rr := httptest.NewRecorder()
+
+	HandleStream(rr, req, initialReq, "test-key")
+
+	if calls != 2 {
+		t.Errorf("Expected 2 upstream attempts, got %d", calls)
+	}
+	// The client opted into error chunks, but the policy asked for the partial answer
+	events := strings.Split(strings.TrimSpace(rr.Body.String()), "\n\n")
+	if len(events) != 1 || !strings.Contains(events[0], "Half an answer") || strings.Contains(rr.Body.String(), `"error"`) {
+		t.Errorf("Expected the stream to end cleanly with the partial answer, got '%s'", rr.Body.String())
+	}
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+}
+
+func TestHandleNonStream_KeyPoolRotatesOnRateLimit(t *testing.T) {
+	var keys []string
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get("X-Goog-Api-Key"))
+		w.Header().Set("Content-Type", "application/json")
+		if r.Header.Get("X-Goog-Api-Key") == "pool-a" {
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"error": {"code": 429, "status": "RESOURCE_EXHAUSTED"}}`)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, `{"candidates": [{"content": {"parts": [{"text": "Done.[RESPONSE_FINISHED]"}], "role": "model"}, "finishReason": "STOP", "index": 0}]}`)
+	}))
+	defer upstreamServer.Close()
+
+	originalConfig := *config.AppConfig
+	config.AppConfig.UpstreamURLBase = upstreamServer.URL
+	config.AppConfig.GeminiAPIKeys = []string{"pool-a", "pool-b"}
+	config.AppConfig.RetryBaseDelay = time.Second
+	defer func() {
+		*config.AppConfig = originalConfig
+	}()
+
+	registry, err := keypool.Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	keypool.SetRegistry(registry)
+	defer keypool.SetRegistry(nil)
+
+	initialReq := &gemini.GenerateContentRequest{
+		Contents: []gemini.Content{{Role: "user", Parts: []gemini.Part{{Text: "Hi"}}}},
+	}
+	start := time.Now()
+	rr := httptest.NewRecorder()
+	HandleNonStream(rr, httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:generateContent", nil), initialReq, "")
+
+	// The rate-limited key is replaced right away, without a backoff
+	if strings.Join(keys, ",") != "pool-a,pool-b" {
+		t.Errorf("Expected keys [pool-a pool-b], got %v", keys)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected no backoff before switching keys, took %v", elapsed)
+	}
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+
+	// pool-a is quarantined, so the next request goes straight to pool-b
+	keys = nil
+	rr = httptest.NewRecorder()
+	HandleNonStream(rr, httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:generateContent", nil), initialReq, "")
+	if strings.Join(keys, ",") != "pool-b" {
+		t.Errorf("Expected keys [pool-b], got %v", keys)
+	}
+
+	// Once pool-b is limited too, requests fail without reaching the upstream
+	limited := registry.ForClient("")
+	limited.Key()
+	limited.Report(http.StatusTooManyRequests, 0)
+	keys = nil
+	rr = httptest.NewRecorder()
+	HandleNonStream(rr, httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:generateContent", nil), initialReq, "")
+	if len(keys) != 0 {
+		t.Errorf("Expected no upstream attempt, got %v", keys)
+	}
+	if rr.Code != http.StatusTooManyRequests || !strings.Contains(rr.Body.String(), "RESOURCE_EXHAUSTED") {
+		t.Errorf("Expected a 429 RESOURCE_EXHAUSTED error, got %d '%s'", rr.Code, rr.Body.String())
+	}
+}
+
+func TestHandleNonStream_KeyPoolSwitchesKeyOnForbidden(t *testing.T) {
+	var keys []string
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get("X-Goog-Api-Key"))
+		w.Header().Set("Content-Type", "application/json")
+		if r.Header.Get("X-Goog-Api-Key") == "revoked" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"error": {"code": 403, "status": "PERMISSION_DENIED"}}`)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, `{"candidates": [{"content": {"parts": [{"text": "Done.[RESPONSE_FINISHED]"}], "role": "model"}, "finishReason": "STOP", "index": 0}]}`)
+	}))
+	defer upstreamServer.Close()
+
+	originalConfig := *config.AppConfig
+	config.AppConfig.UpstreamURLBase = upstreamServer.URL
+	config.AppConfig.GeminiAPIKeys = []string{"revoked", "valid"}
+	defer func() {
+		*config.AppConfig = originalConfig
+	}()
+
+	registry, err := keypool.Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	keypool.SetRegistry(registry)
+	defer keypool.SetRegistry(nil)
+
+	initialReq := &gemini.GenerateContentRequest{
+		Contents: []gemini.Content{{Role: "user", Parts: []gemini.Part{{Text: "Hi"}}}},
+	}
+	rr := httptest.NewRecorder()
+	HandleNonStream(rr, httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:generateContent", nil), initialReq, "")
+
+	if strings.Join(keys, ",") != "revoked,valid" {
+		t.Errorf("Expected keys [revoked valid], got %v", keys)
+	}
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+	if _, _, disabled := registry.Pool(keypool.DefaultPool).Stats(); disabled != 1 {
+		t.Errorf("Expected the revoked key to be disabled, got %d disabled key(s)", disabled)
+	}
+}
+
+func TestProxyHandler_UsesDefaultKeyPool(t *testing.T) {
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Goog-Api-Key") != "pool-key" {
+			t.Errorf("Expected 'pool-key', got '%s'", r.Header.Get("X-Goog-Api-Key"))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, `{"candidates": []}`)
+	}))
+	defer upstreamServer.Close()
+
+	originalConfig := *config.AppConfig
+	config.AppConfig.UpstreamURLBase = upstreamServer.URL
+	config.AppConfig.GeminiAPIKeys = []string{"pool-key"}
+	defer func() {
+		*config.AppConfig = originalConfig
+	}()
+
+	registry, err := keypool.Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	keypool.SetRegistry(registry)
+	defer keypool.SetRegistry(nil)
+
+	// A request without a key is served with a key of the default pool
+	req := httptest.NewRequest("POST", "/v1beta/models/gemini-pro:generateContent", strings.NewReader(`{"contents": []}`))
+	req = mux.SetURLVars(req, map[string]string{"model": "gemini-pro:generateContent"})
+	rr := httptest.NewRecorder()
+	ProxyHandler(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+}
+
+func TestHandleStream_AuthenticatedClientUsesItsPool(t *testing.T) {
+	var keys []string
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get("X-Goog-Api-Key"))
+		if r.URL.Query().Get("key") != "" {
+			t.Errorf("Expected the access token not to be forwarded, got '%s'", r.URL.RawQuery)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, `data: {"candidates": [{"content": {"parts": [{"text": "Done.[RESPONSE_FINISHED]"}], "role": "model"}, "finishReason": "STOP", "index": 0}]}`+"\n\n")
+	}))
+	defer upstreamServer.Close()
+
+	originalConfig := *config.AppConfig
+	config.AppConfig.UpstreamURLBase = upstreamServer.URL
+	config.AppConfig.KeyPoolFile = filepath.Join(t.TempDir(), "keys.json")
+	os.WriteFile(config.AppConfig.KeyPoolFile, []byte(`{"pools": {"default": ["default-key"], "batch": ["batch-key"]}}`), 0o600)
+	defer func() {
+		*config.AppConfig = originalConfig
+	}()
+
+	registry, err := keypool.Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	keypool.SetRegistry(registry)
+	defer keypool.SetRegistry(nil)
+
+	initialReq := &gemini.GenerateContentRequest{
+		Contents: []gemini.Content{{Role: "user", Parts: []gemini.Part{{Text: "Hi"}}}},
+	}
+	req := httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:streamGenerateContent?alt=sse&key=batch-token", nil)
+	req = req.WithContext(auth.NewContext(req.Context(), &auth.Client{ID: "batch-team", Pool: "batch"}))
+	rr := httptest.NewRecorder()
+
+	HandleStream(rr, req, initialReq, "batch-token")
+
+	// The upstream key comes from the client's pool; the access token stays with the proxy
+	if strings.Join(keys, ",") != "batch-key" {
+		t.Errorf("Expected keys [batch-key], got %v", keys)
+	}
+	if !strings.Contains(rr.Body.String(), "Done.") {
+		t.Errorf("Expected the stream to be forwarded, got '%s'", rr.Body.String())
+	}
+}
+
+func TestHandleNonStream_RateLimitCountsRetries(t *testing.T) {
+	calls := 0
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		// Never finishes, so every attempt asks for a continuation
+		fmt.Fprint(w, `{"candidates": [{"content": {"parts": [{"text": "More"}], "role": "model"}, "finishReason": "STOP", "index": 0}]}`)
+	}))
+	defer upstreamServer.Close()
+
+	originalUpstreamURL := config.AppConfig.UpstreamURLBase
+	config.AppConfig.UpstreamURLBase = upstreamServer.URL
+	defer func() {
+		config.AppConfig.UpstreamURLBase = originalUpstreamURL
+	}()
+
+	ratelimit.SetLimiter(ratelimit.NewLimiter(ratelimit.Limits{Model: ratelimit.Limit{RequestsPerMinute: 2}}))
+	defer ratelimit.SetLimiter(nil)
+
+	initialReq := &gemini.GenerateContentRequest{
+		Contents: []gemini.Content{{Role: "user", Parts: []gemini.Part{{Text: "Hi"}}}},
+	}
+	rr := httptest.NewRecorder()
+	HandleNonStream(rr, httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:generateContent", nil), initialReq, "test-key")
+
+	// The continuation counts against the limit, and the third attempt is rejected
+	if calls != 2 {
+		t.Errorf("Expected 2 upstream attempts, got %d", calls)
+	}
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status code %d, got %d", http.StatusTooManyRequests, rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), `"status":"RESOURCE_EXHAUSTED"`) {
+		t.Errorf("Expected a RESOURCE_EXHAUSTED error, got '%s'", rr.Body.String())
+	}
+	if rr.Header().Get("Retry-After") != "30" {
+		t.Errorf("Expected Retry-After '30', got '%s'", rr.Header().Get("Retry-After"))
+	}
+
+	// Further requests for this model are rejected before reaching the upstream
+	calls = 0
+	rr = httptest.NewRecorder()
+	HandleStream(rr, httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:streamGenerateContent?alt=sse", nil), initialReq, "test-key")
+	if calls != 0 || rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the stream to be rejected without an upstream attempt, got %d attempt(s) and status %d", calls, rr.Code)
+	}
+}
+
+func TestProxyHandler_RejectsWhenQueueIsFull(t *testing.T) {
+	limiter := concurrency.NewLimiter(1, 0, nil, 0, time.Second)
+	concurrency.SetLimiter(limiter)
+	defer concurrency.SetLimiter(nil)
+
+	// Another request holds the only slot
+	release, err := limiter.Acquire(context.Background(), "gemini-pro")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer release()
+
+	req := httptest.NewRequest("POST", "/v1beta/models/gemini-pro:generateContent", strings.NewReader(`{"contents": []}`))
+	req.Header.Set("Authorization", "Bearer test-key")
+	req = mux.SetURLVars(req, map[string]string{"model": "gemini-pro:generateContent"})
+	rr := httptest.NewRecorder()
+	ProxyHandler(rr, req)
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status code %d, got %d", http.StatusServiceUnavailable, rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), `"status":"UNAVAILABLE"`) {
+		t.Errorf("Expected an UNAVAILABLE error, got '%s'", rr.Body.String())
+	}
+
+	// The queue statistics show the rejection
+	rr = httptest.NewRecorder()
+	QueueStatsHandler(rr, httptest.NewRequest("GET", "/stats/queue", nil))
+	if !strings.Contains(rr.Body.String(), `"rejected":1`) {
+		t.Errorf("Expected the rejection in the queue statistics, got '%s'", rr.Body.String())
+	}
+}
+
+func TestHandleNonStream_Metrics(t *testing.T) {
+	calls := 0
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `{"error": {"code": 503, "status": "UNAVAILABLE"}}`)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		text := "Part one"
+		if calls == 3 {
+			text = " and two.[RESPONSE_FINISHED]"
+		}
+		fmt.Fprintf(w, `{"candidates": [{"content": {"parts": [{"text": %q}], "role": "model"}, "finishReason": "STOP", "index": 0}]}`, text)
+	}))
+	defer upstreamServer.Close()
+
+	originalConfig := *config.AppConfig
+	originalTargetModels := gemini.TargetModels
+	config.AppConfig.UpstreamURLBase = upstreamServer.URL
+	config.AppConfig.RetryBaseDelay = time.Millisecond
+	gemini.TargetModels = append([]string{"metrics-test-model"}, gemini.TargetModels...)
+	defer func() {
+		*config.AppConfig = originalConfig
+		gemini.TargetModels = originalTargetModels
+	}()
+
+	initialReq := &gemini.GenerateContentRequest{
+		Contents: []gemini.Content{{Role: "user", Parts: []gemini.Part{{Text: "Hi"}}}},
+	}
+	rr := httptest.NewRecorder()
+	HandleNonStream(rr, httptest.NewRequest("POST", "/v1beta/models/metrics-test-model:generateContent", nil), initialReq, "test-key")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+	responseLength := rr.Body.Len()
+
+	rr = httptest.NewRecorder()
+	metrics.Default.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	body := rr.Body.String()
+	for _, line := range []string{
+		`gemini_proxy_requests_total{model="metrics-test-model",mode="non_stream",outcome="complete"} 1`,
+		`gemini_proxy_upstream_responses_total{model="metrics-test-model",code="503"} 1`,
+		`gemini_proxy_upstream_responses_total{model="metrics-test-model",code="200"} 2`,
+		`gemini_proxy_finish_token_missing_total{model="metrics-test-model",mode="non_stream"} 1`,
+		`gemini_proxy_continuations_per_request_bucket{model="metrics-test-model",mode="non_stream",le="0"} 0`,
+		`gemini_proxy_continuations_per_request_bucket{model="metrics-test-model",mode="non_stream",le="1"} 1`,
+		`gemini_proxy_time_to_first_byte_seconds_count{model="metrics-test-model",mode="non_stream"} 1`,
+		`gemini_proxy_request_duration_seconds_count{model="metrics-test-model",mode="non_stream"} 1`,
+		`gemini_proxy_response_bytes_total{model="metrics-test-model",mode="non_stream"} ` + strconv.Itoa(responseLength),
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Expected metrics to contain '%s'", line)
+		}
+	}
+}
+
+func TestHandleNonStream_MetricsLabelBlockedPromptAndUnknownModel(t *testing.T) {
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, `{"promptFeedback": {"blockReason": "SAFETY"}}`)
+	}))
+	defer upstreamServer.Close()
+
+	originalUpstreamURL := config.AppConfig.UpstreamURLBase
+	config.AppConfig.UpstreamURLBase = upstreamServer.URL
+	defer func() {
+		config.AppConfig.UpstreamURLBase = originalUpstreamURL
+	}()
+
+	initialReq := &gemini.GenerateContentRequest{
+		Contents: []gemini.Content{{Role: "user", Parts: []gemini.Part{{Text: "Hi"}}}},
+	}
+	rr := httptest.NewRecorder()
+	HandleNonStream(rr, httptest.NewRequest("POST", "/v1beta/models/not-a-configured-model:generateContent", nil), initialReq, "test-key")
+
+	rr = httptest.NewRecorder()
+	metrics.Default.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	body := rr.Body.String()
+	if strings.Contains(body, "not-a-configured-model") {
+		t.Error("Expected a model that is not configured not to get series of its own")
+	}
+	if line := `gemini_proxy_requests_total{model="other",mode="non_stream",outcome="blocked"} `; !strings.Contains(body, line) {
+		t.Errorf("Expected metrics to contain '%s'", line)
+	}
+}
+
+func TestHandleNonStream_LogsOutcomeAsAttributes(t *testing.T) {
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, `{"candidates": [{"content": {"parts": [{"text": "I can't help"}], "role": "model"}, "finishReason": "SAFETY", "index": 0}]}`)
+	}))
+	defer upstreamServer.Close()
+
+	originalConfig := *config.AppConfig
+	originalLogger := slog.Default()
+	config.AppConfig.UpstreamURLBase = upstreamServer.URL
+	config.AppConfig.LogFormat = "json"
+	defer func() {
+		*config.AppConfig = originalConfig
+		slog.SetDefault(originalLogger)
+	}()
+	var buf bytes.Buffer
+	if err := util.SetupLogger(&buf); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	initialReq := &gemini.GenerateContentRequest{
+		Contents: []gemini.Content{{Role: "user", Parts: []gemini.Part{{Text: "Hi"}}}},
+	}
+	req := httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:generateContent", nil)
+	req = req.WithContext(util.WithRequestID(req.Context(), "req-42"))
+	HandleNonStream(httptest.NewRecorder(), req, initialReq, "test-key")
+
+	var finished map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Expected a JSON log line, got '%s'", line)
+		}
+		if record["msg"] == "Request finished" {
+			finished = record
+		}
+	}
+	if finished == nil {
+		t.Fatalf("Expected a final log line, got '%s'", buf.String())
+	}
+	if finished["outcome"] != "terminal" || finished["model"] != "gemini-2.5-pro" || finished["mode"] != "non_stream" ||
+		finished["attempts"] != float64(1) || finished["request_id"] != "req-42" {
+		t.Errorf("Unexpected attributes of the final log line: %v", finished)
+	}
+}
+
+func TestHandleNonStream_Tracing(t *testing.T) {
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	calls := 0
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if sc, ok := tracing.ParseTraceparent(r.Header.Get("traceparent")); !ok || sc.TraceID.String() != traceID {
+			t.Errorf("Expected attempt %d to continue trace %s, got traceparent '%s'", calls, traceID, r.Header.Get("traceparent"))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `{"error": {"code": 503, "status": "UNAVAILABLE"}}`)
+			return
+		}
+		text := "Part one"
+		if calls == 3 {
+			text = " and two.[RESPONSE_FINISHED]"
+		}
+		fmt.Fprintf(w, `{"candidates": [{"content": {"parts": [{"text": %q}], "role": "model"}, "finishReason": "STOP", "index": 0}]}`, text)
+	}))
+	defer upstreamServer.Close()
+
+	// A collector stub that keeps the spans it receives, by name
+	type span struct {
+		Name         string `json:"name"`
+		TraceID      string `json:"traceId"`
+		ParentSpanID string `json:"parentSpanId"`
+		Attributes   []struct {
+			Key   string                 `json:"key"`
+			Value map[string]interface{} `json:"value"`
+		} `json:"attributes"`
+		Status struct {
+			Code int `json:"code"`
+		} `json:"status"`
+	}
+	var spans []span
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []span `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}))
+	defer collector.Close()
+	attr := func(s span, key string) interface{} {
+		for _, a := range s.Attributes {
+			if a.Key == key {
+				for _, v := range a.Value {
+					return v
+				}
+			}
+		}
+		return nil
+	}
+
+	originalConfig := *config.AppConfig
+	config.AppConfig.UpstreamURLBase = upstreamServer.URL
+	config.AppConfig.RetryBaseDelay = time.Millisecond
+	config.AppConfig.OTLPEndpoint = collector.URL
+	defer func() {
+		*config.AppConfig = originalConfig
+	}()
+	tracer, err := tracing.Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	tracing.SetTracer(tracer)
+	defer tracing.SetTracer(nil)
+
+	initialReq := &gemini.GenerateContentRequest{
+		Contents: []gemini.Content{{Role: "user", Parts: []gemini.Part{{Text: "Hi"}}}},
+	}
+	req := httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:generateContent", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	rr := httptest.NewRecorder()
+	tracing.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		HandleNonStream(w, r, initialReq, "test-key")
+	})).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(spans) != 4 {
+		t.Fatalf("Expected a request span and 3 attempt spans, got %d", len(spans))
+	}
+	request := spans[3]
+	if request.TraceID != traceID || request.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("Expected the request span to continue the client's trace, got %+v", request)
+	}
+	if attr(request, "gemini_proxy.outcome") != "complete" || attr(request, "gemini_proxy.attempts") != "3" || attr(request, "gemini_proxy.continuations") != "1" {
+		t.Errorf("Unexpected request span attributes: %+v", request.Attributes)
+	}
+	for i, s := range spans[:3] {
+		if s.Name != "upstream attempt" || s.ParentSpanID == "" || attr(s, "gemini_proxy.attempt") != strconv.Itoa(i+1) {
+			t.Errorf("Unexpected attempt span %d: %+v", i+1, s)
+		}
+	}
+	if attr(spans[0], "http.response.status_code") != "503" || spans[0].Status.Code != 2 {
+		t.Errorf("Expected the first attempt to fail with 503, got %+v", spans[0])
+	}
+	if attr(spans[1], "gemini_proxy.decision") != "truncated-retry" || attr(spans[1], "gemini_proxy.accumulated_text_length") != "8" {
+		t.Errorf("Unexpected attributes of the truncated attempt: %+v", spans[1].Attributes)
+	}
+	if attr(spans[2], "gemini_proxy.decision") != "complete" || attr(spans[2], "gemini_proxy.finish_reason") != "STOP" {
+		t.Errorf("Unexpected attributes of the final attempt: %+v", spans[2].Attributes)
+	}
+}
+
+func TestHealthzHandler(t *testing.T) {
+	rr := httptest.NewRecorder()
+	HealthzHandler(rr, httptest.NewRequest("GET", "/healthz", nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"status":"ok"`) {
+		t.Errorf("Expected status code %d and status ok, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+}
+
+func TestReadyzHandler(t *testing.T) {
+	upstreamStatus := http.StatusOK
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/v1beta/models" || r.Header.Get("X-Goog-Api-Key") != "pool-key" {
+			t.Errorf("Unexpected probe %s %s with key '%s'", r.Method, r.URL.Path, r.Header.Get("X-Goog-Api-Key"))
+		}
+		w.WriteHeader(upstreamStatus)
+		fmt.Fprint(w, `{"models": []}`)
+	}))
+	defer upstreamServer.Close()
+
+	originalConfig := *config.AppConfig
+	config.AppConfig.UpstreamURLBase = upstreamServer.URL
+	config.AppConfig.GeminiAPIKeys = []string{"pool-key"}
+	config.AppConfig.ReadinessProbeUpstream = true
+	config.AppConfig.ReadinessProbeInterval = 0
+	defer func() {
+		*config.AppConfig = originalConfig
+	}()
+	registry, err := keypool.Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	keypool.SetRegistry(registry)
+	defer keypool.SetRegistry(nil)
+
+	readyz := func() (int, string) {
+		rr := httptest.NewRecorder()
+		ReadyzHandler(rr, httptest.NewRequest("GET", "/readyz", nil))
+		return rr.Code, rr.Body.String()
+	}
+
+	code, body := readyz()
+	if code != http.StatusOK || !strings.Contains(body, `"status":"ready"`) || !strings.Contains(body, `{"name":"default","healthy":1,"quarantined":0,"disabled":0}`) {
+		t.Errorf("Expected a ready proxy with a healthy default pool, got %d: %s", code, body)
+	}
+
+	// An upstream error means the upstream is unavailable
+	upstreamStatus = http.StatusServiceUnavailable
+	if code, body := readyz(); code != http.StatusServiceUnavailable || !strings.Contains(body, "the upstream is unreachable") || !strings.Contains(body, `"statusCode":503`) {
+		t.Errorf("Expected the proxy not to be ready, got %d: %s", code, body)
+	}
+
+	// A recent result is reused
+	config.AppConfig.ReadinessProbeInterval = time.Minute
+	upstreamStatus = http.StatusOK
+	if code, _ := readyz(); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the cached probe result, got %d", code)
+	}
+	config.AppConfig.ReadinessProbeInterval = 0
+
+	// Without a healthy key the proxy cannot serve requests
+	selector := registry.ForPool(keypool.DefaultPool)
+	selector.Key()
+	selector.Report(http.StatusForbidden, 0)
+	if code, body := readyz(); code != http.StatusServiceUnavailable || !strings.Contains(body, "no key pool has a healthy key") {
+		t.Errorf("Expected the proxy not to be ready, got %d: %s", code, body)
+	}
+}
+
+func TestVersionHandler(t *testing.T) {
+	originalConfig := *config.AppConfig
+	config.AppConfig.GeminiAPIKeys = []string{"AIzaSecretKey"}
+	config.AppConfig.ProxyTokens = []string{"alice:secret-token"}
+	defer func() {
+		*config.AppConfig = originalConfig
+	}()
+
+	rr := httptest.NewRecorder()
+	VersionHandler(rr, httptest.NewRequest("GET", "/version", nil))
+	body := rr.Body.String()
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+	var info struct {
+		Version string `json:"version"`
+		Commit  string `json:"commit"`
+		Config  struct {
+			Port        int      `json:"port"`
+			ProxyTokens []string `json:"proxyTokens"`
+			ReadTimeout string   `json:"readTimeout"`
+		} `json:"config"`
+	}
+	if err := json.Unmarshal([]byte(body), &info); err != nil {
+		t.Fatalf("Invalid JSON: %v", err)
+	}
+	if info.Version == "" || info.Commit == "" || info.Config.Port != config.AppConfig.Port || info.Config.ReadTimeout != config.AppConfig.ReadTimeout.String() {
+		t.Errorf("Expected the version, commit and configuration, got %s", body)
+	}
+	if strings.Contains(body, "AIzaSecretKey") || strings.Contains(body, "secret-token") || info.Config.ProxyTokens[0] != "alice:[REDACTED]" {
+		t.Errorf("Expected secrets to be redacted, got %s", body)
+	}
+}
+
+func TestHandleStream_EndsWithErrorEventOnShutdown(t *testing.T) {
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, `data: {"candidates": [{"content": {"parts": [{"text": "Half an answer"}], "role": "model"}, "index": 0}]}`+"\n\n")
+		w.(http.Flusher).Flush()
+		// The rest of the answer never comes
+		<-r.Context().Done()
+	}))
+	defer upstreamServer.Close()
+
+	originalConfig := *config.AppConfig
+	config.AppConfig.UpstreamURLBase = upstreamServer.URL
+	defer func() {
+		*config.AppConfig = originalConfig
+	}()
+	lc := lifecycle.New()
+	lifecycle.SetLifecycle(lc)
+	defer lifecycle.SetLifecycle(nil)
+
+	initialReq := &gemini.GenerateContentRequest{
+		Contents: []gemini.Content{{Role: "user", Parts: []gemini.Part{{Text: "Hi"}}}},
+	}
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		HandleStream(w, r, initialReq, "test-key")
+	}))
+	defer proxyServer.Close()
+
+	resp, err := http.Post(proxyServer.URL+"/v1beta/models/gemini-2.5-pro:streamGenerateContent?alt=sse", "application/json", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	first, err := reader.ReadString('\n')
+	if err != nil || !strings.Contains(first, "Half an answer") {
+		t.Fatalf("Expected the first chunk, got '%s' (%v)", first, err)
+	}
+
+	// The grace period is over while the stream waits for the upstream
+	lc.Stop()
+	rest, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Expected the stream to end cleanly, got %v", err)
+	}
+	if !strings.Contains(string(rest), `"code":503`) || !strings.Contains(string(rest), "shutting down") {
+		t.Errorf("Expected a terminal error event, got '%s'", rest)
+	}
+}
+
+func TestPassthroughRequest_EndsOnShutdown(t *testing.T) {
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The answer never comes
+		io.Copy(io.Discard, r.Body)
+		<-r.Context().Done()
+	}))
+	defer upstreamServer.Close()
+
+	originalConfig := *config.AppConfig
+	config.AppConfig.UpstreamURLBase = upstreamServer.URL
+	defer func() {
+		*config.AppConfig = originalConfig
+	}()
+	lc := lifecycle.New()
+	lifecycle.SetLifecycle(lc)
+	defer lifecycle.SetLifecycle(nil)
+
+	// The grace period is over while the request waits for the upstream
+	time.AfterFunc(50*time.Millisecond, lc.Stop)
+	req := httptest.NewRequest("POST", "/v1beta/models/gemini-pro:generateContent", nil)
+	rr := httptest.NewRecorder()
+	passthroughRequest(rr, req, "test-key", &gemini.GenerateContentRequest{})
+
+	if rr.Code != http.StatusServiceUnavailable || !strings.Contains(rr.Body.String(), "shutting down") {
+		t.Errorf("Expected a 503 shutdown error, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestReadyzHandler_NotReadyWhileShuttingDown(t *testing.T) {
+	lc := lifecycle.New()
+	lifecycle.SetLifecycle(lc)
+	defer lifecycle.SetLifecycle(nil)
+
+	lc.Drain()
+	rr := httptest.NewRecorder()
+	ReadyzHandler(rr, httptest.NewRequest("GET", "/readyz", nil))
+	if rr.Code != http.StatusServiceUnavailable || !strings.Contains(rr.Body.String(), "the proxy is shutting down") {
+		t.Errorf("Expected the proxy not to be ready, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestHandleStream_ContinuesStalledStream(t *testing.T) {
+	var requests []gemini.GenerateContentRequest
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req gemini.GenerateContentRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		requests = append(requests, req)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		if len(requests) == 1 {
+			fmt.Fprint(w, `data: {"candidates": [{"content": {"parts": [{"text": "Part one, "}], "role": "model"}, "index": 0}]}`+"\n\n")
+			w.(http.Flusher).Flush()
+			// The connection stays open but nothing more comes
+			<-r.Context().Done()
+			return
+		}
+		fmt.Fprint(w, `data: {"candidates": [{"content": {"parts": [{"text": "part two.[RESPONSE_FINISHED]"}], "role": "model"}, "finishReason": "STOP", "index": 0}]}`+"\n\n")
+	}))
+	defer upstreamServer.Close()
+
+	originalConfig := *config.AppConfig
+	config.AppConfig.UpstreamURLBase = upstreamServer.URL
+	config.AppConfig.StreamChunkTimeout = 100 * time.Millisecond
+	defer func() {
+		*config.AppConfig = originalConfig
+	}()
+
+	initialReq := &gemini.GenerateContentRequest{
+		Contents: []gemini.Content{{Role: "user", Parts: []gemini.Part{{Text: "Hi"}}}},
+	}
+	req := httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:streamGenerateContent?alt=sse", nil)
+	rr := httptest.NewRecorder()
+
+	HandleStream(rr, req, initialReq, "test-key")
+
+	if len(requests) != 2 {
+		t.Fatalf("Expected 2 upstream attempts, got %d", len(requests))
+	}
+	continuation := requests[1].Contents
+	if len(continuation) != 3 || continuation[1].Role != "model" || continuation[1].Parts[0].Text != "Part one, " {
+		t.Errorf("Expected a continuation from the text received before the stall, got %+v", continuation)
+	}
+	body := rr.Body.String()
+	if !strings.Contains(body, "Part one, ") || !strings.Contains(body, "part two.") || strings.Contains(body, `"error"`) {
+		t.Errorf("Expected both parts of the answer without an error, got '%s'", body)
+	}
+}
+
+func TestHandleStream_ResendsStreamStalledBeforeFirstChunk(t *testing.T) {
+	var requests []gemini.GenerateContentRequest
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req gemini.GenerateContentRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		requests = append(requests, req)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		if len(requests) == 1 {
+			// The headers arrive, but not a single chunk
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		fmt.Fprint(w, `data: {"candidates": [{"content": {"parts": [{"text": "Hello.[RESPONSE_FINISHED]"}], "role": "model"}, "finishReason": "STOP", "index": 0}]}`+"\n\n")
+	}))
+	defer upstreamServer.Close()
+
+	originalConfig := *config.AppConfig
+	config.AppConfig.UpstreamURLBase = upstreamServer.URL
+	config.AppConfig.StreamFirstChunkTimeout = 100 * time.Millisecond
+	config.AppConfig.RetryBaseDelay = time.Millisecond
+	// The resend is an error retry, so it needs no continuation budget
+	config.AppConfig.MaxErrorRetries, config.AppConfig.MaxContinuations = 1, 0
+	defer func() {
+		*config.AppConfig = originalConfig
+	}()
+
+	initialReq := &gemini.GenerateContentRequest{
+		Contents: []gemini.Content{{Role: "user", Parts: []gemini.Part{{Text: "Hi"}}}},
+	}
+	req := httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:streamGenerateContent?alt=sse", nil)
+	rr := httptest.NewRecorder()
+
+	HandleStream(rr, req, initialReq, "test-key")
+
+	if len(requests) != 2 {
+		t.Fatalf("Expected 2 upstream attempts, got %d", len(requests))
+	}
+	if resent := requests[1].Contents; len(resent) != 1 || resent[0].Role != "user" || resent[0].Parts[0].Text != "Hi" {
+		t.Errorf("Expected the original request to be resent without a model turn, got %+v", resent)
+	}
+	body := rr.Body.String()
+	if !strings.Contains(body, "Hello.") || strings.Contains(body, `"error"`) {
+		t.Errorf("Expected the answer of the second attempt without an error, got '%s'", body)
+	}
+
+	// Without an error retry left, the request fails rather than asking for a continuation
+	requests = nil
+	config.AppConfig.MaxErrorRetries, config.AppConfig.MaxContinuations = 0, 2
+	rr = httptest.NewRecorder()
+	HandleStream(rr, req, initialReq, "test-key")
+	if len(requests) != 1 {
+		t.Errorf("Expected a single upstream attempt, got %d", len(requests))
+	}
+	if rr.Code != http.StatusBadGateway {
+		t.Errorf("Expected status code %d, got %d: %s", http.StatusBadGateway, rr.Code, rr.Body.String())
+	}
+}
+
+// disconnectingWriter is a ResponseWriter whose client goes away after the first flush.
+type disconnectingWriter struct {
+	*httptest.ResponseRecorder
+	flushed bool
+}
+
+// Write fails once the response has been flushed.
+func (dw *disconnectingWriter) Write(p []byte) (int, error) {
+	if dw.flushed {
+		return 0, errors.New("write: broken pipe")
+	}
+	return dw.ResponseRecorder.Write(p)
+}
+
+// Flush flushes the recorder and disconnects the client.
+func (dw *disconnectingWriter) Flush() {
+	dw.flushed = true
+	dw.ResponseRecorder.Flush()
+}
+
+func TestHandleStream_StopsWhenClientDisconnects(t *testing.T) {
+	calls := 0
+	abandoned := make(chan struct{})
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		for _, text := range []string{"Part one, ", "part two, "} {
+			fmt.Fprintf(w, `data: {"candidates": [{"content": {"parts": [{"text": %q}], "role": "model"}, "index": 0}]}`+"\n\n", text)
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-r.Context().Done():
+			close(abandoned)
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer upstreamServer.Close()
+
+	originalConfig := *config.AppConfig
+	originalTargetModels := gemini.TargetModels
+	config.AppConfig.UpstreamURLBase = upstreamServer.URL
+	gemini.TargetModels = append([]string{"disconnect-test-model"}, gemini.TargetModels...)
+	defer func() {
+		*config.AppConfig = originalConfig
+		gemini.TargetModels = originalTargetModels
+	}()
+
+	initialReq := &gemini.GenerateContentRequest{
+		Contents: []gemini.Content{{Role: "user", Parts: []gemini.Part{{Text: "Hi"}}}},
+	}
+	req := httptest.NewRequest("POST", "/v1beta/models/disconnect-test-model:streamGenerateContent?alt=sse", nil)
+	HandleStream(&disconnectingWriter{ResponseRecorder: httptest.NewRecorder()}, req, initialReq, "test-key")
+
+	select {
+	case <-abandoned:
+	case <-time.After(2 * time.Second):
+		t.Error("Expected the upstream stream to be abandoned")
+	}
+	if calls != 1 {
+		t.Errorf("Expected 1 upstream attempt, got %d", calls)
+	}
+
+	rr := httptest.NewRecorder()
+	metrics.Default.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if line := `gemini_proxy_requests_total{model="disconnect-test-model",mode="stream",outcome="client_cancelled"} 1`; !strings.Contains(rr.Body.String(), line+"\n") {
+		t.Errorf("Expected metrics to contain '%s'", line)
+	}
+}
@@ -0,0 +1,175 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gemini-anti-truncate-go/internal/config"
+	"gemini-anti-truncate-go/internal/keypool"
+	"gemini-anti-truncate-go/internal/lifecycle"
+	"gemini-anti-truncate-go/internal/upstream"
+	"gemini-anti-truncate-go/internal/version"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// probeTimeout bounds the upstream call of a readiness probe.
+const probeTimeout = 5 * time.Second
+
+// HealthzHandler reports that the process is alive. It does not depend on the upstream, so
+// that an unreachable upstream never gets the proxy restarted.
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// poolHealth is the state of the keys of a key pool.
+type poolHealth struct {
+	Name        string `json:"name"`
+	Healthy     int    `json:"healthy"`
+	Quarantined int    `json:"quarantined"`
+	Disabled    int    `json:"disabled"`
+}
+
+// upstreamHealth is the result of an upstream probe.
+type upstreamHealth struct {
+	Status     string    `json:"status"` // ok, failed or skipped
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	CheckedAt  time.Time `json:"checkedAt"`
+}
+
+// ReadyzHandler reports whether the proxy can serve requests, with 200 or 503. It is not ready
+// while it shuts down, when key pools are configured but none has a healthy key, or, with
+// READINESS_PROBE_UPSTREAM, when the upstream cannot be reached.
+func ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	ready := true
+	var problems []string
+
+	if lifecycle.Current().Draining() {
+		ready = false
+		problems = append(problems, "the proxy is shutting down")
+	}
+
+	registry := keypool.Current()
+	pools := []poolHealth{}
+	healthyKeys := 0
+	for _, name := range registry.Pools() {
+		health := poolHealth{Name: name}
+		health.Healthy, health.Quarantined, health.Disabled = registry.Pool(name).Stats()
+		healthyKeys += health.Healthy
+		pools = append(pools, health)
+	}
+	if len(pools) > 0 && healthyKeys == 0 {
+		ready = false
+		problems = append(problems, "no key pool has a healthy key")
+	}
+
+	var upstream *upstreamHealth
+	if config.AppConfig.ReadinessProbeUpstream {
+		upstream = readinessProbe.check()
+		if upstream.Status == "failed" {
+			ready = false
+			problems = append(problems, "the upstream is unreachable")
+		}
+	}
+
+	status, code := "ready", http.StatusOK
+	if !ready {
+		status, code = "not ready: "+strings.Join(problems, ", "), http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, struct {
+		Status   string          `json:"status"`
+		KeyPools []poolHealth    `json:"keyPools"`
+		Upstream *upstreamHealth `json:"upstream,omitempty"`
+	}{status, pools, upstream})
+}
+
+// upstreamProbe lists the upstream's models to check that it is reachable, and keeps the result
+// for READINESS_PROBE_INTERVAL, so that frequent readiness checks do not spend upstream quota.
+type upstreamProbe struct {
+	mu   sync.Mutex
+	last *upstreamHealth
+}
+
+// readinessProbe is the upstream probe of ReadyzHandler.
+var readinessProbe = &upstreamProbe{}
+
+// check returns the last result if it is recent enough, or probes the upstream again. The probe
+// does not use the context of the readiness request, so that a caller that gives up early does
+// not leave a failed result behind.
+func (p *upstreamProbe) check() *upstreamHealth {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.last != nil && time.Since(p.last.CheckedAt) < config.AppConfig.ReadinessProbeInterval {
+		return p.last
+	}
+	p.last = p.probe(context.Background())
+	return p.last
+}
+
+// probe makes a lightweight models-list call with a key of the default pool. Any answer but a
+// 5xx means the upstream is reachable: a rate-limited key is handled by the key pool. Without
+// a healthy server-side key there is nothing to probe with. The pool is only inspected, so that
+// probes do not move its keys' rotation.
+func (p *upstreamProbe) probe(ctx context.Context) *upstreamHealth {
+	health := &upstreamHealth{CheckedAt: time.Now()}
+	var apiKey string
+	if pool := keypool.Current().Pool(keypool.DefaultPool); pool != nil {
+		if healthy, _, _ := pool.Stats(); healthy > 0 {
+			apiKey, _ = pool.Peek()
+		}
+	}
+	if apiKey == "" {
+		health.Status = "skipped"
+		health.Error = "no server-side API key to probe with"
+		return health
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	probeURL := strings.TrimRight(config.AppConfig.UpstreamURLBase, "/") + "/v1beta/models?pageSize=1"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, probeURL, nil)
+	if err != nil {
+		health.Status = "failed"
+		health.Error = err.Error()
+		return health
+	}
+	req.Header.Set("X-Goog-Api-Key", apiKey)
+
+	resp, err := upstream.CurrentClient().Do(req)
+	if err != nil {
+		health.Status = "failed"
+		health.Error = err.Error()
+		return health
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	health.StatusCode = resp.StatusCode
+	if resp.StatusCode >= 500 {
+		health.Status = "failed"
+		health.Error = fmt.Sprintf("upstream returned %s", resp.Status)
+		return health
+	}
+	health.Status = "ok"
+	return health
+}
+
+// VersionHandler reports the build version and commit and the effective configuration, with
+// secrets redacted.
+func VersionHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, struct {
+		version.Info
+		Config config.Config `json:"config"`
+	}{version.Get(), config.AppConfig.Redacted()})
+}
+
+// writeJSON sends a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, statusCode int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,179 @@
+package handler
+
+import (
+	"gemini-anti-truncate-go/internal/concurrency"
+	"gemini-anti-truncate-go/internal/gemini"
+	"gemini-anti-truncate-go/internal/keypool"
+	"gemini-anti-truncate-go/internal/metrics"
+	"gemini-anti-truncate-go/internal/proxy"
+	"gemini-anti-truncate-go/internal/retry"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Request modes, as reported in the mode label of the metrics.
+const (
+	modeStream      = "stream"
+	modeNonStream   = "non_stream"
+	modePassthrough = "passthrough"
+)
+
+var (
+	requestsTotal = metrics.Default.NewCounterVec("gemini_proxy_requests_total",
+		"Client requests by model, mode and outcome.", "model", "mode", "outcome")
+	continuationsPerRequest = metrics.Default.NewHistogramVec("gemini_proxy_continuations_per_request",
+		"Continuations requested per client request because the answer was truncated.",
+		[]float64{0, 1, 2, 3, 5, 10, 20}, "model", "mode")
+	finishTokenMissing = metrics.Default.NewCounterVec("gemini_proxy_finish_token_missing_total",
+		"Upstream answers that ended without the finish token.", "model", "mode")
+	streamStalls = metrics.Default.NewCounterVec("gemini_proxy_stream_stalls_total",
+		"Upstream streams aborted because they stopped sending data.", "model")
+	upstreamResponses = metrics.Default.NewCounterVec("gemini_proxy_upstream_responses_total",
+		"Upstream attempts by model and HTTP status code, or \"transport\" when no response was received.", "model", "code")
+	timeToFirstByte = metrics.Default.NewHistogramVec("gemini_proxy_time_to_first_byte_seconds",
+		"Time from receiving a client request to sending the first byte of the response body.",
+		metrics.DefBuckets, "model", "mode")
+	requestDuration = metrics.Default.NewHistogramVec("gemini_proxy_request_duration_seconds",
+		"Total time spent on a client request, all attempts included.", metrics.DefBuckets, "model", "mode")
+	responseBytes = metrics.Default.NewCounterVec("gemini_proxy_response_bytes_total",
+		"Bytes of response bodies sent or streamed to clients.", "model", "mode")
+)
+
+// The state of the concurrency gates and key pools is collected when the metrics are scraped.
+func init() {
+	gateSamples := func(value func(concurrency.Stats) float64) func() []metrics.Sample {
+		return func() []metrics.Sample {
+			var samples []metrics.Sample
+			for _, stats := range concurrency.Current().Stats() {
+				samples = append(samples, metrics.Sample{Labels: []string{stats.Name}, Value: value(stats)})
+			}
+			return samples
+		}
+	}
+	metrics.Default.NewGaugeFunc("gemini_proxy_requests_in_flight", "Client requests holding a slot of a concurrency gate.",
+		[]string{"gate"}, gateSamples(func(s concurrency.Stats) float64 { return float64(s.Active) }))
+	metrics.Default.NewGaugeFunc("gemini_proxy_queue_depth", "Client requests waiting for a slot of a concurrency gate.",
+		[]string{"gate"}, gateSamples(func(s concurrency.Stats) float64 { return float64(s.Queued) }))
+	metrics.Default.NewCounterFunc("gemini_proxy_queue_waited_total", "Client requests that got a slot after waiting in the queue.",
+		[]string{"gate"}, gateSamples(func(s concurrency.Stats) float64 { return float64(s.Waited) }))
+	metrics.Default.NewCounterFunc("gemini_proxy_queue_wait_seconds_total", "Time client requests spent waiting in the queue.",
+		[]string{"gate"}, gateSamples(func(s concurrency.Stats) float64 { return s.WaitTotal.Seconds() }))
+	metrics.Default.NewCounterFunc("gemini_proxy_queue_rejected_total", "Client requests rejected because the queue was full.",
+		[]string{"gate"}, gateSamples(func(s concurrency.Stats) float64 { return float64(s.Rejected) }))
+	metrics.Default.NewCounterFunc("gemini_proxy_queue_timeouts_total", "Client requests rejected after waiting for the maximum time.",
+		[]string{"gate"}, gateSamples(func(s concurrency.Stats) float64 { return float64(s.TimedOut) }))
+
+	metrics.Default.NewGaugeFunc("gemini_proxy_upstream_keys", "Upstream API keys by pool and state.",
+		[]string{"pool", "state"}, func() []metrics.Sample {
+			var samples []metrics.Sample
+			registry := keypool.Current()
+			for _, name := range registry.Pools() {
+				healthy, quarantined, disabled := registry.Pool(name).Stats()
+				samples = append(samples,
+					metrics.Sample{Labels: []string{name, "healthy"}, Value: float64(healthy)},
+					metrics.Sample{Labels: []string{name, "quarantined"}, Value: float64(quarantined)},
+					metrics.Sample{Labels: []string{name, "disabled"}, Value: float64(disabled)})
+			}
+			return samples
+		})
+}
+
+// meteredWriter wraps the client's ResponseWriter to measure the time to the first byte of
+// the response body and the number of bytes sent.
+type meteredWriter struct {
+	http.ResponseWriter
+	start     time.Time
+	firstByte time.Duration // Zero until the first write
+	bytes     int64
+}
+
+// newMeteredWriter starts measuring a client request.
+func newMeteredWriter(w http.ResponseWriter) *meteredWriter {
+	return &meteredWriter{ResponseWriter: w, start: time.Now()}
+}
+
+// Write records the first write and counts the bytes written.
+func (mw *meteredWriter) Write(p []byte) (int, error) {
+	if mw.firstByte == 0 {
+		mw.firstByte = time.Since(mw.start)
+	}
+	n, err := mw.ResponseWriter.Write(p)
+	mw.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap returns the wrapped ResponseWriter, so that http.ResponseController can flush it.
+func (mw *meteredWriter) Unwrap() http.ResponseWriter {
+	return mw.ResponseWriter
+}
+
+// observe records the metrics of a finished client request.
+func (mw *meteredWriter) observe(model, mode string, outcome outcome) {
+	requestsTotal.Inc(model, mode, string(outcome))
+	requestDuration.Observe(time.Since(mw.start).Seconds(), model, mode)
+	if mw.firstByte > 0 {
+		timeToFirstByte.Observe(mw.firstByte.Seconds(), model, mode)
+	}
+	responseBytes.Add(float64(mw.bytes), model, mode)
+}
+
+// observeUpstream counts an upstream attempt by its status code, or as a transport error if it got no response.
+func observeUpstream(model string, resp *http.Response) {
+	code := "transport"
+	if resp != nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	upstreamResponses.Inc(modelLabel(model), code)
+}
+
+// otherModel is the model label of the models the proxy is not configured for.
+const otherModel = "other"
+
+// modelLabel returns the model label of a model: the model itself if it is a target model or a
+// fallback model of the retry policy, or otherModel. The model comes from the client's URL, so
+// labeling every model by name would let any client create an unbounded number of series.
+func modelLabel(model string) string {
+	if slices.Contains(gemini.TargetModels, model) || slices.Contains(retry.CurrentPolicy().FallbackModels, model) {
+		return model
+	}
+	return otherModel
+}
+
+// outcome is how a client request ended, as reported in the outcome label of the metrics and
+// on the request's span.
+type outcome string
+
+const (
+	outcomeComplete        outcome = "complete"         // The answer was completed
+	outcomePartial         outcome = "partial"          // The policy returned the answer generated so far
+	outcomeMaxTokens       outcome = "max_tokens"       // The answer reached the output token limit and was returned
+	outcomeTerminal        outcome = "terminal"         // The model stopped for a reason such as SAFETY
+	outcomeBlocked         outcome = "blocked"          // The prompt was blocked, or the response had no candidate
+	outcomeError           outcome = "error"            // The generation failed, e.g. with MALFORMED_FUNCTION_CALL
+	outcomeExhausted       outcome = "exhausted"        // A retry budget was used up
+	outcomeDeadline        outcome = "deadline"         // The request deadline passed
+	outcomeRateLimited     outcome = "rate_limited"     // A rate limit of the proxy was reached
+	outcomeShutdown        outcome = "shutdown"         // The shutdown grace period ended the request
+	outcomeClientCancelled outcome = "client_cancelled" // The client went away before it was answered
+	outcomeFailed          outcome = "failed"           // An upstream or proxy error was returned
+)
+
+// decisionOutcome returns the outcome of a request that ended with an attempt of the given decision.
+func decisionOutcome(decision proxy.Decision) outcome {
+	switch decision {
+	case proxy.DecisionComplete:
+		return outcomeComplete
+	case proxy.DecisionRetry:
+		return outcomePartial
+	case proxy.DecisionMaxTokens:
+		return outcomeMaxTokens
+	case proxy.DecisionTerminal:
+		return outcomeTerminal
+	case proxy.DecisionBlocked:
+		return outcomeBlocked
+	default:
+		return outcomeError
+	}
+}
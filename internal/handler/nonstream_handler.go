@@ -1,85 +1,112 @@
 package handler
 
 import (
-	"bytes"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"gemini-anti-truncate-go/internal/config"
 	"gemini-anti-truncate-go/internal/gemini"
 	"gemini-anti-truncate-go/internal/proxy"
+	"gemini-anti-truncate-go/internal/ratelimit"
+	"gemini-anti-truncate-go/internal/retry"
+	"gemini-anti-truncate-go/internal/upstream"
 	"gemini-anti-truncate-go/internal/util"
 	"io"
 	"net/http"
 )
 
 // HandleNonStream manages non-streaming requests, including the retry logic for truncated responses.
+// Upstream errors and incomplete answers are handled as the retry policy says. The text of every
+// attempt is carried into the next continuation, and the attempts are stitched into a single
+// response once the answer is complete.
 func HandleNonStream(w http.ResponseWriter, r *http.Request, initialReq *gemini.GenerateContentRequest, apiKey string) {
+	meter := newMeteredWriter(w)
+	w = meter
+	model := modelLabel(upstream.ModelFromPath(r.URL.Path))
+
 	currentReq := initialReq
-	httpClient := &http.Client{}
+	caller := newUpstreamCaller(r, apiKey)
+	defer caller.close()
+	var accumulatedParts []gemini.Part
+	var attempts []*gemini.GenerateContentResponse
+
+	// The outcome labels the metrics and the trace; the detail describes it in the log.
+	outcome, detail := outcomeFailed, "failed"
+	defer func() {
+		caller.logOutcome(modeNonStream, outcome, detail)
+		meter.observe(model, modeNonStream, outcome)
+		caller.traceOutcome(outcome)
+		continuationsPerRequest.Observe(float64(caller.session.Used(retry.BudgetContinuation)), model, modeNonStream)
+	}()
 
-	for i := 0; i < config.AppConfig.MaxRetries; i++ {
-		util.Debugf("Non-stream attempt %d/%d", i+1, config.AppConfig.MaxRetries)
+	for {
+		util.Debug(r.Context(), "Sending non-stream attempt", "attempt", len(attempts)+1)
 
 		// 1. Prepare the upstream request
-		reqBodyBytes, err := json.Marshal(currentReq)
+		reqBodyBytes, err := currentReq.MarshalJSON()
 		if err != nil {
 			util.SendJSONError(w, "Failed to marshal request body", http.StatusInternalServerError)
 			return
 		}
 
-		upstreamURL := fmt.Sprintf("%s/%s", config.AppConfig.UpstreamURLBase, r.URL.Path)
-		upstreamReq, err := http.NewRequestWithContext(r.Context(), http.MethodPost, upstreamURL, bytes.NewBuffer(reqBodyBytes))
-		if err != nil {
-			util.SendJSONError(w, "Failed to create upstream request", http.StatusInternalServerError)
-			return
-		}
-
-		// Copy essential headers
-		upstreamReq.Header.Set("Content-Type", "application/json")
-		upstreamReq.Header.Set("X-Goog-Api-Key", apiKey)
-		if auth := r.Header.Get("Authorization"); auth != "" {
-			upstreamReq.Header.Set("Authorization", auth)
-		}
-
-		// 2. Execute the request
-		upstreamResp, err := httpClient.Do(upstreamReq)
-		if err != nil {
-			util.SendJSONError(w, fmt.Sprintf("Upstream request failed: %v", err), http.StatusBadGateway)
+		// 2. Execute the request, retrying upstream errors as the policy allows
+		upstreamResp, failure := caller.send(reqBodyBytes)
+		if failure != nil {
+			var exceeded *ratelimit.ExceededError
+			switch {
+			case caller.shutDown():
+				outcome, detail = outcomeShutdown, "was interrupted by shutdown"
+				util.SendJSONError(w, shutdownMessage, http.StatusServiceUnavailable)
+			case caller.clientGone(failure.Err):
+				outcome, detail = outcomeClientCancelled, clientCancelled
+			case errors.As(failure.Err, &exceeded):
+				outcome, detail = outcomeRateLimited, "was rate limited"
+				sendRateLimited(w, exceeded)
+			case failure.Verdict.Action == retry.ActionReturnPartial && len(attempts) > 0:
+				util.Error(r.Context(), "Non-stream request gave up, returning the partial response", "status", failure.StatusCode, "event", failure.Event.String())
+				outcome, detail = outcomePartial, "returned partial on "+failure.Event.String()
+				writeNonStreamResponse(w, attempts, nil)
+			case caller.deadlineExceeded():
+				outcome, detail = outcomeDeadline, "exceeded its deadline"
+				util.SendJSONError(w, "Request deadline exceeded", http.StatusGatewayTimeout)
+			case failure.StatusCode == 0:
+				util.SendJSONError(w, fmt.Sprintf("Upstream request failed: %v", failure.Err), http.StatusBadGateway)
+			default:
+				// Forward the upstream error to the client
+				util.Error(r.Context(), "Non-stream request failed", "status", failure.StatusCode, "event", failure.Event.String())
+				outcome, detail = outcomeFailed, "failed with "+failure.Event.String()
+				if failure.Verdict.Exhausted {
+					outcome, detail = outcomeExhausted, "ran out of its "+failure.Verdict.Budget+" budget on "+failure.Event.String()
+				}
+				forwardFailure(w, failure)
+			}
 			return
 		}
-		defer upstreamResp.Body.Close()
 
-		// 3. Read the response body
+		// 3. Read the response body, releasing the connection of this attempt right away
 		respBodyBytes, err := io.ReadAll(upstreamResp.Body)
+		upstreamResp.Body.Close()
 		if err != nil {
-			util.SendJSONError(w, "Failed to read upstream response body", http.StatusBadGateway)
-			return
-		}
-
-		// 4. Check the status and process the response
-		if upstreamResp.StatusCode != http.StatusOK {
-			// Check for retryable status codes
-			isRetryable := false
-			for _, code := range gemini.RetryableStatus {
-				if upstreamResp.StatusCode == code {
-					isRetryable = true
-					break
-				}
+			caller.endAttempt(nil, err)
+			if caller.shutDown() {
+				outcome, detail = outcomeShutdown, "was interrupted by shutdown"
+				util.SendJSONError(w, shutdownMessage, http.StatusServiceUnavailable)
+				return
 			}
-			if isRetryable {
-				util.Debugf("Received retryable status %d, retrying...", upstreamResp.StatusCode)
-				continue // Go to the next attempt
+			if caller.clientGone(err) {
+				outcome, detail = outcomeClientCancelled, clientCancelled
+				return
 			}
-
-			// For non-retryable errors, forward the response to the client
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(upstreamResp.StatusCode)
-			w.Write(respBodyBytes)
+			if caller.deadlineExceeded() {
+				outcome, detail = outcomeDeadline, "exceeded its deadline"
+				util.SendJSONError(w, "Request deadline exceeded", http.StatusGatewayTimeout)
+				return
+			}
+			util.SendJSONError(w, "Failed to read upstream response body", http.StatusBadGateway)
 			return
 		}
 
-		// 5. Process the successful response
-		result, err := proxy.ProcessNonStream(respBodyBytes)
+		// 4. Process the successful response
+		result, err := proxy.ProcessNonStream(r.Context(), respBodyBytes)
+		caller.endAttempt(result, err)
 		if err != nil {
 			if pErr, ok := err.(*proxy.ProxyError); ok {
 				util.SendJSONError(w, pErr.Message, pErr.StatusCode)
@@ -89,20 +116,64 @@ func HandleNonStream(w http.ResponseWriter, r *http.Request, initialReq *gemini.
 			return
 		}
 
-		if result.IsComplete || result.HasFunctionCall {
-			util.Debugf("Non-stream response is complete or has function call. Finishing.")
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusOK)
-			w.Write([]byte(result.FinalResponseJSON))
+		attempts = append(attempts, result.Response)
+		accumulatedParts = proxy.AppendModelParts(accumulatedParts, result.AccumulatedParts)
+
+		if result.Decision == proxy.DecisionRetry || result.Decision == proxy.DecisionMaxTokens {
+			finishTokenMissing.Inc(model, modeNonStream)
+		}
+		if result.Decision == proxy.DecisionComplete {
+			util.Debug(r.Context(), "Non-stream response is complete or has function call. Finishing.", "attempt", len(attempts))
+			outcome, detail = outcomeComplete, "completed"
+			writeNonStreamResponse(w, attempts, result)
 			return // Success
 		}
 
-		// 6. If not complete, prepare for retry
-		util.Debugf("Response incomplete, preparing for retry...")
-		currentReq = proxy.BuildRetryRequest(initialReq, result.AccumulatedText)
+		// 5. Ask the policy what to do with an incomplete answer
+		verdict := caller.decideOutcome(result.Decision.String())
+		switch verdict.Action {
+		case retry.ActionRetry:
+			// Prepare for a continuation with everything generated so far
+			util.Debug(r.Context(), "Response incomplete, preparing for retry", "attempt", len(attempts), "finish_reason", result.FinishReason)
+			currentReq = proxy.BuildRetryRequestWithParts(initialReq, accumulatedParts)
+		case retry.ActionReturnPartial:
+			// Terminal stops, errors and blocked prompts cannot be fixed by a continuation, so the client gets what the upstream returned.
+			if result.Decision == proxy.DecisionBlocked {
+				util.Error(r.Context(), "Non-stream prompt blocked, not retrying", "attempt", len(attempts), "block_reason", result.BlockReason)
+			} else {
+				util.Error(r.Context(), "Non-stream response stopped, not retrying", "attempt", len(attempts), "finish_reason", result.FinishReason, "decision", result.Decision.String())
+			}
+			outcome, detail = decisionOutcome(result.Decision), "returned "+result.Decision.String()
+			writeNonStreamResponse(w, attempts, result)
+			return
+		default:
+			if verdict.Exhausted {
+				outcome, detail = outcomeExhausted, "ran out of its "+verdict.Budget+" budget"
+				util.SendJSONError(w, "Request failed after maximum retries", http.StatusGatewayTimeout)
+				return
+			}
+			util.Error(r.Context(), "Non-stream response incomplete, failing as configured", "attempt", len(attempts), "decision", result.Decision.String())
+			util.SendJSONError(w, fmt.Sprintf("Upstream response incomplete: %s", result.Decision), http.StatusBadGateway)
+			return
+		}
 	}
+}
 
-	// If the loop finishes, we've exceeded max retries
-	util.Errorf("Non-stream request failed after %d attempts", config.AppConfig.MaxRetries)
-	util.SendJSONError(w, "Request failed after maximum retries", http.StatusGatewayTimeout)
+// writeNonStreamResponse sends the final response: the cleaned response of the only attempt,
+// or the stitched attempts when continuations were needed.
+func writeNonStreamResponse(w http.ResponseWriter, attempts []*gemini.GenerateContentResponse, last *proxy.StreamProcessingResult) {
+	var finalJSON []byte
+	if len(attempts) == 1 && last != nil {
+		finalJSON = []byte(last.FinalResponseJSON)
+	} else {
+		var err error
+		finalJSON, err = proxy.StitchResponses(attempts).MarshalJSON()
+		if err != nil {
+			util.SendJSONError(w, "Failed to construct stitched response", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(finalJSON)
 }
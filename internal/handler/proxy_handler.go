@@ -1,12 +1,20 @@
 package handler
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"gemini-anti-truncate-go/internal/config"
+	"gemini-anti-truncate-go/internal/auth"
+	"gemini-anti-truncate-go/internal/concurrency"
 	"gemini-anti-truncate-go/internal/gemini"
+	"gemini-anti-truncate-go/internal/keypool"
+	"gemini-anti-truncate-go/internal/lifecycle"
 	"gemini-anti-truncate-go/internal/proxy"
+	"gemini-anti-truncate-go/internal/ratelimit"
+	"gemini-anti-truncate-go/internal/retry"
+	"gemini-anti-truncate-go/internal/tracing"
+	"gemini-anti-truncate-go/internal/upstream"
 	"gemini-anti-truncate-go/internal/util"
 	"io"
 	"net/http"
@@ -30,7 +38,7 @@ func extractBaseModelName(modelPath string) string {
 // It validates the request, decides whether to apply anti-truncate logic,
 // and then dispatches to the appropriate stream or non-stream handler.
 func ProxyHandler(w http.ResponseWriter, r *http.Request) {
-	util.Debugf("Received request for: %s", r.URL.Path)
+	util.Debug(r.Context(), "Received request", "path", r.URL.Path, "client", auth.Name(r.Context()))
 
 	// 1. Basic request validation
 	if r.Method != http.MethodPost {
@@ -38,13 +46,16 @@ func ProxyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Clients without a key of their own are served from the default key pool, if there is one.
+	// With proxy authentication, the key is the client's access token and never goes upstream.
 	apiKey := util.GetAPIKey(r)
-	if apiKey == "" {
-		util.SendJSONError(w, "API key is missing. Please provide it in 'Authorization: Bearer <key>' or 'X-Goog-Api-Key: <key>' header.", http.StatusUnauthorized)
+	if apiKey == "" && !keypool.Current().HasDefault() {
+		util.SendJSONError(w, "API key is missing. Please provide it in 'Authorization: Bearer <key>' or 'X-Goog-Api-Key: <key>' header, or in the 'key' query parameter.", http.StatusUnauthorized)
 		return
 	}
 
-	// 2. Decode the request body
+	// 2. Decode the request body. The request keeps its raw JSON, so fields the proxy
+	// does not model are forwarded unchanged.
 	var req gemini.GenerateContentRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		util.SendJSONError(w, fmt.Sprintf("Invalid JSON in request body: %v", err), http.StatusBadRequest)
@@ -64,10 +75,30 @@ func ProxyHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	hasSchema := req.GenerationConfig != nil && req.GenerationConfig.ResponseSchema != nil
-	
+	tracing.SpanFromContext(r.Context()).SetAttributes(
+		tracing.String("gemini_proxy.client", auth.Name(r.Context())),
+		tracing.String("gemini_proxy.model", model))
+
+	// Wait for a free slot, so that only a bounded number of requests, with all their
+	// attempts, are in flight upstream at once
+	_, wait := tracing.Current().Start(r.Context(), "queue wait", tracing.KindInternal, tracing.String("gemini_proxy.model", model))
+	release, err := concurrency.Current().Acquire(r.Context(), model)
+	if err != nil {
+		wait.SetError(err.Error())
+	}
+	wait.End()
+	if err != nil {
+		if errors.Is(err, concurrency.ErrQueueFull) || errors.Is(err, concurrency.ErrQueueTimeout) {
+			util.Error(r.Context(), "Rejected request", "client", auth.Name(r.Context()), "model", model, "error", err)
+			util.SendJSONError(w, fmt.Sprintf("The proxy is overloaded: %v. Please retry later.", err), http.StatusServiceUnavailable)
+		}
+		return // Otherwise the client went away while waiting
+	}
+	defer release()
+
 	// Passthrough if not a target model or if it's a structured output request
 	if !isTargetModel || hasSchema {
-		util.Debugf("Passthrough request for model '%s' (isTarget: %t, hasSchema: %t)", model, isTargetModel, hasSchema)
+		util.Debug(r.Context(), "Passing request through", "model", model, "target_model", isTargetModel, "has_schema", hasSchema)
 		passthroughRequest(w, r, apiKey, &req)
 		return
 	}
@@ -76,46 +107,89 @@ func ProxyHandler(w http.ResponseWriter, r *http.Request) {
 	modifiedReq := proxy.InjectFinishToken(&req)
 
 	// 5. Dispatch to the appropriate handler
-	isStream := strings.Contains(r.URL.Path, ":streamGenerateContent")
+	isStream := upstream.IsStream(r.URL.Path)
 	if isStream {
-		util.Debugf("Dispatching to stream handler")
+		util.Debug(r.Context(), "Dispatching to stream handler", "model", model)
 		HandleStream(w, r, modifiedReq, apiKey)
 	} else {
-		util.Debugf("Dispatching to non-stream handler")
+		util.Debug(r.Context(), "Dispatching to non-stream handler", "model", model)
 		HandleNonStream(w, r, modifiedReq, apiKey)
 	}
 }
 
 // passthroughRequest forwards the request directly to the upstream without modification.
+// A decoded request marshals back to its original bytes, so nothing is lost on the way.
+// The upstream key is taken from the client's key pool, whose health is updated with the response.
+// The upstream request is canceled when the shutdown grace period is over: a request that has
+// not been answered yet gets a 503, and a response that has started ends where it is, as the
+// proxy does not know its format well enough to add an error event.
 func passthroughRequest(w http.ResponseWriter, r *http.Request, apiKey string, req *gemini.GenerateContentRequest) {
-	httpClient := &http.Client{}
-
-	reqBodyBytes, err := json.Marshal(req)
+	meter := newMeteredWriter(w)
+	w = meter
+	model := upstream.ModelFromPath(r.URL.Path)
+	outcome := outcomeFailed
+	defer func() {
+		meter.observe(modelLabel(model), modePassthrough, outcome)
+		tracing.SpanFromContext(r.Context()).SetAttributes(tracing.String("gemini_proxy.outcome", string(outcome)))
+	}()
+
+	keys := keysFor(r, apiKey)
+	upstreamKey, err := keys.Key()
 	if err != nil {
-		util.SendJSONError(w, "Failed to re-marshal request body for passthrough", http.StatusInternalServerError)
+		util.SendJSONError(w, "All upstream API keys are rate limited or disabled", http.StatusTooManyRequests)
 		return
 	}
 
-	upstreamURL := fmt.Sprintf("%s/%s", config.AppConfig.UpstreamURLBase, r.URL.Path)
-	upstreamReq, err := http.NewRequestWithContext(r.Context(), http.MethodPost, upstreamURL, bytes.NewBuffer(reqBodyBytes))
+	reqBodyBytes, err := req.MarshalJSON()
 	if err != nil {
-		util.SendJSONError(w, "Failed to create passthrough upstream request", http.StatusInternalServerError)
+		util.SendJSONError(w, "Failed to re-marshal request body for passthrough", http.StatusInternalServerError)
 		return
 	}
 
-	// Copy headers
-	upstreamReq.Header.Set("Content-Type", "application/json")
-	upstreamReq.Header.Set("X-Goog-Api-Key", apiKey)
-	if auth := r.Header.Get("Authorization"); auth != "" {
-		upstreamReq.Header.Set("Authorization", auth)
+	var exceeded *ratelimit.ExceededError
+	if err := admit(r, upstreamKey, model, reqBodyBytes); errors.As(err, &exceeded) {
+		outcome = outcomeRateLimited
+		sendRateLimited(w, exceeded)
+		return
 	}
 
-	upstreamResp, err := httpClient.Do(upstreamReq)
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	defer context.AfterFunc(lifecycle.Current().Context(), cancel)()
+
+	upstreamReq, err := upstream.NewRequest(r.WithContext(ctx), reqBodyBytes, upstreamKey)
+	if err != nil {
+		util.SendJSONError(w, "Failed to create passthrough upstream request", http.StatusInternalServerError)
+		return
+	}
+	spanCtx, span := tracing.Current().Start(r.Context(), "upstream attempt", tracing.KindClient,
+		tracing.Int("gemini_proxy.attempt", 1),
+		tracing.String("gemini_proxy.model", model),
+		tracing.String("gemini_proxy.key", keys.Label()))
+	defer span.End()
+	tracing.Inject(spanCtx, upstreamReq.Header)
+
+	upstreamResp, err := upstream.CurrentClient().Do(upstreamReq)
+	observeUpstream(model, upstreamResp)
 	if err != nil {
+		span.SetError(err.Error())
+		if r.Context().Err() == nil && lifecycle.Current().Stopped() {
+			outcome = outcomeShutdown
+			util.SendJSONError(w, shutdownMessage, http.StatusServiceUnavailable)
+			return
+		}
 		util.SendJSONError(w, fmt.Sprintf("Passthrough request failed: %v", err), http.StatusBadGateway)
 		return
 	}
 	defer upstreamResp.Body.Close()
+	span.SetAttributes(tracing.Int("http.response.status_code", upstreamResp.StatusCode))
+	if upstreamResp.StatusCode != http.StatusOK {
+		retryAfter, _ := retry.ServerDelay(upstreamResp.Header, nil)
+		keys.Report(upstreamResp.StatusCode, retryAfter)
+		span.SetError(upstreamResp.Status)
+	} else {
+		outcome = outcomeComplete
+	}
 
 	// Copy upstream response headers to the client
 	for key, values := range upstreamResp.Header {
@@ -127,6 +201,11 @@ func passthroughRequest(w http.ResponseWriter, r *http.Request, apiKey string, r
 
 	// Stream the response body directly to the client
 	if _, err := io.Copy(w, upstreamResp.Body); err != nil {
-		util.Errorf("Error streaming passthrough response: %v", err)
+		if r.Context().Err() != nil {
+			outcome = outcomeClientCancelled
+		} else if lifecycle.Current().Stopped() {
+			outcome = outcomeShutdown
+		}
+		util.Error(r.Context(), "Error streaming passthrough response", "model", model, "status", upstreamResp.StatusCode, "error", err)
 	}
 }
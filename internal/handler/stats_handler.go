@@ -0,0 +1,16 @@
+package handler
+
+import (
+	"encoding/json"
+	"gemini-anti-truncate-go/internal/concurrency"
+	"net/http"
+)
+
+// QueueStatsHandler reports the concurrency gates for monitoring: requests in flight, queue
+// depth, rejections and time spent waiting, for the global gate and each model gate.
+func QueueStatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Gates []concurrency.Stats `json:"gates"`
+	}{concurrency.Current().Stats()})
+}
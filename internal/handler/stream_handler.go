@@ -1,14 +1,17 @@
 package handler
 
 import (
-	"bytes"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"gemini-anti-truncate-go/internal/config"
 	"gemini-anti-truncate-go/internal/gemini"
 	"gemini-anti-truncate-go/internal/proxy"
+	"gemini-anti-truncate-go/internal/ratelimit"
+	"gemini-anti-truncate-go/internal/retry"
+	"gemini-anti-truncate-go/internal/upstream"
 	"gemini-anti-truncate-go/internal/util"
 	"net/http"
+	"strconv"
 )
 
 // headerSuppressingWriter is a wrapper around http.ResponseWriter that suppresses
@@ -45,103 +48,256 @@ func (hsw *headerSuppressingWriter) WriteHeader(statusCode int) {
 	hsw.ResponseWriter.WriteHeader(statusCode)
 }
 
-// Flush ensures that the underlying writer is flushed if it implements http.Flusher.
-func (hsw *headerSuppressingWriter) Flush() {
-	if flusher, ok := hsw.ResponseWriter.(http.Flusher); ok {
-		flusher.Flush()
+// Unwrap returns the wrapped ResponseWriter, so that http.ResponseController can flush it.
+func (hsw *headerSuppressingWriter) Unwrap() http.ResponseWriter {
+	return hsw.ResponseWriter
+}
+
+// streamErrorsHeader is the request header with which a client opts into a terminal error
+// chunk at the end of a failed stream, like the upstream.StreamErrorsParam query parameter.
+const streamErrorsHeader = "X-Proxy-Stream-Errors"
+
+// streamErrorsRequested reports whether the client opted into terminal error chunks.
+func streamErrorsRequested(r *http.Request) bool {
+	value := r.Header.Get(streamErrorsHeader)
+	if value == "" {
+		value = r.URL.Query().Get(upstream.StreamErrorsParam)
+	}
+	enabled, _ := strconv.ParseBool(value)
+	return enabled
+}
+
+// shutdownMessage tells clients why their request ended early when the server shut down.
+const shutdownMessage = "The proxy is shutting down. Please retry."
+
+// endForShutdown ends a stream that is still running when the shutdown grace period is over:
+// with a 503 error if it has not started yet, or otherwise with a terminal error chunk, sent
+// whether or not the client opted into error chunks, so that the response ends cleanly.
+func endForShutdown(w http.ResponseWriter, started bool, sw *proxy.StreamWriter) {
+	if started {
+		sw.WriteError(http.StatusServiceUnavailable, shutdownMessage, nil)
+	} else {
+		util.SendJSONError(w, shutdownMessage, http.StatusServiceUnavailable)
 	}
 }
 
 // HandleStream manages streaming requests, including the retry logic for truncated streams.
+// Upstream errors and incomplete answers are handled as the retry policy says. Clients that opt in
+// through X-Proxy-Stream-Errors or proxy_stream_errors receive a final error chunk when the stream fails.
+// Streams still running at the end of the shutdown grace period are ended with an error chunk.
+// When the client goes away, the upstream stream is abandoned and no further attempt is made.
 func HandleStream(w http.ResponseWriter, r *http.Request, initialReq *gemini.GenerateContentRequest, apiKey string) {
+	meter := newMeteredWriter(w)
+	w = meter
+	model := modelLabel(upstream.ModelFromPath(r.URL.Path))
+
 	currentReq := initialReq
-	httpClient := &http.Client{}
-	var accumulatedText string
+	caller := newUpstreamCaller(r, apiKey)
+	defer caller.close()
+	var accumulatedParts []gemini.Part
+	attempts := 0
+
+	// The outcome labels the metrics and the trace; the detail describes it in the log.
+	outcome, detail := outcomeFailed, "failed"
+	defer func() {
+		caller.logOutcome(modeStream, outcome, detail)
+		meter.observe(model, modeStream, outcome)
+		caller.traceOutcome(outcome)
+		continuationsPerRequest.Observe(float64(caller.session.Used(retry.BudgetContinuation)), model, modeStream)
+	}()
 
 	// Wrap the original response writer to handle headers correctly across multiple retries.
 	wrappedWriter := &headerSuppressingWriter{ResponseWriter: w}
 
-	for i := 0; i < config.AppConfig.MaxRetries; i++ {
-		util.Debugf("Stream attempt %d/%d", i+1, config.AppConfig.MaxRetries)
+	// The stream writer spans all attempts, so the client receives a single SSE stream or
+	// JSON array in the format it asked for, whatever the upstream attempts return.
+	streamWriter, err := proxy.NewStreamWriter(wrappedWriter, proxy.RequestedStreamFormat(r))
+	if err != nil {
+		util.SendJSONError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer streamWriter.Close()
 
-		reqBodyBytes, err := json.Marshal(currentReq)
+	// Once the stream has started, errors can only be reported in-stream, and only to clients
+	// that opted in; the others see a stream that simply stops, as before.
+	streamErrors := streamErrorsRequested(r)
+	failStream := func(code int, message string, upstreamBody []byte) {
+		if streamErrors && r.Context().Err() == nil {
+			streamWriter.WriteError(code, message, upstreamBody)
+		}
+	}
+
+	for {
+		util.Debug(r.Context(), "Sending stream attempt", "attempt", attempts+1)
+
+		reqBodyBytes, err := currentReq.MarshalJSON()
 		if err != nil {
 			// Cannot send JSON error if stream has started, so just log and exit.
 			if !wrappedWriter.headersSent {
 				util.SendJSONError(w, "Failed to marshal request body", http.StatusInternalServerError)
 			}
-			util.Errorf("Failed to marshal request body: %v", err)
+			util.Error(r.Context(), "Failed to marshal request body", "error", err)
 			return
 		}
 
-		upstreamURL := fmt.Sprintf("%s/%s", config.AppConfig.UpstreamURLBase, r.URL.Path)
-		upstreamReq, err := http.NewRequestWithContext(r.Context(), http.MethodPost, upstreamURL, bytes.NewBuffer(reqBodyBytes))
-		if err != nil {
-			if !wrappedWriter.headersSent {
-				util.SendJSONError(w, "Failed to create upstream request", http.StatusInternalServerError)
-			}
-			util.Errorf("Failed to create upstream request: %v", err)
+		upstreamResp, failure := caller.send(reqBodyBytes)
+		if failure != nil && caller.shutDown() {
+			outcome, detail = outcomeShutdown, "was interrupted by shutdown"
+			endForShutdown(w, wrappedWriter.headersSent, streamWriter)
 			return
 		}
-
-		upstreamReq.Header.Set("Content-Type", "application/json")
-		upstreamReq.Header.Set("X-Goog-Api-Key", apiKey)
-		if auth := r.Header.Get("Authorization"); auth != "" {
-			upstreamReq.Header.Set("Authorization", auth)
+		if failure != nil && caller.clientGone(failure.Err) {
+			// There is nobody left to send the error to
+			outcome, detail = outcomeClientCancelled, clientCancelled
+			return
 		}
-
-		upstreamResp, err := httpClient.Do(upstreamReq)
-		if err != nil {
-			if !wrappedWriter.headersSent {
-				util.SendJSONError(w, fmt.Sprintf("Upstream request failed: %v", err), http.StatusBadGateway)
-			}
-			util.Errorf("Upstream request failed: %v", err)
+		if failure != nil && failure.Verdict.Action == retry.ActionReturnPartial && attempts > 0 {
+			// The text received so far has already been forwarded, so the stream simply ends
+			util.Error(r.Context(), "Stream request gave up, returning the partial response", "status", failure.StatusCode, "event", failure.Event.String())
+			outcome, detail = outcomePartial, "returned partial on "+failure.Event.String()
 			return
 		}
-		defer upstreamResp.Body.Close()
-
-		if upstreamResp.StatusCode != http.StatusOK {
-			// Handle retryable status codes
-			isRetryable := false
-			for _, code := range gemini.RetryableStatus {
-				if upstreamResp.StatusCode == code {
-					isRetryable = true
-					break
-				}
-			}
-			if isRetryable {
-				util.Debugf("Received retryable status %d, retrying stream...", upstreamResp.StatusCode)
-				continue // Go to the next attempt
-			}
-			
-			// For non-retryable errors, forward if possible
-			if !wrappedWriter.headersSent {
-				util.SendJSONError(w, "Upstream returned non-200 status", upstreamResp.StatusCode)
+		if failure != nil {
+			outcome, detail = outcomeFailed, "failed with "+failure.Event.String()
+			if failure.Verdict.Exhausted {
+				outcome, detail = outcomeExhausted, "ran out of its "+failure.Verdict.Budget+" budget on "+failure.Event.String()
 			}
-			util.Errorf("Upstream returned non-200 status: %d", upstreamResp.StatusCode)
+			if caller.deadlineExceeded() {
+				outcome, detail = outcomeDeadline, "exceeded its deadline"
+			}
+
+			var exceeded *ratelimit.ExceededError
+			if errors.As(failure.Err, &exceeded) {
+				outcome, detail = outcomeRateLimited, "was rate limited"
+			}
+
+			// Forward the error if the stream has not started yet, or end the stream with it
+			switch {
+			case !wrappedWriter.headersSent && exceeded != nil:
+				sendRateLimited(w, exceeded)
+			case !wrappedWriter.headersSent && caller.deadlineExceeded():
+				util.SendJSONError(w, "Request deadline exceeded", http.StatusGatewayTimeout)
+			case !wrappedWriter.headersSent && failure.StatusCode == 0:
+				util.SendJSONError(w, fmt.Sprintf("Upstream request failed: %v", failure.Err), http.StatusBadGateway)
+			case !wrappedWriter.headersSent:
+				forwardFailure(w, failure)
+			case exceeded != nil:
+				failStream(http.StatusTooManyRequests, exceeded.Error(), nil)
+			case caller.deadlineExceeded():
+				failStream(http.StatusGatewayTimeout, "Request deadline exceeded", nil)
+			case failure.StatusCode == 0:
+				failStream(http.StatusBadGateway, fmt.Sprintf("Upstream request failed: %v", failure.Err), nil)
+			default:
+				failStream(failure.StatusCode, "Upstream returned non-200 status", failure.Body)
+			}
+			util.Error(r.Context(), "Stream request failed", "status", failure.StatusCode, "event", failure.Event.String(), "action", failure.Verdict.Action)
 			return
 		}
 
-		// Process the stream. The wrappedWriter ensures headers are only sent once.
-		result, err := proxy.ProcessStream(wrappedWriter, upstreamResp)
+		// Process the stream. The wrappedWriter ensures headers are only sent once. The body is
+		// closed as soon as the attempt ends, so that a continuation does not hold two connections.
+		// A stalled stream is aborted and continued like a truncated one, unless it stalled before
+		// its first chunk: then there is nothing to continue from and the request is resent.
+		attempts++
+		upstreamResp.Body = proxy.WatchStall(upstreamResp.Body, proxy.StallTimeouts{
+			FirstChunk: config.AppConfig.StreamFirstChunkTimeout,
+			Idle:       config.AppConfig.StreamChunkTimeout,
+		})
+		result, err := proxy.ProcessStreamTo(streamWriter, upstreamResp)
+		upstreamResp.Body.Close()
+		caller.endAttempt(result, err)
 		if err != nil {
-			util.Errorf("Error processing stream: %v", err)
-			return // The connection is likely broken
+			if caller.shutDown() {
+				outcome, detail = outcomeShutdown, "was interrupted by shutdown"
+				endForShutdown(w, wrappedWriter.headersSent, streamWriter)
+				return
+			}
+			if caller.clientGone(err) {
+				// Neither the rest of this attempt nor a continuation can reach the client
+				outcome, detail = outcomeClientCancelled, clientCancelled
+				return
+			}
+			if caller.deadlineExceeded() {
+				outcome, detail = outcomeDeadline, "exceeded its deadline"
+				failStream(http.StatusGatewayTimeout, "Request deadline exceeded", nil)
+				return
+			}
+			util.Error(r.Context(), "Error processing stream", "attempt", attempts, "error", err)
+			failStream(http.StatusBadGateway, fmt.Sprintf("Upstream stream interrupted: %v", err), nil)
+			return // The upstream connection is likely broken
 		}
 
-		// Append the text from this chunk to the total accumulated text
-		accumulatedText += result.AccumulatedText
+		// Append the output of this attempt, including non-text parts, to the accumulated model turn
+		accumulatedParts = proxy.AppendModelParts(accumulatedParts, result.AccumulatedParts)
 
-		if result.IsComplete || result.HasFunctionCall {
-			util.Debugf("Stream is complete or has function call. Finishing.")
+		if result.Stalled {
+			streamStalls.Inc(model)
+		}
+		if result.Chunks == 0 {
+			// Nothing arrived to continue from, so the same request is resent as after an upstream error
+			verdict := caller.decideEmptyAttempt()
+			if verdict.Action == retry.ActionRetry {
+				util.Debug(r.Context(), "Stream ended before its first chunk, resending the request", "attempt", attempts, "stalled", result.Stalled)
+				continue
+			}
+			if caller.shutDown() {
+				outcome, detail = outcomeShutdown, "was interrupted by shutdown"
+				endForShutdown(w, wrappedWriter.headersSent, streamWriter)
+				return
+			}
+			if caller.clientGone(nil) {
+				outcome, detail = outcomeClientCancelled, clientCancelled
+				return
+			}
+			outcome, detail = outcomeFailed, "failed on an empty stream"
+			code, message := http.StatusBadGateway, "Upstream stream ended before its first chunk"
+			if verdict.Exhausted {
+				outcome, detail = outcomeExhausted, "ran out of its "+verdict.Budget+" budget on an empty stream"
+			}
+			if caller.deadlineExceeded() {
+				outcome, detail = outcomeDeadline, "exceeded its deadline"
+				code, message = http.StatusGatewayTimeout, "Request deadline exceeded"
+			}
+			util.Error(r.Context(), "Stream ended before its first chunk, not retrying", "attempt", attempts, "stalled", result.Stalled, "action", verdict.Action)
+			if wrappedWriter.headersSent {
+				failStream(code, message, nil)
+			} else {
+				util.SendJSONError(w, message, code)
+			}
+			return
+		}
+		if result.Decision == proxy.DecisionRetry || result.Decision == proxy.DecisionMaxTokens {
+			finishTokenMissing.Inc(model, modeStream)
+		}
+		if result.Decision == proxy.DecisionComplete {
+			util.Debug(r.Context(), "Stream is complete or has function call. Finishing.", "attempt", attempts)
+			outcome, detail = outcomeComplete, "completed"
 			return // Success
 		}
 
-		util.Debugf("Stream incomplete, preparing for retry...")
-		currentReq = proxy.BuildRetryRequest(initialReq, accumulatedText)
+		verdict := caller.decideOutcome(result.Decision.String())
+		switch verdict.Action {
+		case retry.ActionRetry:
+			util.Debug(r.Context(), "Stream incomplete, preparing for retry", "attempt", attempts, "finish_reason", result.FinishReason)
+			currentReq = proxy.BuildRetryRequestWithParts(initialReq, accumulatedParts)
+		case retry.ActionReturnPartial:
+			// The chunks, including the finish reason or the promptFeedback, have already been forwarded.
+			if result.Decision == proxy.DecisionBlocked {
+				util.Error(r.Context(), "Stream prompt blocked, not retrying", "attempt", attempts, "block_reason", result.BlockReason)
+			} else {
+				util.Error(r.Context(), "Stream stopped, not retrying", "attempt", attempts, "finish_reason", result.FinishReason, "decision", result.Decision.String())
+			}
+			outcome, detail = decisionOutcome(result.Decision), "returned "+result.Decision.String()
+			return
+		default:
+			outcome, detail = outcomeFailed, "failed on "+result.Decision.String()
+			if verdict.Exhausted {
+				outcome, detail = outcomeExhausted, "ran out of its "+verdict.Budget+" budget"
+				failStream(http.StatusGatewayTimeout, "Request failed after maximum retries", nil)
+				return
+			}
+			failStream(http.StatusBadGateway, fmt.Sprintf("Upstream response incomplete: %s", result.Decision), nil)
+			return
+		}
 	}
-
-	util.Errorf("Stream request failed after %d attempts", config.AppConfig.MaxRetries)
-	// We cannot send a final error message as the stream is already in progress.
-	// The client will experience this as a stream that simply stops.
 }
@@ -0,0 +1,415 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gemini-anti-truncate-go/internal/auth"
+	"gemini-anti-truncate-go/internal/config"
+	"gemini-anti-truncate-go/internal/gemini"
+	"gemini-anti-truncate-go/internal/keypool"
+	"gemini-anti-truncate-go/internal/lifecycle"
+	"gemini-anti-truncate-go/internal/proxy"
+	"gemini-anti-truncate-go/internal/ratelimit"
+	"gemini-anti-truncate-go/internal/retry"
+	"gemini-anti-truncate-go/internal/tracing"
+	"gemini-anti-truncate-go/internal/upstream"
+	"gemini-anti-truncate-go/internal/util"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// upstreamCaller sends the attempts of a single client request to the upstream and applies
+// the retry policy to upstream errors. It is shared by the stream and non-stream handlers,
+// which only differ in how they process a successful response. All attempts share the
+// request deadline, which is enforced through the context of r.
+type upstreamCaller struct {
+	r            *http.Request
+	clientCtx    context.Context // The context of the client request, canceled when the client goes away
+	cancel       context.CancelFunc
+	stopShutdown func() bool // Unregisters the cancellation at the end of the shutdown grace period
+	start        time.Time
+	keys         *keypool.Selector
+	client       *http.Client
+	session      *retry.Session
+	backoff      *retry.Backoff
+	model        string
+	errorRetries int
+
+	attempts   int           // Upstream requests sent, retries included
+	attempt    *tracing.Span // The span of the attempt whose response is being processed
+	textLength int           // Text generated by all processed attempts
+}
+
+// upstreamFailure describes an upstream error the policy gave up on.
+type upstreamFailure struct {
+	Event       retry.Event
+	Verdict     retry.Verdict
+	StatusCode  int // Zero for transport errors
+	Body        []byte
+	ContentType string        // The Content-Type of Body
+	Err         error         // The transport error, if the request never got a response
+	RetryAfter  time.Duration // How long the upstream asked to wait, if that was too long to retry
+}
+
+// newUpstreamCaller creates the caller for a client request, using the current retry policy,
+// the key pool the client's key maps to and the configured request deadline. The request is
+// also canceled when the shutdown grace period is over. The caller must be closed when the
+// request is done.
+func newUpstreamCaller(r *http.Request, apiKey string) *upstreamCaller {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if deadline := config.AppConfig.RequestDeadline; deadline > 0 {
+		ctx, cancel = context.WithTimeout(r.Context(), deadline)
+	} else {
+		ctx, cancel = context.WithCancel(r.Context())
+	}
+	return &upstreamCaller{
+		r:            r.WithContext(ctx),
+		clientCtx:    r.Context(),
+		cancel:       cancel,
+		stopShutdown: context.AfterFunc(lifecycle.Current().Context(), cancel),
+		start:        time.Now(),
+		keys:         keysFor(r, apiKey),
+		client:       upstream.CurrentClient(),
+		session:      retry.CurrentPolicy().NewSession(),
+		backoff:      retry.NewBackoff(),
+		model:        upstream.ModelFromPath(r.URL.Path),
+	}
+}
+
+// keysFor returns the upstream keys for a client request: the key pool of the authenticated
+// client, or what the client's own key maps to when proxy authentication is disabled.
+func keysFor(r *http.Request, apiKey string) *keypool.Selector {
+	if client := auth.FromContext(r.Context()); client != nil {
+		return keypool.Current().ForPool(client.Pool)
+	}
+	return keypool.Current().ForClient(apiKey)
+}
+
+// admit checks an upstream attempt against the rate limits of its client, key and model.
+func admit(r *http.Request, apiKey, model string, body []byte) error {
+	req := ratelimit.Request{Key: apiKey, Model: model, Tokens: ratelimit.EstimateTokens(body)}
+	if client := auth.FromContext(r.Context()); client != nil {
+		req.Client = client.ID
+		req.ClientLimit = ratelimit.Limit{RequestsPerMinute: client.RequestsPerMinute, TokensPerMinute: client.TokensPerMinute}
+	}
+	return ratelimit.Current().Allow(req)
+}
+
+// sendRateLimited rejects a request that exceeded a rate limit with a 429 RESOURCE_EXHAUSTED
+// error, telling the client when to try again.
+func sendRateLimited(w http.ResponseWriter, err *ratelimit.ExceededError) {
+	setRetryAfter(w, err.RetryAfter)
+	util.SendJSONError(w, err.Error(), http.StatusTooManyRequests)
+}
+
+// forwardFailure sends the upstream's error response to a client whose response has not started,
+// so that it sees the actual Gemini error, along with how long to wait if that was too long to retry.
+func forwardFailure(w http.ResponseWriter, failure *upstreamFailure) {
+	if failure.RetryAfter > 0 {
+		setRetryAfter(w, failure.RetryAfter)
+	}
+	if len(failure.Body) == 0 {
+		util.SendJSONError(w, "Upstream returned non-200 status", failure.StatusCode)
+		return
+	}
+	contentType := failure.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(failure.StatusCode)
+	w.Write(failure.Body)
+}
+
+// setRetryAfter tells the client how long to wait before trying again, in whole seconds.
+func setRetryAfter(w http.ResponseWriter, delay time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(max(delay.Seconds(), 1)))))
+}
+
+// send posts the request body upstream until it gets a 200 response or the policy gives up.
+// Retries are delayed by the backoff; key and model switches are applied before the next try.
+// With a key pool, every retry moves to another key, and a rate-limited key is replaced without
+// waiting. When the pool has no usable key left, the request fails with a 429. Every attempt,
+// retries included, counts against the rate limits.
+func (uc *upstreamCaller) send(body []byte) (*http.Response, *upstreamFailure) {
+	for {
+		apiKey, err := uc.keys.Key()
+		if err != nil {
+			util.Error(uc.r.Context(), "Upstream request not sent", "model", uc.model, "error", err)
+			return nil, noKeyFailure()
+		}
+
+		if err := admit(uc.r, apiKey, uc.model, body); err != nil {
+			var exceeded *ratelimit.ExceededError
+			// Another key of the pool may still have room
+			if errors.As(err, &exceeded) && exceeded.Scope == ratelimit.ScopeKey && uc.keys.Next() {
+				continue
+			}
+			util.Error(uc.r.Context(), "Upstream request not sent", "client", auth.Name(uc.r.Context()), "model", uc.model, "error", err)
+			return nil, &upstreamFailure{
+				Verdict:    retry.Verdict{Action: retry.ActionFail},
+				StatusCode: http.StatusTooManyRequests,
+				Err:        err,
+			}
+		}
+
+		upstreamReq, err := upstream.NewRequest(upstream.WithModel(uc.r, uc.model), body, apiKey)
+		if err != nil {
+			return nil, &upstreamFailure{Verdict: retry.Verdict{Action: retry.ActionFail}, Err: err}
+		}
+		span := uc.startAttempt(upstreamReq)
+
+		var failure *upstreamFailure
+		var header http.Header
+		upstreamResp, err := uc.client.Do(upstreamReq)
+		observeUpstream(uc.model, upstreamResp)
+		switch {
+		case err != nil:
+			failure = &upstreamFailure{Event: retry.TransportEvent(), Err: err}
+			span.SetError(err.Error())
+			span.End()
+		case upstreamResp.StatusCode == http.StatusOK:
+			// The span ends once the handler has processed the response, see endAttempt
+			span.SetAttributes(tracing.Int("http.response.status_code", upstreamResp.StatusCode))
+			uc.attempt = span
+			return upstreamResp, nil
+		default:
+			respBodyBytes, _ := io.ReadAll(upstreamResp.Body)
+			upstreamResp.Body.Close()
+			header = upstreamResp.Header
+			failure = &upstreamFailure{
+				Event:       retry.StatusEvent(upstreamResp.StatusCode, respBodyBytes),
+				StatusCode:  upstreamResp.StatusCode,
+				Body:        respBodyBytes,
+				ContentType: upstreamResp.Header.Get("Content-Type"),
+			}
+			retryAfter, _ := retry.ServerDelay(header, respBodyBytes)
+			uc.keys.Report(upstreamResp.StatusCode, retryAfter)
+			span.SetAttributes(tracing.Int("http.response.status_code", upstreamResp.StatusCode))
+			span.SetError(failure.Event.String())
+			span.End()
+		}
+
+		// A client that went away cannot be served by another attempt.
+		if ctxErr := uc.r.Context().Err(); ctxErr != nil {
+			failure.Verdict = retry.Verdict{Action: retry.ActionFail}
+			failure.Err = ctxErr
+			return nil, failure
+		}
+
+		failure.Verdict = uc.session.Decide(failure.Event)
+		util.Debug(uc.r.Context(), "Retry policy decided on an upstream error", "attempt", uc.attempts, "status", failure.StatusCode, "event", failure.Event.String(),
+			"action", failure.Verdict.Action, "rule", failure.Verdict.Rule, "exhausted", failure.Verdict.Exhausted)
+
+		action := uc.resolve(failure.Verdict)
+		if action != retry.ActionRetry {
+			failure.Verdict.Action = action
+			return nil, failure
+		}
+
+		if failure.Verdict.Action == retry.ActionRetry {
+			// Move on to another key of the pool. A rate limit applies to the key, so after
+			// a 429 the fresh key can be used right away.
+			if uc.keys.Next() {
+				util.Debug(uc.r.Context(), "Retrying with another key", "event", failure.Event.String(), "key", uc.keys.Label())
+				if failure.StatusCode == http.StatusTooManyRequests {
+					continue
+				}
+			} else if _, err := uc.keys.Key(); err != nil {
+				return nil, noKeyFailure()
+			}
+
+			// The error body may say how long to wait (google.rpc.RetryInfo).
+			delay, ok := uc.backoff.Next(uc.errorRetries, header, failure.Body, uc.remaining())
+			if !ok {
+				util.Error(uc.r.Context(), "Upstream asked to wait longer than the backoff cap or the deadline allow, not retrying",
+					"attempt", uc.attempts, "status", failure.StatusCode, "delay", delay)
+				failure.Verdict.Action = retry.ActionFail
+				failure.RetryAfter = delay
+				return nil, failure
+			}
+			uc.errorRetries++
+			util.Debug(uc.r.Context(), "Retrying after backoff", "attempt", uc.attempts, "event", failure.Event.String(), "delay", delay)
+			if err := retry.Sleep(uc.r.Context(), delay); err != nil {
+				failure.Verdict.Action = retry.ActionFail
+				failure.Err = err
+				return nil, failure
+			}
+		}
+	}
+}
+
+// noKeyFailure describes a request that could not be sent because every key of its pool is
+// rate limited, disabled or already tried, in the format of an upstream error.
+func noKeyFailure() *upstreamFailure {
+	body := []byte(fmt.Sprintf(`{"error":{"code":%d,"message":"All upstream API keys are rate limited or disabled","status":"%s"}}`,
+		http.StatusTooManyRequests, gemini.StatusName(http.StatusTooManyRequests)))
+	return &upstreamFailure{
+		Event:      retry.StatusEvent(http.StatusTooManyRequests, body),
+		Verdict:    retry.Verdict{Action: retry.ActionFail},
+		StatusCode: http.StatusTooManyRequests,
+		Body:       body,
+		Err:        keypool.ErrNoKey,
+	}
+}
+
+// startAttempt starts the span of an upstream attempt and propagates it to the upstream in the
+// traceparent header.
+func (uc *upstreamCaller) startAttempt(upstreamReq *http.Request) *tracing.Span {
+	uc.attempts++
+	ctx, span := tracing.Current().Start(uc.r.Context(), "upstream attempt", tracing.KindClient,
+		tracing.Int("gemini_proxy.attempt", uc.attempts),
+		tracing.String("gemini_proxy.model", uc.model),
+		tracing.String("gemini_proxy.key", uc.keys.Label()))
+	tracing.Inject(ctx, upstreamReq.Header)
+	return span
+}
+
+// endAttempt ends the span of the attempt whose response was processed, recording the text it
+// generated, the text accumulated over all attempts and the completion decision.
+func (uc *upstreamCaller) endAttempt(result *proxy.StreamProcessingResult, err error) {
+	span := uc.attempt
+	uc.attempt = nil
+	if err != nil {
+		span.SetError(err.Error())
+	}
+	if result != nil {
+		uc.textLength += len(result.AccumulatedText)
+		span.SetAttributes(
+			tracing.Int("gemini_proxy.text_length", len(result.AccumulatedText)),
+			tracing.Int("gemini_proxy.accumulated_text_length", uc.textLength),
+			tracing.String("gemini_proxy.decision", result.Decision.String()),
+			tracing.String("gemini_proxy.finish_reason", result.FinishReason))
+		if result.Stalled {
+			span.SetAttributes(tracing.Bool("gemini_proxy.stalled", true))
+		}
+	}
+	span.End()
+}
+
+// traceOutcome records the outcome of the request and the budgets it used on the request's span.
+func (uc *upstreamCaller) traceOutcome(outcome outcome) {
+	tracing.SpanFromContext(uc.r.Context()).SetAttributes(
+		tracing.String("gemini_proxy.outcome", string(outcome)),
+		tracing.String("gemini_proxy.model", uc.model),
+		tracing.Int("gemini_proxy.attempts", uc.attempts),
+		tracing.Int("gemini_proxy.error_retries", uc.session.Used(retry.BudgetRetry)),
+		tracing.Int("gemini_proxy.continuations", uc.session.Used(retry.BudgetContinuation)),
+		tracing.Int("gemini_proxy.accumulated_text_length", uc.textLength))
+}
+
+// close releases the deadline of the request and ends the span of an attempt whose response
+// was not processed.
+func (uc *upstreamCaller) close() {
+	uc.attempt.End()
+	uc.stopShutdown()
+	uc.cancel()
+}
+
+// remaining returns the time left before the request deadline, or zero if there is none.
+func (uc *upstreamCaller) remaining() time.Duration {
+	deadline, ok := uc.r.Context().Deadline()
+	if !ok {
+		return 0
+	}
+	return max(time.Until(deadline), time.Nanosecond)
+}
+
+// deadlineExceeded reports whether the request deadline has passed.
+func (uc *upstreamCaller) deadlineExceeded() bool {
+	return uc.r.Context().Err() == context.DeadlineExceeded
+}
+
+// shutDown reports whether the request was canceled because the shutdown grace period is over.
+func (uc *upstreamCaller) shutDown() bool {
+	return uc.r.Context().Err() != nil && lifecycle.Current().Stopped()
+}
+
+// clientCancelled describes the outcome of a request whose client went away before it was answered.
+const clientCancelled = "was cancelled by the client"
+
+// clientGone reports whether the client went away: its connection was closed, or a write to it
+// failed. No attempt is worth making for it anymore.
+func (uc *upstreamCaller) clientGone(err error) bool {
+	return errors.Is(err, proxy.ErrClientDisconnected) || uc.clientCtx.Err() != nil
+}
+
+// logOutcome writes the final log line of the request: how it ended, the model and client, and
+// how much of each budget it used.
+func (uc *upstreamCaller) logOutcome(mode string, outcome outcome, detail string) {
+	util.Info(uc.r.Context(), "Request finished",
+		"mode", mode,
+		"outcome", outcome,
+		"detail", detail,
+		"model", uc.model,
+		"client", auth.Name(uc.r.Context()),
+		"attempts", uc.attempts,
+		"error_retries", uc.session.Used(retry.BudgetRetry),
+		"error_retry_budget", uc.session.Limit(retry.BudgetRetry),
+		"continuations", uc.session.Used(retry.BudgetContinuation),
+		"continuation_budget", uc.session.Limit(retry.BudgetContinuation),
+		"elapsed", time.Since(uc.start).Round(time.Millisecond),
+		"deadline", config.AppConfig.RequestDeadline)
+}
+
+// decideOutcome consults the policy about a response that did not complete the answer and
+// carries out any key or model switch. The returned action is ActionRetry if a continuation
+// should be requested, or the action that ends the request otherwise.
+func (uc *upstreamCaller) decideOutcome(outcome string) retry.Verdict {
+	verdict := uc.session.Decide(retry.OutcomeEvent(outcome))
+	util.Debug(uc.r.Context(), "Retry policy decided on an incomplete answer", "attempt", uc.attempts, "decision", outcome,
+		"action", verdict.Action, "rule", verdict.Rule, "exhausted", verdict.Exhausted)
+	verdict.Action = uc.resolve(verdict)
+	return verdict
+}
+
+// decideEmptyAttempt consults the policy about a stream that ended or stalled before its first
+// chunk. Nothing was received to continue from, so it is handled like a transport error: the
+// retry draws on the retry budget and waits for the backoff, and the caller resends the same
+// request. The returned action is ActionRetry if it should be resent.
+func (uc *upstreamCaller) decideEmptyAttempt() retry.Verdict {
+	verdict := uc.session.Decide(retry.TransportEvent())
+	util.Debug(uc.r.Context(), "Retry policy decided on an empty stream", "attempt", uc.attempts,
+		"action", verdict.Action, "rule", verdict.Rule, "exhausted", verdict.Exhausted)
+	verdict.Action = uc.resolve(verdict)
+	if verdict.Action != retry.ActionRetry {
+		return verdict
+	}
+
+	delay, _ := uc.backoff.Next(uc.errorRetries, nil, nil, uc.remaining())
+	uc.errorRetries++
+	util.Debug(uc.r.Context(), "Retrying after backoff", "attempt", uc.attempts, "event", "empty stream", "delay", delay)
+	if err := retry.Sleep(uc.r.Context(), delay); err != nil {
+		verdict.Action = retry.ActionFail
+	}
+	return verdict
+}
+
+// resolve carries out the key or model switch asked for by a verdict. It returns ActionRetry
+// if another attempt should be made, or the verdict's final action otherwise.
+func (uc *upstreamCaller) resolve(verdict retry.Verdict) retry.Action {
+	switch verdict.Action {
+	case retry.ActionSwitchKey:
+		if !uc.keys.Next() {
+			util.Error(uc.r.Context(), "Retry policy asked to switch API keys, but no other key is available")
+			return retry.ActionFail
+		}
+		util.Info(uc.r.Context(), "Switching API key", "key", uc.keys.Label())
+		return retry.ActionRetry
+	case retry.ActionSwitchModel:
+		next, ok := uc.session.NextModel(uc.model)
+		if !ok {
+			util.Error(uc.r.Context(), "Retry policy asked to switch models, but no fallback model is left", "model", uc.model)
+			return retry.ActionFail
+		}
+		util.Info(uc.r.Context(), "Switching model", "from", uc.model, "to", next)
+		uc.model = next
+		return retry.ActionRetry
+	}
+	return verdict.Action
+}
@@ -0,0 +1,372 @@
+package keypool
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gemini-anti-truncate-go/internal/config"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultPool is the pool used by clients that bring no key of their own.
+const DefaultPool = "default"
+
+// Selection strategies.
+const (
+	// StrategyRoundRobin hands out the healthy keys of a pool in turn.
+	StrategyRoundRobin = "round_robin"
+	// StrategyLeastRecentlyLimited prefers the healthy key whose last rate limit lies furthest back.
+	StrategyLeastRecentlyLimited = "least_recently_limited"
+)
+
+// ErrNoKey is returned when every key of a pool is quarantined, disabled or already tried.
+var ErrNoKey = errors.New("no upstream API key available")
+
+// key is a Gemini API key and its health.
+type key struct {
+	value            string
+	disabled         bool      // The key was rejected with a 403 and is not used again
+	quarantinedUntil time.Time // The key was rate limited and rests until then
+	lastLimited      time.Time
+}
+
+// Pool is a named set of upstream keys that requests share.
+type Pool struct {
+	name       string
+	strategy   string
+	quarantine time.Duration
+
+	mu   sync.Mutex
+	keys []*key
+	next int // Round-robin position
+}
+
+// newPool creates a pool from a list of keys. Blank and duplicate keys are ignored.
+func newPool(name, strategy string, quarantine time.Duration, values []string) *Pool {
+	p := &Pool{name: name, strategy: strategy, quarantine: quarantine}
+	p.add(values)
+	return p
+}
+
+// add appends keys to the pool, ignoring blank and duplicate ones.
+func (p *Pool) add(values []string) {
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" || p.find(value) != nil {
+			continue
+		}
+		p.keys = append(p.keys, &key{value: value})
+	}
+}
+
+// find returns the key with the given value, or nil.
+func (p *Pool) find(value string) *key {
+	for _, k := range p.keys {
+		if k.value == value {
+			return k
+		}
+	}
+	return nil
+}
+
+// Name returns the name of the pool.
+func (p *Pool) Name() string {
+	return p.name
+}
+
+// acquire picks a healthy key that is not in tried, following the pool's strategy.
+func (p *Pool) acquire(tried []string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	chosen, err := p.pick(tried)
+	if err != nil {
+		return "", err
+	}
+	p.next = (chosen + 1) % len(p.keys)
+	return p.keys[chosen].value, nil
+}
+
+// Peek returns the key the pool would hand out next, without moving on to the following one,
+// for health probes that must not disturb the rotation of the keys among requests.
+func (p *Pool) Peek() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	chosen, err := p.pick(nil)
+	if err != nil {
+		return "", err
+	}
+	return p.keys[chosen].value, nil
+}
+
+// pick returns the index of the healthy key that is not in tried and comes first under the
+// pool's strategy. The caller must hold p.mu.
+func (p *Pool) pick(tried []string) (int, error) {
+	now := time.Now()
+	var candidates []int
+	for offset := 0; offset < len(p.keys); offset++ {
+		i := (p.next + offset) % len(p.keys)
+		k := p.keys[i]
+		if k.disabled || now.Before(k.quarantinedUntil) || contains(tried, k.value) {
+			continue
+		}
+		candidates = append(candidates, i)
+	}
+	if len(candidates) == 0 {
+		return 0, ErrNoKey
+	}
+
+	if p.strategy == StrategyLeastRecentlyLimited {
+		// Candidates are in round-robin order, so a stable sort keeps rotating among equals.
+		sort.SliceStable(candidates, func(a, b int) bool {
+			return p.keys[candidates[a]].lastLimited.Before(p.keys[candidates[b]].lastLimited)
+		})
+	}
+	return candidates[0], nil
+}
+
+// report updates the health of a key after an upstream response: a 429 quarantines it for
+// the pool's quarantine period (or longer, if the upstream asked for it) and a 403 disables it.
+func (p *Pool) report(value string, statusCode int, retryAfter time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	k := p.find(value)
+	if k == nil {
+		return
+	}
+	switch statusCode {
+	case http.StatusTooManyRequests:
+		now := time.Now()
+		k.lastLimited = now
+		k.quarantinedUntil = now.Add(max(p.quarantine, retryAfter))
+	case http.StatusForbidden:
+		k.disabled = true
+	}
+}
+
+// Stats returns the number of keys in the pool that are usable, quarantined and disabled.
+func (p *Pool) Stats() (healthy, quarantined, disabled int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	for _, k := range p.keys {
+		switch {
+		case k.disabled:
+			disabled++
+		case now.Before(k.quarantinedUntil):
+			quarantined++
+		default:
+			healthy++
+		}
+	}
+	return healthy, quarantined, disabled
+}
+
+// Registry holds the configured pools and the client tokens that map to them.
+type Registry struct {
+	pools   map[string]*Pool
+	clients map[string]string // Client token -> pool name
+}
+
+// fileConfig is the format of KEY_POOL_FILE.
+type fileConfig struct {
+	Strategy string              `json:"strategy,omitempty"`
+	Pools    map[string][]string `json:"pools"`
+	Clients  map[string]string   `json:"clients,omitempty"` // Client token -> pool name
+}
+
+// Load builds the registry from the application configuration: the pools and client tokens
+// of KEY_POOL_FILE, plus the comma-separated keys of GEMINI_API_KEY in the default pool.
+func Load() (*Registry, error) {
+	var file fileConfig
+	if path := config.AppConfig.KeyPoolFile; path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key pool file: %w", err)
+		}
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("invalid key pool file: %w", err)
+		}
+	}
+
+	strategy := config.AppConfig.KeyPoolStrategy
+	if file.Strategy != "" {
+		strategy = file.Strategy
+	}
+	if strategy != StrategyRoundRobin && strategy != StrategyLeastRecentlyLimited {
+		return nil, fmt.Errorf("unknown key pool strategy %q", strategy)
+	}
+
+	reg := &Registry{pools: make(map[string]*Pool), clients: make(map[string]string)}
+	for name, values := range file.Pools {
+		reg.pools[name] = newPool(name, strategy, config.AppConfig.KeyQuarantine, values)
+	}
+	if envKeys := config.AppConfig.GeminiAPIKeys; len(envKeys) > 0 {
+		if pool, ok := reg.pools[DefaultPool]; ok {
+			pool.add(envKeys)
+		} else {
+			reg.pools[DefaultPool] = newPool(DefaultPool, strategy, config.AppConfig.KeyQuarantine, envKeys)
+		}
+	}
+
+	for token, name := range file.Clients {
+		if _, ok := reg.pools[name]; !ok {
+			return nil, fmt.Errorf("client token mapped to unknown key pool %q", name)
+		}
+		reg.clients[token] = name
+	}
+	return reg, nil
+}
+
+// Pool returns the named pool, or nil if there is none.
+func (reg *Registry) Pool(name string) *Pool {
+	return reg.pools[name]
+}
+
+// Pools returns the names of all pools, sorted.
+func (reg *Registry) Pools() []string {
+	names := make([]string, 0, len(reg.pools))
+	for name := range reg.pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ForClient returns the key selector for a client request, given the key the client presented
+// (see util.GetAPIKey). A client token mapped to a pool uses that pool, no key at all uses the
+// default pool, and any other key is a Gemini key of the client's own and is used as it is.
+func (reg *Registry) ForClient(clientKey string) *Selector {
+	if name, ok := reg.clients[clientKey]; ok {
+		return &Selector{pool: reg.pools[name]}
+	}
+	if pool, ok := reg.pools[DefaultPool]; ok && clientKey == "" {
+		return &Selector{pool: pool}
+	}
+	return &Selector{fixed: clientKey}
+}
+
+// ForPool returns the key selector for a client request served from the named pool.
+// If there is no such pool, the selector has no key to give out.
+func (reg *Registry) ForPool(name string) *Selector {
+	return &Selector{pool: reg.pools[name]}
+}
+
+// HasDefault reports whether there is a default pool for clients that bring no key.
+func (reg *Registry) HasDefault() bool {
+	_, ok := reg.pools[DefaultPool]
+	return ok
+}
+
+var current atomic.Pointer[Registry]
+
+// SetRegistry installs the registry returned by Current.
+func SetRegistry(reg *Registry) {
+	current.Store(reg)
+}
+
+// Current returns the installed registry, or an empty one if none was installed.
+func Current() *Registry {
+	if reg := current.Load(); reg != nil {
+		return reg
+	}
+	return &Registry{}
+}
+
+// Selector hands out the upstream keys for the attempts of a single client request.
+// It sticks to one key until the request moves on with Next, and never returns to a key
+// it has moved away from.
+type Selector struct {
+	pool    *Pool
+	fixed   string // The client's own key, when no pool is involved
+	current string
+	tried   []string
+}
+
+// Key returns the key for the next attempt.
+func (s *Selector) Key() (string, error) {
+	if s.pool == nil {
+		if s.fixed == "" {
+			return "", ErrNoKey
+		}
+		return s.fixed, nil
+	}
+	if s.current == "" {
+		value, err := s.pool.acquire(s.tried)
+		if err != nil {
+			return "", err
+		}
+		s.current = value
+	}
+	return s.current, nil
+}
+
+// Next moves to another key of the pool for the following attempts. It reports false,
+// keeping the current key, if the request has no pool or no other key is available.
+func (s *Selector) Next() bool {
+	if s.pool == nil {
+		return false
+	}
+	tried := s.tried
+	if s.current != "" {
+		tried = append(tried, s.current)
+	}
+	value, err := s.pool.acquire(tried)
+	if err != nil {
+		return false
+	}
+	s.tried = tried
+	s.current = value
+	return true
+}
+
+// Report records the upstream status of an attempt made with the current key, so that
+// rate-limited keys are quarantined and rejected keys disabled for all requests. A key that
+// becomes unusable is dropped, and the next call to Key picks another one.
+func (s *Selector) Report(statusCode int, retryAfter time.Duration) {
+	if s.pool == nil || s.current == "" {
+		return
+	}
+	s.pool.report(s.current, statusCode, retryAfter)
+	if statusCode == http.StatusTooManyRequests || statusCode == http.StatusForbidden {
+		s.tried = append(s.tried, s.current)
+		s.current = ""
+	}
+}
+
+// Pooled reports whether the keys come from a server-side pool.
+func (s *Selector) Pooled() bool {
+	return s.pool != nil
+}
+
+// Label identifies the current key in logs without revealing it.
+func (s *Selector) Label() string {
+	return Mask(s.current)
+}
+
+// Mask shortens a key to its last four characters, for logs.
+func Mask(value string) string {
+	if len(value) <= 4 {
+		return "****"
+	}
+	return "…" + value[len(value)-4:]
+}
+
+// contains reports whether values contains value.
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
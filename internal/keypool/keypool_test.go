@@ -0,0 +1,209 @@
+package keypool
+
+import (
+	"gemini-anti-truncate-go/internal/config"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Initialize config for tests
+func init() {
+	config.Load()
+}
+
+func TestSelector_RoundRobin(t *testing.T) {
+	pool := newPool("test", StrategyRoundRobin, time.Minute, []string{"key-a", "key-b", "key-c", "key-a", " "})
+
+	var got []string
+	for i := 0; i < 4; i++ {
+		key, err := (&Selector{pool: pool}).Key()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		got = append(got, key)
+	}
+	expected := []string{"key-a", "key-b", "key-c", "key-a"}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected, got)
+			break
+		}
+	}
+}
+
+func TestPool_PeekKeepsRotation(t *testing.T) {
+	pool := newPool("test", StrategyRoundRobin, time.Minute, []string{"key-a", "key-b"})
+
+	for i := 0; i < 3; i++ {
+		if key, err := pool.Peek(); err != nil || key != "key-a" {
+			t.Fatalf("Expected to peek at 'key-a', got '%s' (%v)", key, err)
+		}
+	}
+	if key, _ := (&Selector{pool: pool}).Key(); key != "key-a" {
+		t.Errorf("Expected peeking not to move the rotation, got '%s'", key)
+	}
+	if key, _ := pool.Peek(); key != "key-b" {
+		t.Errorf("Expected to peek at 'key-b' once 'key-a' was used, got '%s'", key)
+	}
+}
+
+func TestSelector_QuarantineAndDisable(t *testing.T) {
+	pool := newPool("test", StrategyRoundRobin, time.Minute, []string{"key-a", "key-b", "key-c"})
+
+	s := &Selector{pool: pool}
+	if key, _ := s.Key(); key != "key-a" {
+		t.Fatalf("Expected 'key-a', got '%s'", key)
+	}
+	// A 429 quarantines the key and the request moves on to the next one
+	s.Report(http.StatusTooManyRequests, 0)
+	if key, _ := s.Key(); key != "key-b" {
+		t.Errorf("Expected 'key-b' after a 429, got '%s'", key)
+	}
+	// A 403 disables the key
+	s.Report(http.StatusForbidden, 0)
+	if key, _ := s.Key(); key != "key-c" {
+		t.Errorf("Expected 'key-c' after a 403, got '%s'", key)
+	}
+	// Other errors leave the key in place
+	s.Report(http.StatusServiceUnavailable, 0)
+	if key, _ := s.Key(); key != "key-c" {
+		t.Errorf("Expected 'key-c' after a 503, got '%s'", key)
+	}
+	if s.Next() {
+		t.Error("Expected no other key to be available")
+	}
+
+	healthy, quarantined, disabled := pool.Stats()
+	if healthy != 1 || quarantined != 1 || disabled != 1 {
+		t.Errorf("Expected 1 healthy, 1 quarantined and 1 disabled key, got %d, %d and %d", healthy, quarantined, disabled)
+	}
+
+	// Other requests skip the quarantined and disabled keys too
+	for i := 0; i < 3; i++ {
+		if key, _ := (&Selector{pool: pool}).Key(); key != "key-c" {
+			t.Errorf("Expected 'key-c', got '%s'", key)
+		}
+	}
+}
+
+func TestSelector_QuarantineEnds(t *testing.T) {
+	pool := newPool("test", StrategyRoundRobin, 10*time.Millisecond, []string{"key-a"})
+
+	s := &Selector{pool: pool}
+	s.Key()
+	s.Report(http.StatusTooManyRequests, 0)
+	if _, err := s.Key(); err != ErrNoKey {
+		t.Errorf("Expected ErrNoKey, got %v", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if key, err := (&Selector{pool: pool}).Key(); err != nil || key != "key-a" {
+		t.Errorf("Expected 'key-a' once the quarantine is over, got '%s' (%v)", key, err)
+	}
+
+	// A longer Retry-After extends the quarantine
+	s = &Selector{pool: pool}
+	s.Key()
+	s.Report(http.StatusTooManyRequests, time.Hour)
+	time.Sleep(20 * time.Millisecond)
+	if _, err := (&Selector{pool: pool}).Key(); err != ErrNoKey {
+		t.Errorf("Expected ErrNoKey while Retry-After lasts, got %v", err)
+	}
+}
+
+func TestSelector_LeastRecentlyLimited(t *testing.T) {
+	pool := newPool("test", StrategyLeastRecentlyLimited, 0, []string{"key-a", "key-b", "key-c"})
+
+	// With no quarantine, limited keys stay usable but are picked last
+	for _, limited := range []string{"key-b", "key-a"} {
+		s := &Selector{pool: pool, current: limited}
+		s.Report(http.StatusTooManyRequests, 0)
+	}
+
+	expected := []string{"key-c", "key-c", "key-c"}
+	for _, want := range expected {
+		if key, _ := (&Selector{pool: pool}).Key(); key != want {
+			t.Errorf("Expected '%s', got '%s'", want, key)
+		}
+	}
+
+	s := &Selector{pool: pool}
+	s.Key()
+	if !s.Next() || s.Label() != Mask("key-b") {
+		t.Errorf("Expected the next key to be the one limited longest ago, got %s", s.Label())
+	}
+}
+
+func TestSelector_Fixed(t *testing.T) {
+	s := Current().ForClient("client-key")
+	if s.Pooled() {
+		t.Error("Expected the client's own key not to be pooled")
+	}
+	if key, _ := s.Key(); key != "client-key" {
+		t.Errorf("Expected 'client-key', got '%s'", key)
+	}
+	s.Report(http.StatusTooManyRequests, 0)
+	if key, _ := s.Key(); key != "client-key" || s.Next() {
+		t.Errorf("Expected the client's key to stay in use, got '%s'", key)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	defer func(cfg config.Config) { *config.AppConfig = cfg }(*config.AppConfig)
+
+	path := filepath.Join(t.TempDir(), "keys.json")
+	os.WriteFile(path, []byte(`{
+		"strategy": "least_recently_limited",
+		"pools": {"default": ["file-key"], "batch": ["batch-a", "batch-b"]},
+		"clients": {"batch-token": "batch"}
+	}`), 0o600)
+	config.AppConfig.KeyPoolFile = path
+	config.AppConfig.GeminiAPIKeys = []string{"env-a", "env-b"}
+
+	reg, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if names := reg.Pools(); len(names) != 2 || names[0] != "batch" || names[1] != "default" {
+		t.Errorf("Expected pools [batch default], got %v", names)
+	}
+	if healthy, _, _ := reg.Pool(DefaultPool).Stats(); healthy != 3 {
+		t.Errorf("Expected 3 keys in the default pool, got %d", healthy)
+	}
+	if !reg.HasDefault() {
+		t.Error("Expected a default pool")
+	}
+
+	s := reg.ForClient("batch-token")
+	if key, _ := s.Key(); key != "batch-a" {
+		t.Errorf("Expected the client token to use the batch pool, got '%s'", key)
+	}
+	s = reg.ForClient("")
+	if key, _ := s.Key(); !s.Pooled() || key != "file-key" {
+		t.Errorf("Expected a client without a key to use the default pool, got '%s'", key)
+	}
+
+	// Client tokens must map to a pool that exists
+	os.WriteFile(path, []byte(`{"pools": {"batch": ["k"]}, "clients": {"t": "missing"}}`), 0o600)
+	if _, err := Load(); err == nil {
+		t.Error("Expected an error for a client token mapped to an unknown pool")
+	}
+
+	config.AppConfig.KeyPoolFile = ""
+	config.AppConfig.KeyPoolStrategy = "random"
+	if _, err := Load(); err == nil {
+		t.Error("Expected an error for an unknown strategy")
+	}
+}
+
+func TestMask(t *testing.T) {
+	if masked := Mask("AIzaSyExample1234"); masked != "…1234" {
+		t.Errorf("Expected '…1234', got '%s'", masked)
+	}
+	if masked := Mask("abc"); masked != "****" {
+		t.Errorf("Expected '****', got '%s'", masked)
+	}
+}
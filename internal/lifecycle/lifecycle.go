@@ -0,0 +1,66 @@
+package lifecycle
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// Lifecycle tracks the shutdown of the server in two phases. While draining, no new work is
+// accepted but requests in flight carry on. Once stopped, when the grace period is over,
+// requests still in flight end their responses early, cleanly, instead of being cut off.
+type Lifecycle struct {
+	draining atomic.Bool
+	ctx      context.Context // Canceled when stopped
+	stop     context.CancelFunc
+}
+
+// New creates the lifecycle of a server that is running.
+func New() *Lifecycle {
+	ctx, stop := context.WithCancel(context.Background())
+	return &Lifecycle{ctx: ctx, stop: stop}
+}
+
+// Drain starts the shutdown: the server stops accepting work and reports that it is not ready.
+func (l *Lifecycle) Drain() {
+	l.draining.Store(true)
+}
+
+// Draining reports whether the shutdown has started.
+func (l *Lifecycle) Draining() bool {
+	return l.draining.Load()
+}
+
+// Stop ends the grace period: the requests still in flight are asked to finish now.
+func (l *Lifecycle) Stop() {
+	l.Drain()
+	l.stop()
+}
+
+// Stopped reports whether the grace period is over.
+func (l *Lifecycle) Stopped() bool {
+	return l.ctx.Err() != nil
+}
+
+// Context returns a context that is canceled when the grace period is over, for requests to
+// derive their own contexts from.
+func (l *Lifecycle) Context() context.Context {
+	return l.ctx
+}
+
+var current atomic.Pointer[Lifecycle]
+
+// SetLifecycle installs the lifecycle returned by Current.
+func SetLifecycle(l *Lifecycle) {
+	current.Store(l)
+}
+
+// Current returns the installed lifecycle, or one that never shuts down if none was installed.
+func Current() *Lifecycle {
+	if l := current.Load(); l != nil {
+		return l
+	}
+	return running
+}
+
+// running is used until a lifecycle is installed.
+var running = New()
@@ -0,0 +1,43 @@
+package lifecycle
+
+import (
+	"testing"
+)
+
+func TestLifecycle(t *testing.T) {
+	l := New()
+	if l.Draining() || l.Stopped() || l.Context().Err() != nil {
+		t.Fatal("Expected a new lifecycle to be running")
+	}
+
+	l.Drain()
+	if !l.Draining() || l.Stopped() {
+		t.Error("Expected the lifecycle to be draining but not stopped")
+	}
+
+	l.Stop()
+	l.Stop() // Stopping twice is harmless
+	if !l.Stopped() || l.Context().Err() == nil {
+		t.Error("Expected the lifecycle to be stopped and its context canceled")
+	}
+}
+
+func TestStopDrains(t *testing.T) {
+	l := New()
+	l.Stop()
+	if !l.Draining() {
+		t.Error("Expected a stopped lifecycle to be draining")
+	}
+}
+
+func TestCurrent(t *testing.T) {
+	if Current() == nil || Current().Draining() {
+		t.Fatal("Expected a running lifecycle by default")
+	}
+	l := New()
+	SetLifecycle(l)
+	defer SetLifecycle(nil)
+	if Current() != l {
+		t.Error("Expected the installed lifecycle")
+	}
+}
@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// scrape returns the text the registry's handler serves.
+func scrape(t *testing.T, r *Registry) string {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if contentType := rr.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("Expected the Prometheus text format, got '%s'", contentType)
+	}
+	return rr.Body.String()
+}
+
+func TestCounterVec(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("test_requests_total", "Requests.", "model", "outcome")
+	c.Inc("b", "ok")
+	c.Inc("a", "ok")
+	c.Add(2.5, "a", "ok")
+	c.Inc("a", `say "hi"`+"\n\\")
+
+	expected := `# HELP test_requests_total Requests.
+# TYPE test_requests_total counter
+test_requests_total{model="a",outcome="ok"} 3.5
+test_requests_total{model="a",outcome="say \"hi\"\n\\"} 1
+test_requests_total{model="b",outcome="ok"} 1
+`
+	if got := scrape(t, r); got != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, got)
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	r := NewRegistry()
+	h := r.NewHistogramVec("test_latency_seconds", "Latency.", []float64{1, 0.5}, "mode")
+	h.Observe(0.2, "stream")
+	h.Observe(0.5, "stream")
+	h.Observe(3, "stream")
+
+	expected := `# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{mode="stream",le="0.5"} 2
+test_latency_seconds_bucket{mode="stream",le="1"} 2
+test_latency_seconds_bucket{mode="stream",le="+Inf"} 3
+test_latency_seconds_sum{mode="stream"} 3.7
+test_latency_seconds_count{mode="stream"} 3
+`
+	if got := scrape(t, r); got != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, got)
+	}
+}
+
+func TestGaugeFunc(t *testing.T) {
+	r := NewRegistry()
+	r.NewGaugeFunc("test_queue_depth", "Queue depth.", []string{"gate"}, func() []Sample {
+		return []Sample{{Labels: []string{"global"}, Value: 4}}
+	})
+	r.NewCounterFunc("test_rejected_total", "Rejections.", nil, func() []Sample {
+		return []Sample{{Value: 2}}
+	})
+
+	got := scrape(t, r)
+	for _, line := range []string{
+		"# TYPE test_queue_depth gauge",
+		`test_queue_depth{gate="global"} 4`,
+		"# TYPE test_rejected_total counter",
+		"test_rejected_total 2",
+	} {
+		if !strings.Contains(got, line+"\n") {
+			t.Errorf("Expected line '%s', got:\n%s", line, got)
+		}
+	}
+}
+
+func TestLabelCountMismatch(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected a panic for a wrong number of label values")
+		}
+	}()
+	NewRegistry().NewCounterVec("test_total", "Test.", "a", "b").Inc("only-one")
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"gemini-anti-truncate-go/internal/gemini"
+)
+
+// Decision is the verdict on a single upstream attempt: whether the answer is finished,
+// should be continued, or must be handed to the client as it is.
+type Decision int
+
+const (
+	// DecisionComplete means the model finished its answer (or handed over to a function call).
+	DecisionComplete Decision = iota
+	// DecisionRetry means the answer was cut off and a continuation should be requested.
+	DecisionRetry
+	// DecisionTerminal means the model stopped for a reason a continuation cannot fix, such as a safety block.
+	DecisionTerminal
+	// DecisionError means the generation failed, for example with a malformed function call.
+	DecisionError
+	// DecisionBlocked means the prompt itself was blocked (promptFeedback.blockReason) or the
+	// response carried no candidate at all, so there is no answer to continue.
+	DecisionBlocked
+	// DecisionMaxTokens means the answer reached the output token limit. The limit may be the
+	// client's own maxOutputTokens, so whether to continue is left to the retry policy.
+	DecisionMaxTokens
+)
+
+// String returns the name of the decision, used in logs.
+func (d Decision) String() string {
+	switch d {
+	case DecisionComplete:
+		return "complete"
+	case DecisionRetry:
+		return "truncated-retry"
+	case DecisionTerminal:
+		return "terminal-stop"
+	case DecisionBlocked:
+		return "prompt-blocked"
+	case DecisionMaxTokens:
+		return "max-tokens"
+	default:
+		return "error"
+	}
+}
+
+// terminalFinishReasons are the finish reasons after which the model will not produce the
+// rest of the answer, however often it is asked to continue.
+var terminalFinishReasons = map[string]bool{
+	gemini.FinishReasonSafety:            true,
+	gemini.FinishReasonRecitation:        true,
+	gemini.FinishReasonLanguage:          true,
+	gemini.FinishReasonBlocklist:         true,
+	gemini.FinishReasonProhibitedContent: true,
+	gemini.FinishReasonSPII:              true,
+	gemini.FinishReasonImageSafety:       true,
+}
+
+// ClassifyCompletion decides what to do with an attempt from the finish reason of its first
+// candidate and whether the finish token was seen in its answer.
+//
+// The token is the proxy's own proof of completion, so it always wins. Without it, a STOP or a
+// missing finish reason (the stream was cut off) are truncations worth continuing, MAX_TOKENS
+// gets a decision of its own, content blocks are terminal, and anything else, including finish
+// reasons this proxy does not know yet, is reported as an error rather than retried blindly.
+func ClassifyCompletion(finishReason string, tokenFound, hasFunctionCall bool) Decision {
+	if tokenFound || hasFunctionCall {
+		return DecisionComplete
+	}
+
+	switch {
+	case finishReason == "", finishReason == gemini.FinishReasonStop:
+		return DecisionRetry
+	case finishReason == gemini.FinishReasonMaxTokens:
+		return DecisionMaxTokens
+	case terminalFinishReasons[finishReason]:
+		return DecisionTerminal
+	default:
+		return DecisionError
+	}
+}
+
+// classifyAttempt extends ClassifyCompletion to whole responses: a blocked prompt or a
+// response without candidates is never worth resending.
+func classifyAttempt(blockReason string, hasCandidates bool, finishReason string, tokenFound, hasFunctionCall bool) Decision {
+	if blockReason != "" || !hasCandidates {
+		return DecisionBlocked
+	}
+	return ClassifyCompletion(finishReason, tokenFound, hasFunctionCall)
+}
+
+// promptBlockReason returns the block reason of a response, or "" if its prompt was not blocked.
+func promptBlockReason(response *gemini.GenerateContentResponse) string {
+	return response.PromptFeedback.BlockReason
+}
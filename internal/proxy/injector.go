@@ -1,6 +1,9 @@
 package proxy
 
-import "gemini-anti-truncate-go/internal/gemini"
+import (
+	"gemini-anti-truncate-go/internal/gemini"
+	"strings"
+)
 
 // InjectFinishToken modifies the request to include instructions for the model
 // to append a finish token at the end of its response.
@@ -16,12 +19,11 @@ func InjectFinishToken(req *gemini.GenerateContentRequest) *gemini.GenerateConte
 			},
 		}
 	} else {
-		// If it exists, append the instruction.
-		// We assume the first part is the main text.
-		if len(systemInstruction.Parts) > 0 {
-			systemInstruction.Parts[0].Text += "\n\nPlease ensure your response ends with " + gemini.FinishToken
+		// If it exists, append the instruction to the first text part.
+		if i := firstTextPart(systemInstruction.Parts); i >= 0 {
+			systemInstruction.Parts[i].Text += "\n\nPlease ensure your response ends with " + gemini.FinishToken
 		} else {
-			// If parts are empty, add a new part.
+			// If there is no text part, add a new one.
 			systemInstruction.Parts = append(systemInstruction.Parts, gemini.Part{Text: "Please ensure your response ends with " + gemini.FinishToken})
 		}
 	}
@@ -35,10 +37,25 @@ func InjectFinishToken(req *gemini.GenerateContentRequest) *gemini.GenerateConte
 
 		if lastContent.Role == "user" && len(lastContent.Parts) > 0 {
 			lastPartIndex := len(lastContent.Parts) - 1
-			// Append to the last part of the last user message.
-			lastContent.Parts[lastPartIndex].Text += gemini.UserPromptSuffix
+			if lastContent.Parts[lastPartIndex].IsText() {
+				// Append to the last part of the last user message.
+				lastContent.Parts[lastPartIndex].Text += gemini.UserPromptSuffix
+			} else {
+				// Images, files and function responses cannot carry text, so add a separate part.
+				lastContent.Parts = append(lastContent.Parts, gemini.Part{Text: strings.TrimLeft(gemini.UserPromptSuffix, "\n")})
+			}
 		}
 	}
 
 	return req
 }
+
+// firstTextPart returns the index of the first plain text part, or -1 if there is none.
+func firstTextPart(parts []gemini.Part) int {
+	for i, part := range parts {
+		if part.IsText() && !part.Thought {
+			return i
+		}
+	}
+	return -1
+}
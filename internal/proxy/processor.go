@@ -3,171 +3,304 @@ package proxy
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"gemini-anti-truncate-go/internal/gemini"
 	"gemini-anti-truncate-go/internal/util"
+	"io"
 	"net/http"
 	"strings"
 )
 
 // StreamProcessingResult holds the outcome of processing a stream.
 type StreamProcessingResult struct {
-	IsComplete        bool
+	IsComplete        bool // The finish token was seen
 	HasFunctionCall   bool
+	Stalled           bool     // The upstream stopped sending data, see WatchStall
+	Chunks            int      // The chunks received from the upstream stream
+	FinishReason      string   // The finish reason of the first candidate, if any
+	BlockReason       string   // promptFeedback.blockReason, if the prompt was blocked
+	Decision          Decision // What to do next, see ClassifyCompletion
 	AccumulatedText   string
-	FinalResponseJSON string // Used for non-stream handler to get the full JSON
+	AccumulatedParts  []gemini.Part                   // The model turn of this attempt, including non-text parts, for continuations
+	FinalResponseJSON string                          // Used for non-stream handler to get the full JSON
+	Response          *gemini.GenerateContentResponse // The parsed upstream response, used to stitch attempts together
 }
 
-// ProcessStream handles the server-sent event (SSE) stream from the upstream API.
-// It forwards events to the client, while checking for the finish token to determine if the response is complete.
+// ProcessStream handles a streamed response from the upstream API and forwards it to the client
+// in the same wire format (SSE or JSON array), while checking for the finish token to determine if
+// the response is complete. The token is stripped from the forwarded chunks even when it is split
+// across chunks or parts.
 func ProcessStream(w http.ResponseWriter, upstreamResp *http.Response) (*StreamProcessingResult, error) {
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		return nil, &ProxyError{Message: "Streaming unsupported", StatusCode: http.StatusInternalServerError}
+	body := bufio.NewReader(upstreamResp.Body)
+	sw, err := NewStreamWriter(w, detectStreamFormat(upstreamResp, body))
+	if err != nil {
+		return nil, err
 	}
+	defer sw.Close()
 
-	// Set client headers for SSE
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
+	peekedResp := *upstreamResp
+	peekedResp.Body = io.NopCloser(body)
+	return ProcessStreamTo(sw, &peekedResp)
+}
 
-	scanner := bufio.NewScanner(upstreamResp.Body)
-	var textBuffer, lookbehindBuffer bytes.Buffer
-	var isComplete, hasFunctionCall, inPassthrough bool
+// ProcessStreamTo processes one upstream stream, in either wire format, and writes the cleaned
+// chunks to sw. The writer is owned by the caller so that the chunks of several continuation
+// attempts can be sent as one client response. A stream that stalled (ErrStalled) is not an
+// error: it ends like a stream that was cut off, with the text received so far. Once a write to
+// the client fails, the upstream stream is no longer read and ErrClientDisconnected is returned.
+func ProcessStreamTo(sw *StreamWriter, upstreamResp *http.Response) (*StreamProcessingResult, error) {
+	body := bufio.NewReader(upstreamResp.Body)
+	sp := &streamProcessor{ctx: context.Background(), sw: sw, rewriter: newStreamRewriter()}
+	if upstreamResp.Request != nil {
+		sp.ctx = upstreamResp.Request.Context()
+	}
 
-	for scanner.Scan() {
-		line := scanner.Text()
+	var err error
+	if detectStreamFormat(upstreamResp, body) == FormatJSONArray {
+		err = sp.readJSONArray(body)
+	} else {
+		err = sp.readSSE(body)
+	}
+	if errors.Is(err, ErrStalled) {
+		util.Error(sp.ctx, "Upstream stream stalled", "chunks", sp.chunks)
+		sp.stalled = true
+		err = nil
+	}
+	if errors.Is(err, ErrClientDisconnected) {
+		util.Info(sp.ctx, "Stopped reading the upstream stream", "chunks", sp.chunks, "error", err)
+		return nil, err
+	}
+	if err != nil {
+		util.Error(sp.ctx, "Error reading stream from upstream", "chunks", sp.chunks, "error", err)
+		return nil, err
+	}
 
-		if strings.HasPrefix(line, "data:") {
-			jsonData := strings.TrimPrefix(line, "data: ")
+	return sp.finish()
+}
 
-			if inPassthrough {
-				// Once a function call is seen, we just forward everything.
-				fmt.Fprintf(w, "%s\n", line)
-				flusher.Flush()
-				continue
-			}
+// streamProcessor holds the state of a single upstream stream while its chunks are
+// fed through finish-token detection and forwarded to the client.
+type streamProcessor struct {
+	ctx              context.Context // Of the upstream request, for logging
+	sw               *StreamWriter
+	rewriter         *streamRewriter
+	textBuffer       bytes.Buffer
+	accumulatedParts []gemini.Part
+	hasFunctionCall  bool
+	inPassthrough    bool
+	finishReason     string
+	blockReason      string
+	chunks           int
+	hasCandidates    bool
+	stalled          bool
+	fields           []string // SSE fields of the event being handled, see write
+}
 
-			var streamChunk gemini.GenerateContentResponse
-			if err := json.Unmarshal([]byte(jsonData), &streamChunk); err != nil {
-				util.Debugf("Error unmarshalling stream chunk: %v. Data: %s", err, jsonData)
-				// Forward malformed data as-is
-				fmt.Fprintf(w, "%s\n", line)
-				flusher.Flush()
-				continue
+// readSSE reads an SSE stream event by event and feeds the data of each event into the
+// pipeline. The other fields of an event are forwarded with its data, and events without data,
+// such as keep-alive comments, are forwarded as they are.
+func (sp *streamProcessor) readSSE(body io.Reader) error {
+	reader := newSSEReader(body)
+	for {
+		event, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !event.HasData {
+			if err := sp.sw.WriteFields(event.Fields); err != nil {
+				return err
 			}
+			continue
+		}
+		sp.fields = append(sp.fields, event.Fields...)
+		if err := sp.handleChunk(event.Data); err != nil {
+			return err
+		}
+	}
+}
 
-			var currentText, currentThought string
-			isThoughtChunk := false
-
-			// Process parts to extract text, thoughts, and function calls
-			if len(streamChunk.Candidates) > 0 {
-				for _, part := range streamChunk.Candidates[0].Content.Parts {
-					if part.Thought {
-						isThoughtChunk = true
-						currentThought += part.Text
-					} else if part.FunctionCall != nil {
-						hasFunctionCall = true
-						inPassthrough = true // Enter passthrough mode
-						currentText += part.Text
-					} else {
-						currentText += part.Text
-					}
-				}
-			}
+// readJSONArray reads a streamed JSON array element by element and feeds each one into the pipeline.
+func (sp *streamProcessor) readJSONArray(body io.Reader) error {
+	reader := newJSONArrayReader(body)
+	for {
+		element, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := sp.handleChunk(element); err != nil {
+			return err
+		}
+	}
+}
 
-			if isThoughtChunk {
-				// Forward thought chunks immediately without affecting the main text buffer
-				// but clean the finish token just in case it appears there.
-				cleanedThoughtLine := strings.Replace(line, gemini.FinishToken, "", -1)
-				fmt.Fprintf(w, "%s\n", cleanedThoughtLine)
-				flusher.Flush()
-				continue // Skip buffer processing for thoughts
-			}
+// handleChunk inspects a single response chunk and forwards it, cleaned of the finish token.
+func (sp *streamProcessor) handleChunk(data []byte) error {
+	if sp.inPassthrough {
+		// Once a function call is seen, we just forward everything, after the text still held back.
+		if err := sp.flushPending(); err != nil {
+			return err
+		}
+		return sp.write(data)
+	}
 
-			// Append text to main buffer and lookbehind buffer
-			textBuffer.WriteString(currentText)
-			if lookbehindBuffer.Len() > gemini.TokenLookbehindChars {
-				// Slide the lookbehind window
-				lookbehindBuffer.Next(lookbehindBuffer.Len() - gemini.TokenLookbehindChars)
-			}
-			lookbehindBuffer.WriteString(currentText)
+	var streamChunk gemini.GenerateContentResponse
+	if err := json.Unmarshal(data, &streamChunk); err != nil {
+		util.Debug(sp.ctx, "Error unmarshalling stream chunk, forwarding it as it is", "error", err, "data", string(data))
+		// Forward malformed data as-is
+		return sp.write(data)
+	}
+
+	sp.chunks++
+	if reason := promptBlockReason(&streamChunk); reason != "" {
+		sp.blockReason = reason
+	}
 
-			// Check for finish token
-			if strings.Contains(lookbehindBuffer.String(), gemini.FinishToken) {
-				isComplete = true
-				// Clean the token from the output
-				line = strings.Replace(line, gemini.FinishToken, "", -1)
+	// Accumulate the raw answer (thoughts excluded) before the token is stripped.
+	if len(streamChunk.Candidates) > 0 {
+		sp.hasCandidates = true
+		if reason := streamChunk.Candidates[0].FinishReason; reason != "" {
+			sp.finishReason = reason
+		}
+		sp.accumulatedParts = AppendModelParts(sp.accumulatedParts, streamChunk.Candidates[0].Content.Parts)
+		for _, part := range streamChunk.Candidates[0].Content.Parts {
+			if part.FunctionCall != nil {
+				sp.hasFunctionCall = true
+				sp.inPassthrough = true // Enter passthrough mode
+			}
+			if !part.Thought {
+				sp.textBuffer.WriteString(part.Text)
 			}
 		}
+	}
 
-		// Forward the (potentially modified) line to the client
-		fmt.Fprintf(w, "%s\n", line)
-
-		// Write an empty line to signify the end of the event
-		if len(line) > 0 {
-			fmt.Fprintf(w, "\n")
+	if changed := sp.rewriter.rewrite(&streamChunk); changed {
+		// Only chunks that were actually rewritten are re-marshalled; the rest are forwarded verbatim.
+		cleanedJSON, err := json.Marshal(streamChunk)
+		if err != nil {
+			return err
 		}
+		data = cleanedJSON
+	}
 
-		flusher.Flush()
+	return sp.write(data)
+}
+
+// write forwards a chunk with the SSE fields of the event it was made from. It fails with ErrClientDisconnected once
+// the client is gone, which stops reading the upstream stream.
+func (sp *streamProcessor) write(data []byte) error {
+	err := sp.sw.WriteEvent(sp.fields, data)
+	sp.fields = nil
+	return err
+}
+
+// flushPending sends the text that was held back but can no longer turn into the finish token
+// as a chunk of its own. Nothing is sent if no text is pending.
+func (sp *streamProcessor) flushPending() error {
+	pending := sp.rewriter.flushAll()
+	if pending == nil {
+		return nil
 	}
+	pendingJSON, err := json.Marshal(pending)
+	if err != nil {
+		return err
+	}
+	return sp.sw.WriteChunk(pendingJSON)
+}
 
-	if err := scanner.Err(); err != nil {
-		util.Errorf("Error reading stream from upstream: %v", err)
+// finish releases any text that was held back but never turned into the finish token,
+// and returns the outcome of the stream.
+func (sp *streamProcessor) finish() (*StreamProcessingResult, error) {
+	if err := sp.flushPending(); err != nil {
 		return nil, err
 	}
+	if len(sp.fields) > 0 {
+		if err := sp.sw.WriteFields(sp.fields); err != nil {
+			return nil, err
+		}
+		sp.fields = nil
+	}
 
 	return &StreamProcessingResult{
-		IsComplete:      isComplete,
-		HasFunctionCall: hasFunctionCall,
-		AccumulatedText: textBuffer.String(),
+		IsComplete:       sp.rewriter.found(),
+		HasFunctionCall:  sp.hasFunctionCall,
+		Stalled:          sp.stalled,
+		Chunks:           sp.chunks,
+		FinishReason:     sp.finishReason,
+		BlockReason:      sp.blockReason,
+		Decision:         sp.decision(),
+		AccumulatedText:  sp.textBuffer.String(),
+		AccumulatedParts: sp.accumulatedParts,
 	}, nil
 }
 
-// ProcessNonStream checks a complete non-streaming response for the finish token.
-func ProcessNonStream(body []byte) (*StreamProcessingResult, error) {
+// decision classifies the stream. A stream that ended before its first chunk was cut off
+// rather than answered, so it is not treated as a response without candidates.
+func (sp *streamProcessor) decision() Decision {
+	hasCandidates := sp.hasCandidates || sp.chunks == 0
+	return classifyAttempt(sp.blockReason, hasCandidates, sp.finishReason, sp.rewriter.found(), sp.hasFunctionCall)
+}
+
+// ProcessNonStream checks a complete non-streaming response for the finish token and classifies
+// it by its finish reason. Errors are logged with the request of ctx.
+func ProcessNonStream(ctx context.Context, body []byte) (*StreamProcessingResult, error) {
 	var response gemini.GenerateContentResponse
 	if err := json.Unmarshal(body, &response); err != nil {
-		util.Errorf("Error unmarshalling non-stream response: %v", err)
+		util.Error(ctx, "Error unmarshalling non-stream response", "error", err)
 		return nil, &ProxyError{Message: "Failed to parse upstream response", StatusCode: http.StatusBadGateway}
 	}
 
 	var accumulatedText string
+	var accumulatedParts []gemini.Part
 	hasFunctionCall := false
+	finishReason := ""
 	if len(response.Candidates) > 0 {
+		finishReason = response.Candidates[0].FinishReason
+		accumulatedParts = AppendModelParts(nil, response.Candidates[0].Content.Parts)
 		for _, part := range response.Candidates[0].Content.Parts {
 			if part.FunctionCall != nil {
 				hasFunctionCall = true
 			}
-			accumulatedText += part.Text
+			if !part.Thought {
+				accumulatedText += part.Text
+			}
 		}
 	}
 
 	isComplete := strings.Contains(accumulatedText, gemini.FinishToken)
-	
-	// Clean the finish token from the final text for the client
-	finalText := strings.Replace(accumulatedText, gemini.FinishToken, "", -1)
 
-	// Re-assemble the response with the cleaned text
-	if len(response.Candidates) > 0 && len(response.Candidates[0].Content.Parts) > 0 {
-		// This is a simplification. It assumes the text is in the first part.
-		// A more robust implementation might need to handle multiple text parts.
-		response.Candidates[0].Content.Parts[0].Text = finalText
+	// Keep the parsed response for stitching, and clean the finish token from every
+	// candidate for the client.
+	parsed := response
+	parsed.Candidates = append([]gemini.Candidate(nil), response.Candidates...)
+	for i := range response.Candidates {
+		response.Candidates[i].Content.Parts = stripFinishToken(response.Candidates[i].Content.Parts)
 	}
 
-	finalJSON, err := json.Marshal(response)
+	// MarshalJSON is called directly so the untouched parts of the upstream body keep their exact bytes.
+	finalJSON, err := response.MarshalJSON()
 	if err != nil {
-		util.Errorf("Error re-marshalling cleaned response: %v", err)
+		util.Error(ctx, "Error re-marshalling cleaned response", "error", err)
 		return nil, &ProxyError{Message: "Failed to construct final response", StatusCode: http.StatusInternalServerError}
 	}
 
-
 	return &StreamProcessingResult{
 		IsComplete:        isComplete,
 		HasFunctionCall:   hasFunctionCall,
+		FinishReason:      finishReason,
+		BlockReason:       promptBlockReason(&response),
+		Decision:          classifyAttempt(promptBlockReason(&response), len(response.Candidates) > 0, finishReason, isComplete, hasFunctionCall),
 		AccumulatedText:   accumulatedText, // The original text with the token
+		AccumulatedParts:  accumulatedParts,
 		FinalResponseJSON: string(finalJSON),
+		Response:          &parsed,
 	}, nil
 }
 
@@ -1,8 +1,20 @@
 package proxy
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"gemini-anti-truncate-go/internal/gemini"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestInjectFinishToken(t *testing.T) {
@@ -141,4 +153,851 @@ func contains(s, substr string) bool {
 		}
 	}
 	return false
-}
\ No newline at end of file
+}
+
+func TestTokenFilter(t *testing.T) {
+	f := &tokenFilter{}
+
+	// A prefix of the token must be held back
+	if out := f.Write("Hello [RESPONSE_"); out != "Hello " {
+		t.Errorf("Expected 'Hello ', got '%s'", out)
+	}
+
+	// Completing the token removes it entirely
+	if out := f.Write("FINISHED]"); out != "" {
+		t.Errorf("Expected empty output, got '%s'", out)
+	}
+	if !f.found {
+		t.Error("Expected the finish token to be detected")
+	}
+
+	// A held prefix that turns out not to be the token is re-emitted
+	f = &tokenFilter{}
+	if out := f.Write("see [RES"); out != "see " {
+		t.Errorf("Expected 'see ', got '%s'", out)
+	}
+	if out := f.Write("ULTS]"); out != "[RESULTS]" {
+		t.Errorf("Expected '[RESULTS]', got '%s'", out)
+	}
+	if f.found {
+		t.Error("Expected no finish token to be detected")
+	}
+
+	// Flush releases whatever is still held back
+	f.Write("end [")
+	if out := f.Flush(); out != "[" {
+		t.Errorf("Expected '[', got '%s'", out)
+	}
+}
+
+func TestProcessStream_SplitFinishToken(t *testing.T) {
+	stream := `data: {"candidates": [{"content": {"parts": [{"text": "Hello world [RESPONSE_"}], "role": "model"}, "index": 0}]}
+
+data: {"candidates": [{"content": {"parts": [{"text": "FINI"}, {"text": "SHED]"}], "role": "model"}, "finishReason": "STOP", "index": 0}]}
+
+`
+	upstreamResp := &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(stream)),
+	}
+	rr := httptest.NewRecorder()
+
+	result, err := ProcessStream(rr, upstreamResp)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if !result.IsComplete {
+		t.Error("Expected stream to be complete")
+	}
+
+	body := rr.Body.String()
+	for _, fragment := range []string{"RESPONSE_", "FINI", "SHED]"} {
+		if strings.Contains(body, fragment) {
+			t.Errorf("Expected '%s' to be removed from the stream, got '%s'", fragment, body)
+		}
+	}
+	if !strings.Contains(body, "Hello world ") {
+		t.Errorf("Expected the answer text to be forwarded, got '%s'", body)
+	}
+	if !strings.Contains(body, `"finishReason":"STOP"`) {
+		t.Errorf("Expected the finishing chunk to be forwarded, got '%s'", body)
+	}
+}
+
+func TestProcessStream_KeepsChunkWhoseTextIsHeldBack(t *testing.T) {
+	stream := `data: {"candidates": [{"content": {"parts": [{"text": "[RESPONSE"}], "role": "model"}, "index": 0, "groundingMetadata": {"webSearchQueries": ["weather"]}}], "usageMetadata": {"totalTokenCount": 7}}
+
+data: {"candidates": [{"content": {"parts": [{"text": "_FINISHED]"}], "role": "model"}, "finishReason": "STOP", "index": 0}]}
+
+`
+	upstreamResp := &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(stream)),
+	}
+	rr := httptest.NewRecorder()
+
+	result, err := ProcessStream(rr, upstreamResp)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !result.IsComplete {
+		t.Error("Expected stream to be complete")
+	}
+
+	body := rr.Body.String()
+	if strings.Contains(body, "RESPONSE") {
+		t.Errorf("Expected the held-back text to be removed, got '%s'", body)
+	}
+	if !strings.Contains(body, `"usageMetadata":{"totalTokenCount":7}`) || !strings.Contains(body, `"webSearchQueries":["weather"]`) {
+		t.Errorf("Expected the other fields of the chunk to be forwarded, got '%s'", body)
+	}
+}
+
+func TestProcessStream_FlushesHeldTextBeforePassthrough(t *testing.T) {
+	stream := `data: {"candidates": [{"content": {"parts": [{"text": "Checking."}], "role": "model"}, "index": 0}, {"content": {"parts": [{"text": "Maybe ["}], "role": "model"}, "index": 1}]}
+
+data: {"candidates": [{"content": {"parts": [{"functionCall": {"name": "lookup", "args": {}}}], "role": "model"}, "index": 0}]}
+
+data: {"candidates": [{"content": {"parts": [{"text": "later"}], "role": "model"}, "index": 1}]}
+
+`
+	upstreamResp := &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(stream)),
+	}
+	rr := httptest.NewRecorder()
+
+	if _, err := ProcessStream(rr, upstreamResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	body := rr.Body.String()
+	held, later := strings.Index(body, `"text":"["`), strings.Index(body, "later")
+	if held < 0 || later < 0 || held > later {
+		t.Errorf("Expected the held-back text before the chunks forwarded after the function call, got '%s'", body)
+	}
+}
+
+func TestProcessStream_ReleasesHeldPrefix(t *testing.T) {
+	stream := `data: {"candidates": [{"content": {"parts": [{"text": "Array index a["}], "role": "model"}, "index": 0}]}
+
+data: {"candidates": [{"content": {"parts": [{"text": "0]"}], "role": "model"}, "index": 0}]}
+
+data: {"candidates": [{"content": {"parts": [{"text": " and ["}], "role": "model"}, "index": 0}]}
+
+`
+	upstreamResp := &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(stream)),
+	}
+	rr := httptest.NewRecorder()
+
+	result, err := ProcessStream(rr, upstreamResp)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if result.IsComplete {
+		t.Error("Expected stream to be incomplete")
+	}
+
+	// Reassemble the text the client saw
+	var seen string
+	for _, line := range strings.Split(rr.Body.String(), "\n") {
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var chunk gemini.GenerateContentResponse
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &chunk); err != nil {
+			t.Fatalf("Failed to parse forwarded chunk: %v", err)
+		}
+		for _, cand := range chunk.Candidates {
+			for _, part := range cand.Content.Parts {
+				seen += part.Text
+			}
+		}
+	}
+
+	if seen != "Array index a[0] and [" {
+		t.Errorf("Expected 'Array index a[0] and [', got '%s'", seen)
+	}
+	if result.AccumulatedText != "Array index a[0] and [" {
+		t.Errorf("Expected accumulated text to be unchanged, got '%s'", result.AccumulatedText)
+	}
+}
+
+func TestStitchResponses(t *testing.T) {
+	attempts := []*gemini.GenerateContentResponse{
+		{
+			Candidates: []gemini.Candidate{{
+				Content: gemini.Content{Role: "model", Parts: []gemini.Part{{Text: "The first half, "}}},
+				SafetyRatings: []gemini.SafetyRating{
+					{Category: "HARM_CATEGORY_HARASSMENT", Probability: "NEGLIGIBLE"},
+				},
+				CitationMetadata: &gemini.CitationMetadata{CitationSources: []gemini.CitationSource{
+					{StartIndex: 0, EndIndex: 5, URI: "https://example.com/a"},
+				}},
+			}},
+		},
+		{
+			Candidates: []gemini.Candidate{{
+				Content:      gemini.Content{Role: "model", Parts: []gemini.Part{{Text: "the second half.[RESPONSE_"}}},
+				FinishReason: "MAX_TOKENS",
+			}},
+		},
+		{
+			Candidates: []gemini.Candidate{{
+				Content:      gemini.Content{Role: "model", Parts: []gemini.Part{{Text: "FINISHED]"}}},
+				FinishReason: "STOP",
+				SafetyRatings: []gemini.SafetyRating{
+					{Category: "HARM_CATEGORY_HARASSMENT", Probability: "LOW"},
+					{Category: "HARM_CATEGORY_HATE_SPEECH", Probability: "NEGLIGIBLE"},
+				},
+				CitationMetadata: &gemini.CitationMetadata{CitationSources: []gemini.CitationSource{
+					{StartIndex: 0, EndIndex: 3, URI: "https://example.com/b"},
+				}},
+			}},
+		},
+	}
+
+	stitched := StitchResponses(attempts)
+
+	if len(stitched.Candidates) != 1 {
+		t.Fatalf("Expected 1 candidate, got %d", len(stitched.Candidates))
+	}
+	cand := stitched.Candidates[0]
+
+	if len(cand.Content.Parts) != 1 || cand.Content.Parts[0].Text != "The first half, the second half." {
+		t.Errorf("Expected stitched text without the finish token, got %+v", cand.Content.Parts)
+	}
+
+	if cand.FinishReason != "STOP" {
+		t.Errorf("Expected finish reason 'STOP', got '%s'", cand.FinishReason)
+	}
+
+	if len(cand.SafetyRatings) != 2 || cand.SafetyRatings[0].Probability != "LOW" {
+		t.Errorf("Expected merged safety ratings keeping the most severe probability, got %+v", cand.SafetyRatings)
+	}
+
+	if cand.CitationMetadata == nil || len(cand.CitationMetadata.CitationSources) != 2 {
+		t.Fatalf("Expected combined citation metadata, got %+v", cand.CitationMetadata)
+	}
+	second := cand.CitationMetadata.CitationSources[1]
+	if second.StartIndex != 32 || second.EndIndex != 35 {
+		t.Errorf("Expected second citation to be shifted to 32-35, got %d-%d", second.StartIndex, second.EndIndex)
+	}
+}
+
+func TestProcessNonStream_StripsTokenFromEveryPart(t *testing.T) {
+	body := `{"candidates": [{"content": {"parts": [{"text": "Part one. "}, {"text": "Part two.[RESPONSE_FINISHED]"}], "role": "model"}, "finishReason": "STOP", "index": 0}]}`
+
+	result, err := ProcessNonStream(context.Background(), []byte(body))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if !result.IsComplete {
+		t.Error("Expected response to be complete")
+	}
+
+	var response gemini.GenerateContentResponse
+	if err := json.Unmarshal([]byte(result.FinalResponseJSON), &response); err != nil {
+		t.Fatalf("Failed to parse final response: %v", err)
+	}
+	parts := response.Candidates[0].Content.Parts
+	if len(parts) != 2 || parts[0].Text != "Part one. " || parts[1].Text != "Part two." {
+		t.Errorf("Expected parts to be cleaned individually, got %+v", parts)
+	}
+
+	// The parsed response keeps the raw text for stitching
+	if result.Response.Candidates[0].Content.Parts[1].Text != "Part two.[RESPONSE_FINISHED]" {
+		t.Errorf("Expected raw response to keep the finish token, got %+v", result.Response.Candidates[0].Content.Parts)
+	}
+}
+
+// TestGoldenPatching checks that the proxy only patches the fields it touches: the
+// golden files differ from their inputs in nothing but the injected or cleaned text.
+func TestGoldenPatching(t *testing.T) {
+	input, err := os.ReadFile(filepath.Join("testdata", "request_unknown_fields.json"))
+	if err != nil {
+		t.Fatalf("Failed to read request: %v", err)
+	}
+	var req gemini.GenerateContentRequest
+	if err := json.Unmarshal(input, &req); err != nil {
+		t.Fatalf("Failed to decode request: %v", err)
+	}
+	injected, err := InjectFinishToken(&req).MarshalJSON()
+	if err != nil {
+		t.Fatalf("Failed to encode request: %v", err)
+	}
+	assertGolden(t, filepath.Join("testdata", "request_unknown_fields.injected.golden"), injected)
+
+	input, err = os.ReadFile(filepath.Join("testdata", "response_unknown_fields.json"))
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	result, err := ProcessNonStream(context.Background(), input)
+	if err != nil {
+		t.Fatalf("Failed to process response: %v", err)
+	}
+	assertGolden(t, filepath.Join("testdata", "response_unknown_fields.cleaned.golden"), []byte(result.FinalResponseJSON))
+}
+
+func assertGolden(t *testing.T, goldenFile string, got []byte) {
+	t.Helper()
+	expected, err := os.ReadFile(goldenFile)
+	if err != nil {
+		t.Fatalf("Failed to read golden file %s: %v", goldenFile, err)
+	}
+	if string(bytes.TrimRight(expected, "\n")) != string(got) {
+		t.Errorf("Output does not match %s.\nExpected: %s\nGot:      %s", goldenFile, expected, got)
+	}
+}
+
+func TestBuildRetryRequest_KeepsUnknownFields(t *testing.T) {
+	var req gemini.GenerateContentRequest
+	body := `{"contents":[{"role":"user","parts":[{"text":"Hi"}]}],"toolConfig":{"functionCallingConfig":{"mode":"ANY"}},"cachedContent":"cachedContents/abc"}`
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		t.Fatalf("Failed to decode request: %v", err)
+	}
+
+	retryBody, err := BuildRetryRequest(&req, "partial").MarshalJSON()
+	if err != nil {
+		t.Fatalf("Failed to encode retry request: %v", err)
+	}
+
+	for _, fragment := range []string{`"toolConfig":{"functionCallingConfig":{"mode":"ANY"}}`, `"cachedContent":"cachedContents/abc"`, `{"role":"user","parts":[{"text":"Hi"}]}`} {
+		if !strings.Contains(string(retryBody), fragment) {
+			t.Errorf("Expected retry request to contain '%s', got %s", fragment, retryBody)
+		}
+	}
+}
+
+func TestInjectFinishToken_NonTextLastPart(t *testing.T) {
+	req := &gemini.GenerateContentRequest{
+		Contents: []gemini.Content{
+			{
+				Role: "user",
+				Parts: []gemini.Part{
+					{Text: "What is in this picture?"},
+					{InlineData: &gemini.Blob{MIMEType: "image/png", Data: "AAAA"}},
+				},
+			},
+		},
+	}
+
+	result := InjectFinishToken(req)
+
+	parts := result.Contents[0].Parts
+	if len(parts) != 3 {
+		t.Fatalf("Expected a separate text part to be added, got %d parts", len(parts))
+	}
+	if parts[1].InlineData == nil || parts[1].Text != "" {
+		t.Errorf("Expected the image part to be left untouched, got %+v", parts[1])
+	}
+	if !contains(parts[2].Text, gemini.FinishToken) {
+		t.Errorf("Expected the new part to contain the finish token instruction, got '%s'", parts[2].Text)
+	}
+}
+
+func TestAppendModelParts(t *testing.T) {
+	var acc []gemini.Part
+	acc = AppendModelParts(acc, []gemini.Part{
+		{Text: "Thinking...", Thought: true},
+		{Text: "Here is "},
+		{Text: "the chart: "},
+		{InlineData: &gemini.Blob{MIMEType: "image/png", Data: "AAAA"}},
+	})
+	acc = AppendModelParts(acc, []gemini.Part{
+		{Text: "and the code: "},
+		{ExecutableCode: &gemini.ExecutableCode{Language: "PYTHON", Code: "print(1)"}},
+		{CodeExecutionResult: &gemini.CodeExecutionResult{Outcome: "OUTCOME_OK", Output: "1\n"}},
+		{Text: "done", ThoughtSignature: "c2ln"},
+	})
+
+	if len(acc) != 6 {
+		t.Fatalf("Expected 6 parts, got %d: %+v", len(acc), acc)
+	}
+	if acc[0].Text != "Here is the chart: " {
+		t.Errorf("Expected consecutive text to be merged, got '%s'", acc[0].Text)
+	}
+	if acc[1].InlineData == nil || acc[3].ExecutableCode == nil || acc[4].CodeExecutionResult == nil {
+		t.Errorf("Expected non-text parts to be kept in order, got %+v", acc)
+	}
+	if acc[5].ThoughtSignature != "c2ln" {
+		t.Errorf("Expected the thought signature to be kept, got %+v", acc[5])
+	}
+
+	retryReq := BuildRetryRequestWithParts(&gemini.GenerateContentRequest{
+		Contents: []gemini.Content{{Role: "user", Parts: []gemini.Part{{Text: "Plot it"}}}},
+	}, acc)
+	if modelTurn := retryReq.Contents[1]; modelTurn.Role != "model" || len(modelTurn.Parts) != 6 {
+		t.Errorf("Expected the model turn to replay all parts, got %+v", modelTurn)
+	}
+}
+
+func TestBuildRetryRequestWithParts_WithoutParts(t *testing.T) {
+	originalReq := &gemini.GenerateContentRequest{
+		Contents: []gemini.Content{{Role: "user", Parts: []gemini.Part{{Text: "Hi"}}}},
+	}
+
+	retryReq := BuildRetryRequestWithParts(originalReq, nil)
+	if len(retryReq.Contents) != 1 || retryReq.Contents[0].Role != "user" {
+		t.Errorf("Expected the original contents without an empty model turn, got %+v", retryReq.Contents)
+	}
+	if retryReq == originalReq {
+		t.Error("Expected a copy of the original request")
+	}
+}
+
+func TestStitchResponses_KeepsNonTextParts(t *testing.T) {
+	attempts := []*gemini.GenerateContentResponse{
+		{Candidates: []gemini.Candidate{{Content: gemini.Content{Parts: []gemini.Part{
+			{Text: "Before the image. "},
+			{InlineData: &gemini.Blob{MIMEType: "image/png", Data: "AAAA"}},
+		}}}}},
+		{Candidates: []gemini.Candidate{{Content: gemini.Content{Parts: []gemini.Part{
+			{Text: "After the image.[RESPONSE_FINISHED]"},
+		}}, FinishReason: "STOP"}}},
+	}
+
+	parts := StitchResponses(attempts).Candidates[0].Content.Parts
+	if len(parts) != 3 {
+		t.Fatalf("Expected 3 parts, got %d: %+v", len(parts), parts)
+	}
+	if parts[0].Text != "Before the image. " || parts[1].InlineData == nil || parts[2].Text != "After the image." {
+		t.Errorf("Expected text and image parts in their original order, got %+v", parts)
+	}
+}
+
+func TestProcessStream_JSONArray(t *testing.T) {
+	stream := "[{\n  \"candidates\": [{\"content\": {\"parts\": [{\"text\": \"Hello from the [RESPONSE\"}], \"role\": \"model\"}, \"index\": 0}]\n}\n,\r\n{\n  \"candidates\": [{\"content\": {\"parts\": [{\"text\": \"_FINISHED]\"}], \"role\": \"model\"}, \"finishReason\": \"STOP\", \"index\": 0}],\n  \"usageMetadata\": {\"totalTokenCount\": 12}\n}\n]"
+	upstreamResp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json; charset=UTF-8"}},
+		Body:       io.NopCloser(strings.NewReader(stream)),
+	}
+	rr := httptest.NewRecorder()
+
+	result, err := ProcessStream(rr, upstreamResp)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !result.IsComplete {
+		t.Error("Expected stream to be complete")
+	}
+
+	if contentType := rr.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Expected Content-Type 'application/json', got '%s'", contentType)
+	}
+
+	// The client must receive a single valid JSON array
+	var chunks []gemini.GenerateContentResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &chunks); err != nil {
+		t.Fatalf("Expected a valid JSON array, got '%s': %v", rr.Body.String(), err)
+	}
+	if len(chunks) != 2 {
+		t.Fatalf("Expected 2 chunks, got %d", len(chunks))
+	}
+	if chunks[0].Candidates[0].Content.Parts[0].Text != "Hello from the " {
+		t.Errorf("Expected the token prefix to be held back, got '%s'", chunks[0].Candidates[0].Content.Parts[0].Text)
+	}
+	if len(chunks[1].Candidates[0].Content.Parts) != 0 || chunks[1].Candidates[0].FinishReason != "STOP" {
+		t.Errorf("Expected the token to be removed from the finishing chunk, got %+v", chunks[1].Candidates[0])
+	}
+	if !strings.Contains(rr.Body.String(), `"usageMetadata":{"totalTokenCount":12}`) {
+		t.Errorf("Expected usageMetadata to be preserved, got '%s'", rr.Body.String())
+	}
+}
+
+func TestStreamWriter_SpansAttempts(t *testing.T) {
+	rr := httptest.NewRecorder()
+	sw, err := NewStreamWriter(rr, FormatJSONArray)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for _, text := range []string{"first ", "second"} {
+		stream := `data: {"candidates": [{"content": {"parts": [{"text": "` + text + `"}], "role": "model"}, "index": 0}]}` + "\n\n"
+		upstreamResp := &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+			Body:       io.NopCloser(strings.NewReader(stream)),
+		}
+		if _, err := ProcessStreamTo(sw, upstreamResp); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	sw.Close()
+
+	// SSE attempts are re-emitted in the JSON array format the client asked for
+	var chunks []gemini.GenerateContentResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &chunks); err != nil {
+		t.Fatalf("Expected a valid JSON array, got '%s': %v", rr.Body.String(), err)
+	}
+	if len(chunks) != 2 {
+		t.Errorf("Expected 2 chunks, got %d", len(chunks))
+	}
+}
+
+func TestRequestedStreamFormat(t *testing.T) {
+	if format := RequestedStreamFormat(httptest.NewRequest("POST", "/v1beta/models/m:streamGenerateContent?alt=sse", nil)); format != FormatSSE {
+		t.Errorf("Expected SSE for alt=sse, got %s", format)
+	}
+	if format := RequestedStreamFormat(httptest.NewRequest("POST", "/v1beta/models/m:streamGenerateContent", nil)); format != FormatJSONArray {
+		t.Errorf("Expected JSON array without alt=sse, got %s", format)
+	}
+}
+
+func TestClassifyCompletion(t *testing.T) {
+	testCases := []struct {
+		finishReason    string
+		tokenFound      bool
+		hasFunctionCall bool
+		expected        Decision
+	}{
+		{"STOP", true, false, DecisionComplete},
+		{"MAX_TOKENS", true, false, DecisionComplete},
+		{"", false, true, DecisionComplete},
+		{"STOP", false, false, DecisionRetry},
+		{"", false, false, DecisionRetry},
+		{"MAX_TOKENS", false, false, DecisionMaxTokens},
+		{"SAFETY", false, false, DecisionTerminal},
+		{"RECITATION", false, false, DecisionTerminal},
+		{"BLOCKLIST", false, false, DecisionTerminal},
+		{"MALFORMED_FUNCTION_CALL", false, false, DecisionError},
+		{"OTHER", false, false, DecisionError},
+		{"SOME_FUTURE_REASON", false, false, DecisionError},
+	}
+
+	for _, tc := range testCases {
+		if decision := ClassifyCompletion(tc.finishReason, tc.tokenFound, tc.hasFunctionCall); decision != tc.expected {
+			t.Errorf("For finishReason '%s' (token %v, function call %v): expected %s, got %s",
+				tc.finishReason, tc.tokenFound, tc.hasFunctionCall, tc.expected, decision)
+		}
+	}
+}
+
+func TestProcessNonStream_Decision(t *testing.T) {
+	body := `{"candidates": [{"content": {"parts": [{"text": "I cannot"}], "role": "model"}, "finishReason": "SAFETY", "index": 0}]}`
+
+	result, err := ProcessNonStream(context.Background(), []byte(body))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result.FinishReason != "SAFETY" {
+		t.Errorf("Expected finish reason 'SAFETY', got '%s'", result.FinishReason)
+	}
+	if result.Decision != DecisionTerminal {
+		t.Errorf("Expected decision %s, got %s", DecisionTerminal, result.Decision)
+	}
+}
+
+func TestProcessStream_Decision(t *testing.T) {
+	stream := `data: {"candidates": [{"content": {"parts": [{"text": "Partial"}], "role": "model"}, "index": 0}]}` + "\n\n" +
+		`data: {"candidates": [{"content": {"parts": [{"text": " answer"}], "role": "model"}, "finishReason": "MAX_TOKENS", "index": 0}]}` + "\n\n"
+	upstreamResp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+		Body:       io.NopCloser(strings.NewReader(stream)),
+	}
+
+	result, err := ProcessStream(httptest.NewRecorder(), upstreamResp)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result.FinishReason != "MAX_TOKENS" {
+		t.Errorf("Expected finish reason 'MAX_TOKENS', got '%s'", result.FinishReason)
+	}
+	if result.Decision != DecisionMaxTokens {
+		t.Errorf("Expected decision %s, got %s", DecisionMaxTokens, result.Decision)
+	}
+}
+
+func TestProcessNonStream_PromptBlocked(t *testing.T) {
+	testCases := []struct {
+		name        string
+		body        string
+		blockReason string
+	}{
+		{"block reason", `{"promptFeedback": {"blockReason": "SAFETY", "safetyRatings": [{"category": "HARM_CATEGORY_HARASSMENT", "probability": "HIGH"}]}}`, "SAFETY"},
+		{"no candidates", `{"usageMetadata": {"promptTokenCount": 3}}`, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := ProcessNonStream(context.Background(), []byte(tc.body))
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if result.Decision != DecisionBlocked {
+				t.Errorf("Expected decision %s, got %s", DecisionBlocked, result.Decision)
+			}
+			if result.BlockReason != tc.blockReason {
+				t.Errorf("Expected block reason '%s', got '%s'", tc.blockReason, result.BlockReason)
+			}
+			if result.FinalResponseJSON != tc.body {
+				t.Errorf("Expected the response to be returned unchanged, got '%s'", result.FinalResponseJSON)
+			}
+		})
+	}
+}
+
+func TestProcessStream_PromptBlocked(t *testing.T) {
+	stream := `data: {"promptFeedback": {"blockReason": "PROHIBITED_CONTENT"}, "usageMetadata": {"promptTokenCount": 3}}` + "\n\n"
+	upstreamResp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+		Body:       io.NopCloser(strings.NewReader(stream)),
+	}
+	rr := httptest.NewRecorder()
+
+	result, err := ProcessStream(rr, upstreamResp)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result.Decision != DecisionBlocked || result.BlockReason != "PROHIBITED_CONTENT" {
+		t.Errorf("Expected a blocked prompt, got decision %s with block reason '%s'", result.Decision, result.BlockReason)
+	}
+	if rr.Body.String() != stream {
+		t.Errorf("Expected the block to be forwarded unchanged, got '%s'", rr.Body.String())
+	}
+
+	// A stream that ends before its first chunk was cut off, not blocked.
+	emptyResp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+		Body:       io.NopCloser(strings.NewReader("")),
+	}
+	result, err = ProcessStream(httptest.NewRecorder(), emptyResp)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result.Decision != DecisionRetry {
+		t.Errorf("Expected decision %s for an empty stream, got %s", DecisionRetry, result.Decision)
+	}
+}
+
+func TestStreamWriter_WriteError(t *testing.T) {
+	rr := httptest.NewRecorder()
+	sw, err := NewStreamWriter(rr, FormatJSONArray)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	sw.WriteChunk([]byte(`{"candidates": [{"content": {"parts": [{"text": "Partial"}], "role": "model"}, "index": 0}]}`))
+	sw.WriteError(http.StatusGatewayTimeout, "Request failed after maximum retries", nil)
+	sw.Close()
+
+	var chunks []map[string]json.RawMessage
+	if err := json.Unmarshal(rr.Body.Bytes(), &chunks); err != nil {
+		t.Fatalf("Expected a valid JSON array, got '%s': %v", rr.Body.String(), err)
+	}
+	if len(chunks) != 2 {
+		t.Fatalf("Expected 2 chunks, got %d", len(chunks))
+	}
+	expectedError := `{"code":504,"message":"Request failed after maximum retries","status":"DEADLINE_EXCEEDED"}`
+	if string(chunks[1]["error"]) != expectedError {
+		t.Errorf("Expected error %s, got %s", expectedError, chunks[1]["error"])
+	}
+	if !strings.Contains(string(chunks[1]["candidates"]), `"finishReason":"OTHER"`) {
+		t.Errorf("Expected a synthetic finish reason, got %s", chunks[1]["candidates"])
+	}
+}
+
+func TestWatchStall(t *testing.T) {
+	// No data at all within the first-chunk timeout
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	body := WatchStall(pr, StallTimeouts{FirstChunk: 50 * time.Millisecond, Idle: time.Hour})
+	if _, err := body.Read(make([]byte, 16)); err != ErrStalled {
+		t.Errorf("Expected ErrStalled before the first chunk, got %v", err)
+	}
+
+	// Data keeps the stream alive until it stops for longer than the idle timeout
+	pr, pw = io.Pipe()
+	defer pw.Close()
+	body = WatchStall(pr, StallTimeouts{FirstChunk: time.Hour, Idle: 100 * time.Millisecond})
+	go func() {
+		for i := 0; i < 3; i++ {
+			pw.Write([]byte("data"))
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
+	received, err := io.ReadAll(body)
+	if err != ErrStalled || string(received) != "datadatadata" {
+		t.Errorf("Expected ErrStalled after all data, got '%s' and %v", received, err)
+	}
+
+	// A closed body is no longer watched
+	body = WatchStall(io.NopCloser(strings.NewReader("data")), StallTimeouts{Idle: 10 * time.Millisecond})
+	body.Close()
+	time.Sleep(30 * time.Millisecond)
+	if received, err := io.ReadAll(body); err != nil || string(received) != "data" {
+		t.Errorf("Expected the data of a closed body, got '%s' and %v", received, err)
+	}
+}
+
+func TestProcessStream_Stalled(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go fmt.Fprint(pw, `data: {"candidates": [{"content": {"parts": [{"text": "Half an answer"}], "role": "model"}, "index": 0}]}`+"\n\n")
+
+	upstreamResp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+		Body:       WatchStall(pr, StallTimeouts{Idle: 50 * time.Millisecond}),
+	}
+	rr := httptest.NewRecorder()
+	result, err := ProcessStream(rr, upstreamResp)
+	if err != nil {
+		t.Fatalf("Expected a stall not to be an error, got %v", err)
+	}
+	if !result.Stalled || result.Decision != DecisionRetry || result.AccumulatedText != "Half an answer" {
+		t.Errorf("Expected a truncated result with the text so far, got %+v", result)
+	}
+	if !strings.Contains(rr.Body.String(), "Half an answer") {
+		t.Errorf("Expected the chunk to be forwarded, got '%s'", rr.Body.String())
+	}
+}
+
+func TestSSEReader(t *testing.T) {
+	stream := "\xEF\xBB\xBF: keep-alive\r\n\r\n" +
+		"event: message\r\nid: 1\r\ndata: {\"a\":\r\ndata:1}\r\n\r\n" +
+		"retry: 1000\rdata\rdata: x\r\r" +
+		"\n\n" +
+		"data: incomplete"
+	reader := newSSEReader(strings.NewReader(stream))
+
+	expected := []sseEvent{
+		{Fields: []string{": keep-alive"}},
+		{Fields: []string{"event: message", "id: 1"}, Data: []byte("{\"a\":\n1}"), HasData: true},
+		{Fields: []string{"retry: 1000"}, Data: []byte("\nx"), HasData: true},
+	}
+	for _, want := range expected {
+		event, err := reader.Next()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if strings.Join(event.Fields, "|") != strings.Join(want.Fields, "|") || string(event.Data) != string(want.Data) || event.HasData != want.HasData {
+			t.Errorf("Expected %+v, got %+v", want, event)
+		}
+	}
+	// The event that was not ended is dropped
+	if event, err := reader.Next(); err != io.EOF {
+		t.Errorf("Expected io.EOF, got %+v and %v", event, err)
+	}
+}
+
+func TestProcessStream_LongEvents(t *testing.T) {
+	// A single data line far beyond the 64KB line limit of bufio.Scanner
+	longText := strings.Repeat("a", 256*1024)
+	stream := ": ping\n\n" +
+		"event: message\nid: 7\n" +
+		`data: {"candidates": [{"content": {"parts": [{"text": "` + longText + `"}], "role": "model"}, "index": 0}]}` + "\n\n" +
+		"data: {\"candidates\": [{\"content\": {\"parts\": [{\"text\": \"[RESPONSE_FINISHED]\"}],\n" +
+		"data: \"role\": \"model\"}, \"finishReason\": \"STOP\", \"index\": 0}]}\n\n"
+	upstreamResp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+		Body:       io.NopCloser(strings.NewReader(stream)),
+	}
+
+	rr := httptest.NewRecorder()
+	result, err := ProcessStream(rr, upstreamResp)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result.Decision != DecisionComplete || result.AccumulatedText != longText+"[RESPONSE_FINISHED]" {
+		t.Errorf("Expected a complete answer with the long text, got decision %s and %d bytes", result.Decision, len(result.AccumulatedText))
+	}
+
+	events := strings.Split(strings.TrimSuffix(rr.Body.String(), "\n\n"), "\n\n")
+	if len(events) != 3 || events[0] != ": ping" {
+		t.Fatalf("Expected the keep-alive and 2 events, got %d: %.200q", len(events), events)
+	}
+	if !strings.HasPrefix(events[1], "event: message\nid: 7\ndata: ") || !strings.Contains(events[1], longText) {
+		t.Errorf("Expected the long event to be forwarded intact, got %.200q", events[1])
+	}
+	if strings.Count(events[2], "\n") != 0 || !strings.HasPrefix(events[2], "data: ") {
+		t.Errorf("Expected the multi-line event as a single data line, got %q", events[2])
+	}
+}
+
+// failingWriter is a ResponseWriter whose writes fail, like those to a client that went away.
+type failingWriter struct {
+	*httptest.ResponseRecorder
+}
+
+// Write always fails.
+func (fw failingWriter) Write(p []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+func TestProcessStream_StopsWhenClientDisconnects(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	written := make(chan error, 1)
+	go func() {
+		_, err := fmt.Fprint(pw, `data: {"candidates": [{"content": {"parts": [{"text": "Part one"}], "role": "model"}, "index": 0}]}`+"\n\n")
+		if err == nil {
+			// The processor must not wait for more
+			_, err = fmt.Fprint(pw, "data: {}\n\n")
+		}
+		written <- err
+	}()
+
+	sw, err := NewStreamWriter(failingWriter{httptest.NewRecorder()}, FormatSSE)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	upstreamResp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+		Body:       pr,
+	}
+	if _, err := ProcessStreamTo(sw, upstreamResp); !errors.Is(err, ErrClientDisconnected) {
+		t.Fatalf("Expected ErrClientDisconnected, got %v", err)
+	}
+	pr.Close()
+	if err := <-written; err == nil {
+		t.Error("Expected the upstream stream to be abandoned after the failed write")
+	}
+	if err := sw.WriteChunk([]byte("{}")); !errors.Is(err, ErrClientDisconnected) {
+		t.Errorf("Expected later writes to fail too, got %v", err)
+	}
+}
+
+// unwrappingWriter wraps a ResponseWriter without flushing it itself.
+type unwrappingWriter struct {
+	http.ResponseWriter
+}
+
+func (uw unwrappingWriter) Unwrap() http.ResponseWriter {
+	return uw.ResponseWriter
+}
+
+func TestStreamWriter_FlushesThroughWrappers(t *testing.T) {
+	rr := httptest.NewRecorder()
+	sw, err := NewStreamWriter(unwrappingWriter{unwrappingWriter{rr}}, FormatSSE)
+	if err != nil {
+		t.Fatalf("Expected a wrapped flusher to be found, got %v", err)
+	}
+	if err := sw.WriteChunk([]byte("{}")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !rr.Flushed {
+		t.Error("Expected the wrapped writer to be flushed")
+	}
+
+	if _, err := NewStreamWriter(unwrappingWriter{nonFlushingWriter{}}, FormatSSE); err == nil {
+		t.Error("Expected an error for a writer that cannot flush")
+	}
+}
+
+// nonFlushingWriter is a ResponseWriter that does not support flushing.
+type nonFlushingWriter struct{}
+
+func (nonFlushingWriter) Header() http.Header         { return http.Header{} }
+func (nonFlushingWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (nonFlushingWriter) WriteHeader(int)             {}
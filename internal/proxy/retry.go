@@ -6,26 +6,29 @@ import "gemini-anti-truncate-go/internal/gemini"
 // It takes the original request and the partial response text, and constructs a new request
 // that instructs the model to continue from where it left off.
 func BuildRetryRequest(originalReq *gemini.GenerateContentRequest, partialResponseText string) *gemini.GenerateContentRequest {
-	// Create a new request object to avoid modifying the original.
-	retryReq := &gemini.GenerateContentRequest{
-		// Copy essential fields from the original request.
-		SystemInstruction:  originalReq.SystemInstruction,
-		SystemInstruction_: originalReq.SystemInstruction_,
-		GenerationConfig:   originalReq.GenerationConfig,
-		SafetySettings:     originalReq.SafetySettings,
-		Tools:              originalReq.Tools,
-		// Deep copy the contents to avoid slice modification issues.
-		Contents: make([]gemini.Content, len(originalReq.Contents)),
-	}
+	return BuildRetryRequestWithParts(originalReq, []gemini.Part{{Text: partialResponseText}})
+}
+
+// BuildRetryRequestWithParts is like BuildRetryRequest, but replays the complete partial model
+// turn, including non-text parts such as generated images, executed code and thought signatures.
+// Without partial parts there is nothing to continue from, so no empty model turn is added and
+// a copy of the original request is returned.
+func BuildRetryRequestWithParts(originalReq *gemini.GenerateContentRequest, partialResponseParts []gemini.Part) *gemini.GenerateContentRequest {
+	// Copy the original request so that every field, including the ones the proxy does not
+	// model, is carried over. Deep copy the contents to avoid slice modification issues.
+	retryReq := *originalReq
+	retryReq.Contents = make([]gemini.Content, len(originalReq.Contents))
 	copy(retryReq.Contents, originalReq.Contents)
 
+	if len(partialResponseParts) == 0 {
+		return &retryReq
+	}
+
 	// 1. Add the model's partial response to the conversation history.
 	// This provides context for the continuation.
 	modelContent := gemini.Content{
-		Role: "model",
-		Parts: []gemini.Part{
-			{Text: partialResponseText},
-		},
+		Role:  "model",
+		Parts: partialResponseParts,
 	}
 	retryReq.Contents = append(retryReq.Contents, modelContent)
 
@@ -38,5 +41,29 @@ func BuildRetryRequest(originalReq *gemini.GenerateContentRequest, partialRespon
 	}
 	retryReq.Contents = append(retryReq.Contents, userPrompt)
 
-	return retryReq
+	return &retryReq
+}
+
+// AppendModelParts appends the parts of a (partial) model turn to the parts accumulated so far.
+// Consecutive plain text parts are merged, thought text is dropped as it is not part of the
+// answer, and every other part is kept in order.
+func AppendModelParts(accumulated []gemini.Part, parts []gemini.Part) []gemini.Part {
+	for _, part := range parts {
+		switch {
+		case part.IsText() && part.Thought:
+			continue
+		case part.IsText():
+			if part.Text == "" {
+				continue
+			}
+			if last := len(accumulated) - 1; last >= 0 && accumulated[last].IsText() && !accumulated[last].Thought {
+				accumulated[last] = gemini.Part{Text: accumulated[last].Text + part.Text}
+				continue
+			}
+			accumulated = append(accumulated, gemini.Part{Text: part.Text})
+		default:
+			accumulated = append(accumulated, part)
+		}
+	}
+	return accumulated
 }
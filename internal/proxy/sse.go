@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// sseEvent is one event of a server-sent events stream.
+type sseEvent struct {
+	// Fields are the lines of the event other than data, such as event, id and retry fields
+	// and comments, as received.
+	Fields []string
+	// Data is the value of the data fields, joined with newlines.
+	Data    []byte
+	HasData bool
+}
+
+// sseReader reads the events of a server-sent events stream as specified by the HTML standard:
+// lines end with CRLF, LF or a lone CR, a blank line ends an event, the values of several data
+// fields are joined with newlines, and an event that is not ended before the stream
+// ends is dropped. Lines may be of any length.
+type sseReader struct {
+	br      *bufio.Reader
+	line    []byte
+	skipLF  bool // The previous line ended with a CR, which may be followed by an LF
+	started bool
+}
+
+// newSSEReader creates a reader for an SSE stream.
+func newSSEReader(r io.Reader) *sseReader {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &sseReader{br: br}
+}
+
+// Next returns the next event, or io.EOF once the stream ended. Events without any field,
+// such as the blank lines between events, are skipped.
+func (sr *sseReader) Next() (*sseEvent, error) {
+	event := &sseEvent{}
+	var data bytes.Buffer
+	for {
+		line, err := sr.readLine()
+		if err != nil {
+			// An incomplete last line or event is discarded
+			return nil, err
+		}
+
+		if len(line) == 0 {
+			if !event.HasData && len(event.Fields) == 0 {
+				continue
+			}
+			event.Data = data.Bytes()
+			return event, nil
+		}
+
+		name, value, _ := bytes.Cut(line, []byte(":"))
+		if !bytes.Equal(name, []byte("data")) {
+			// Comments start with a colon, so they have an empty name
+			event.Fields = append(event.Fields, string(line))
+			continue
+		}
+		value = bytes.TrimPrefix(value, []byte(" "))
+		if event.HasData {
+			data.WriteByte('\n')
+		}
+		data.Write(value)
+		event.HasData = true
+	}
+}
+
+// readLine returns the next line without its terminator. The line is only valid until the next
+// call. A byte order mark at the start of the stream is dropped.
+func (sr *sseReader) readLine() ([]byte, error) {
+	if sr.skipLF {
+		sr.skipLF = false
+		if next, err := sr.br.Peek(1); err == nil && next[0] == '\n' {
+			sr.br.Discard(1)
+		}
+	}
+	if !sr.started {
+		sr.started = true
+		if bom, err := sr.br.Peek(3); err == nil && bytes.Equal(bom, []byte("\xEF\xBB\xBF")) {
+			sr.br.Discard(3)
+		}
+	}
+
+	sr.line = sr.line[:0]
+	for {
+		if sr.br.Buffered() == 0 {
+			if _, err := sr.br.Peek(1); err != nil {
+				return nil, err
+			}
+		}
+		buffered, _ := sr.br.Peek(sr.br.Buffered())
+		if i := bytes.IndexAny(buffered, "\r\n"); i >= 0 {
+			sr.line = append(sr.line, buffered[:i]...)
+			sr.skipLF = buffered[i] == '\r'
+			sr.br.Discard(i + 1)
+			return sr.line, nil
+		}
+		sr.line = append(sr.line, buffered...)
+		sr.br.Discard(len(buffered))
+	}
+}
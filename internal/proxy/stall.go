@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrStalled is returned by the reads of a watched stream body once the upstream stopped
+// sending data for longer than allowed.
+var ErrStalled = errors.New("upstream stream stalled")
+
+// StallTimeouts bound the silences of an upstream stream. A zero timeout disables the limit.
+type StallTimeouts struct {
+	FirstChunk time.Duration // Until the first data arrives
+	Idle       time.Duration // Between two reads that return data
+}
+
+// stallReader aborts a stream body that goes silent by closing it, which unblocks a pending read.
+type stallReader struct {
+	body     io.ReadCloser
+	timeouts StallTimeouts
+	timer    *time.Timer
+
+	mu      sync.Mutex
+	stalled bool
+	done    bool
+}
+
+// WatchStall wraps an upstream stream body so that it fails with ErrStalled when no data arrives
+// within the first-chunk timeout, or within the idle timeout of the previous data. The connection
+// stays open otherwise, however long the answer takes. Closing the returned body stops the watch.
+func WatchStall(body io.ReadCloser, timeouts StallTimeouts) io.ReadCloser {
+	if timeouts.FirstChunk <= 0 && timeouts.Idle <= 0 {
+		return body
+	}
+	sr := &stallReader{body: body, timeouts: timeouts}
+	sr.timer = time.AfterFunc(time.Hour, sr.stall)
+	sr.restart(timeouts.FirstChunk)
+	return sr
+}
+
+// restart sets the timer to the given timeout, or stops it if the limit is disabled.
+func (sr *stallReader) restart(timeout time.Duration) {
+	sr.timer.Stop()
+	if timeout > 0 {
+		sr.timer.Reset(timeout)
+	}
+}
+
+// stall aborts the stream when the timer fires before data arrived.
+func (sr *stallReader) stall() {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	if sr.done {
+		return
+	}
+	sr.stalled = true
+	sr.body.Close()
+}
+
+// Read reads from the body and restarts the idle timeout whenever data arrives.
+func (sr *stallReader) Read(p []byte) (int, error) {
+	n, err := sr.body.Read(p)
+
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	if sr.stalled {
+		return 0, ErrStalled
+	}
+	if n > 0 && !sr.done {
+		sr.restart(sr.timeouts.Idle)
+	}
+	return n, err
+}
+
+// Close stops the watch and closes the body.
+func (sr *stallReader) Close() error {
+	sr.mu.Lock()
+	sr.done = true
+	sr.timer.Stop()
+	sr.mu.Unlock()
+	return sr.body.Close()
+}
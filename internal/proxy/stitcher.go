@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"gemini-anti-truncate-go/internal/gemini"
+	"strings"
+)
+
+// safetyProbabilityRank orders the HarmProbability values so that merged ratings keep the most severe one.
+var safetyProbabilityRank = map[string]int{
+	"HARM_PROBABILITY_UNSPECIFIED": 0,
+	"NEGLIGIBLE":                   1,
+	"LOW":                          2,
+	"MEDIUM":                       3,
+	"HIGH":                         4,
+}
+
+// StitchResponses merges the responses of successive continuation attempts into a single response.
+// The first candidate of every attempt contributes to the result: answer and thought text are
+// concatenated (with the finish token stripped, even when it was split between attempts), other
+// parts such as images, code or function calls keep their position, the finish reason is taken from the last attempt,
+// safety ratings are merged per category and citation offsets are shifted onto the stitched text.
+// Everything else, including fields the proxy does not model such as usageMetadata, is taken
+// from the last attempt.
+func StitchResponses(attempts []*gemini.GenerateContentResponse) *gemini.GenerateContentResponse {
+	stitched := &gemini.GenerateContentResponse{}
+	var base gemini.Candidate
+	for _, attempt := range attempts {
+		if attempt == nil {
+			continue
+		}
+		*stitched = *attempt
+		if len(attempt.Candidates) > 0 {
+			base = attempt.Candidates[0]
+		}
+	}
+	if len(attempts) > 0 && attempts[0] != nil {
+		stitched.PromptFeedback = attempts[0].PromptFeedback
+	}
+	// A continuation whose prompt was blocked ends the answer, and the client should know why.
+	for _, attempt := range attempts {
+		if attempt != nil && promptBlockReason(attempt) != "" {
+			stitched.PromptFeedback = attempt.PromptFeedback
+		}
+	}
+
+	var thought strings.Builder
+	textFilter, thoughtFilter := &tokenFilter{}, &tokenFilter{}
+	var parts []gemini.Part
+	var citations []gemini.CitationSource
+	var ratings []gemini.SafetyRating
+	finishReason := ""
+	textLen := 0
+
+	for _, attempt := range attempts {
+		if attempt == nil || len(attempt.Candidates) == 0 {
+			continue
+		}
+		cand := attempt.Candidates[0]
+
+		// Citation indexes refer to the text of this attempt, so shift them by what came before.
+		if cand.CitationMetadata != nil {
+			for _, source := range cand.CitationMetadata.CitationSources {
+				source.StartIndex += textLen
+				source.EndIndex += textLen
+				citations = append(citations, source)
+			}
+		}
+
+		for _, part := range cand.Content.Parts {
+			switch {
+			case part.Thought && part.IsText():
+				thought.WriteString(thoughtFilter.Write(part.Text))
+			case part.IsText():
+				text := textFilter.Write(part.Text)
+				textLen += len(text)
+				parts = AppendModelParts(parts, []gemini.Part{{Text: text}})
+			default:
+				// Non-text parts keep their position; text cannot span them, so release anything held back.
+				held := textFilter.Flush()
+				textLen += len(held)
+				parts = AppendModelParts(parts, []gemini.Part{{Text: held}})
+				if part.Text != "" {
+					part.Text = strings.ReplaceAll(part.Text, gemini.FinishToken, "")
+					textLen += len(part.Text)
+				}
+				parts = append(parts, part)
+			}
+		}
+
+		ratings = mergeSafetyRatings(ratings, cand.SafetyRatings)
+		if cand.FinishReason != "" {
+			finishReason = cand.FinishReason
+		}
+	}
+	thought.WriteString(thoughtFilter.Flush())
+	parts = AppendModelParts(parts, []gemini.Part{{Text: textFilter.Flush()}})
+
+	if thought.Len() > 0 {
+		parts = append([]gemini.Part{{Text: thought.String(), Thought: true}}, parts...)
+	}
+
+	cand := base
+	cand.Content.Parts = parts
+	if cand.Content.Role == "" {
+		cand.Content.Role = "model"
+	}
+	cand.FinishReason = finishReason
+	cand.Index = 0
+	cand.SafetyRatings = ratings
+	cand.CitationMetadata = nil
+	if len(citations) > 0 {
+		cand.CitationMetadata = &gemini.CitationMetadata{CitationSources: citations}
+	}
+	stitched.Candidates = []gemini.Candidate{cand}
+
+	return stitched
+}
+
+// mergeSafetyRatings folds the ratings of another attempt into the merged list,
+// keeping the most severe probability for each category in first-seen order.
+func mergeSafetyRatings(merged, ratings []gemini.SafetyRating) []gemini.SafetyRating {
+	for _, rating := range ratings {
+		found := false
+		for i := range merged {
+			if merged[i].Category == rating.Category {
+				found = true
+				if safetyProbabilityRank[rating.Probability] > safetyProbabilityRank[merged[i].Probability] {
+					merged[i].Probability = rating.Probability
+				}
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, rating)
+		}
+	}
+	return merged
+}
+
+// stripFinishToken removes the finish token from the text parts of a complete candidate.
+// Text parts left empty by the removal are dropped.
+func stripFinishToken(parts []gemini.Part) []gemini.Part {
+	filters := map[bool]*tokenFilter{false: {}, true: {}}
+	lastText := map[bool]int{false: -1, true: -1}
+	cleaned := make([]gemini.Part, 0, len(parts))
+
+	for _, part := range parts {
+		if part.Text == "" {
+			cleaned = append(cleaned, part)
+			continue
+		}
+		part.Text = filters[part.Thought].Write(part.Text)
+		// A part that also carries data (e.g. a thought signature) is kept without its text.
+		if part.Text == "" && part.IsText() {
+			continue
+		}
+		cleaned = append(cleaned, part)
+		lastText[part.Thought] = len(cleaned) - 1
+	}
+
+	// The response is complete, so any held-back prefix is plain text.
+	for _, thought := range []bool{true, false} {
+		held := filters[thought].Flush()
+		if held == "" {
+			continue
+		}
+		if i := lastText[thought]; i >= 0 {
+			cleaned[i].Text += held
+		} else {
+			cleaned = append(cleaned, gemini.Part{Text: held, Thought: thought})
+		}
+	}
+
+	return cleaned
+}
@@ -0,0 +1,295 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gemini-anti-truncate-go/internal/gemini"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// StreamFormat is the wire format of a streamGenerateContent response.
+type StreamFormat int
+
+const (
+	// FormatSSE is the server-sent events format returned for ?alt=sse.
+	FormatSSE StreamFormat = iota
+	// FormatJSONArray is the default format: a single JSON array whose elements arrive incrementally.
+	FormatJSONArray
+)
+
+// String returns a short name for the format, used in logs.
+func (f StreamFormat) String() string {
+	if f == FormatJSONArray {
+		return "json-array"
+	}
+	return "sse"
+}
+
+// RequestedStreamFormat returns the format the client asked for. Like the Gemini API,
+// the proxy answers with SSE only when the request carries alt=sse.
+func RequestedStreamFormat(r *http.Request) StreamFormat {
+	if strings.EqualFold(r.URL.Query().Get("alt"), "sse") {
+		return FormatSSE
+	}
+	return FormatJSONArray
+}
+
+// detectStreamFormat determines the format of an upstream stream from its Content-Type,
+// falling back to the first non-whitespace byte of the body when the header is missing.
+func detectStreamFormat(upstreamResp *http.Response, body *bufio.Reader) StreamFormat {
+	contentType := upstreamResp.Header.Get("Content-Type")
+	switch {
+	case strings.HasPrefix(contentType, "text/event-stream"):
+		return FormatSSE
+	case strings.HasPrefix(contentType, "application/json"):
+		return FormatJSONArray
+	}
+
+	for n := 1; ; n++ {
+		peeked, err := body.Peek(n)
+		if len(peeked) < n || err != nil {
+			return FormatSSE
+		}
+		switch peeked[n-1] {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '[':
+			return FormatJSONArray
+		default:
+			return FormatSSE
+		}
+	}
+}
+
+// ErrClientDisconnected is returned by the writes of a StreamWriter once writing to the client
+// failed, which means that the client went away.
+var ErrClientDisconnected = errors.New("client disconnected")
+
+// StreamWriter writes response chunks to the client in the requested format.
+// It lives for the whole client response, so the chunks of several upstream attempts
+// end up in a single SSE stream or a single JSON array.
+type StreamWriter struct {
+	w       http.ResponseWriter
+	rc      *http.ResponseController
+	format  StreamFormat
+	started bool
+	closed  bool
+	chunks  int
+	err     error // The first failed write, after which nothing more is written
+}
+
+// NewStreamWriter creates a StreamWriter. The ResponseWriter, or one it wraps, must support flushing.
+func NewStreamWriter(w http.ResponseWriter, format StreamFormat) (*StreamWriter, error) {
+	if !canFlush(w) {
+		return nil, &ProxyError{Message: "Streaming unsupported", StatusCode: http.StatusInternalServerError}
+	}
+	return &StreamWriter{w: w, rc: http.NewResponseController(w), format: format}, nil
+}
+
+// canFlush reports whether w supports flushing, looking through the ResponseWriters it wraps the
+// way http.ResponseController does.
+func canFlush(w http.ResponseWriter) bool {
+	for {
+		switch t := w.(type) {
+		case http.Flusher, interface{ FlushError() error }:
+			return true
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = t.Unwrap()
+		default:
+			return false
+		}
+	}
+}
+
+// Format returns the format the writer produces.
+func (sw *StreamWriter) Format() StreamFormat {
+	return sw.format
+}
+
+// start sends the response headers (and the opening bracket of a JSON array) on first use.
+func (sw *StreamWriter) start() {
+	if sw.started {
+		return
+	}
+	sw.started = true
+
+	if sw.format == FormatSSE {
+		// Set client headers for SSE
+		sw.w.Header().Set("Content-Type", "text/event-stream")
+		sw.w.Header().Set("Cache-Control", "no-cache")
+		sw.w.Header().Set("Connection", "keep-alive")
+		return
+	}
+	sw.w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(sw.w, "[")
+}
+
+// WriteChunk sends a single JSON response chunk and flushes it to the client.
+func (sw *StreamWriter) WriteChunk(data []byte) error {
+	return sw.WriteEvent(nil, data)
+}
+
+// WriteEvent sends a single JSON response chunk with the other fields of the SSE event it came
+// in, such as event, id and retry fields and comments, and flushes it to the client. The fields
+// are dropped for JSON array output, which has no equivalent.
+func (sw *StreamWriter) WriteEvent(fields []string, data []byte) error {
+	if sw.err != nil {
+		return sw.err
+	}
+	sw.start()
+
+	var err error
+	if sw.format == FormatSSE {
+		for _, field := range fields {
+			fmt.Fprintf(sw.w, "%s\n", field)
+		}
+		// An SSE data line cannot contain newlines: JSON is compacted, anything else is sent
+		// as several data lines, which the client joins again.
+		if bytes.ContainsAny(data, "\r\n") {
+			var compacted bytes.Buffer
+			if json.Compact(&compacted, data) == nil {
+				data = compacted.Bytes()
+			}
+		}
+		for _, line := range dataLines(data) {
+			fmt.Fprintf(sw.w, "data: %s\n", line)
+		}
+		_, err = fmt.Fprint(sw.w, "\n")
+	} else {
+		if sw.chunks > 0 {
+			fmt.Fprint(sw.w, ",\r\n")
+		}
+		_, err = sw.w.Write(data)
+	}
+	sw.chunks++
+	return sw.flush(err)
+}
+
+// dataLines splits the data of an SSE event at its line breaks.
+func dataLines(data []byte) [][]byte {
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	data = bytes.ReplaceAll(data, []byte("\r"), []byte("\n"))
+	return bytes.Split(data, []byte("\n"))
+}
+
+// WriteFields forwards an SSE event without data, such as a keep-alive comment, unchanged.
+// It is a no-op for JSON array output, which has no equivalent.
+func (sw *StreamWriter) WriteFields(fields []string) error {
+	if sw.format != FormatSSE || sw.err != nil {
+		return sw.err
+	}
+	sw.start()
+	for _, field := range fields {
+		fmt.Fprintf(sw.w, "%s\n", field)
+	}
+	_, err := fmt.Fprint(sw.w, "\n")
+	return sw.flush(err)
+}
+
+// flush sends what was written to the client. A failed write, or a flush that fails because the
+// connection is gone, is kept as the error of all further writes.
+func (sw *StreamWriter) flush(err error) error {
+	if err == nil {
+		err = sw.rc.Flush()
+	}
+	if err != nil {
+		sw.err = fmt.Errorf("%w: %v", ErrClientDisconnected, err)
+	}
+	return sw.err
+}
+
+// Started reports whether anything has been written to the client yet.
+func (sw *StreamWriter) Started() bool {
+	return sw.started
+}
+
+// Close terminates the response. For a JSON array it writes the closing bracket;
+// nothing is written if the stream never started.
+func (sw *StreamWriter) Close() error {
+	if !sw.started || sw.closed || sw.format != FormatJSONArray || sw.err != nil {
+		return sw.err
+	}
+	sw.closed = true
+	_, err := fmt.Fprint(sw.w, "]")
+	return sw.flush(err)
+}
+
+// WriteError ends the stream with a chunk that carries a Gemini-style error object and the
+// synthetic finish reason OTHER, so that the client can tell a failed answer from a finished
+// one. If upstreamBody is a Gemini error response its error object is used as it is; otherwise
+// one is built from code and message.
+func (sw *StreamWriter) WriteError(code int, message string, upstreamBody []byte) error {
+	var upstreamError struct {
+		Error json.RawMessage `json:"error"`
+	}
+	var errorObject json.RawMessage
+	if json.Unmarshal(upstreamBody, &upstreamError) == nil && bytes.HasPrefix(upstreamError.Error, []byte("{")) {
+		errorObject = upstreamError.Error
+	} else {
+		var apiError gemini.ErrorResponse
+		apiError.Error.Code = code
+		apiError.Error.Message = message
+		apiError.Error.Status = gemini.StatusName(code)
+		errorObject, _ = json.Marshal(apiError.Error)
+	}
+
+	chunk := struct {
+		Candidates []gemini.Candidate `json:"candidates"`
+		Error      json.RawMessage    `json:"error"`
+	}{
+		Candidates: []gemini.Candidate{{
+			Content:      gemini.Content{Parts: []gemini.Part{}, Role: "model"},
+			FinishReason: gemini.FinishReasonOther,
+		}},
+		Error: errorObject,
+	}
+	data, err := json.Marshal(chunk)
+	if err != nil {
+		return err
+	}
+	return sw.WriteChunk(data)
+}
+
+// jsonArrayReader decodes the elements of a streamed JSON array one at a time,
+// as soon as each element is complete.
+type jsonArrayReader struct {
+	dec     *json.Decoder
+	started bool
+}
+
+// newJSONArrayReader creates a reader for a JSON array stream.
+func newJSONArrayReader(r io.Reader) *jsonArrayReader {
+	return &jsonArrayReader{dec: json.NewDecoder(r)}
+}
+
+// Next returns the raw bytes of the next array element, or io.EOF after the closing bracket.
+func (jr *jsonArrayReader) Next() (json.RawMessage, error) {
+	if !jr.started {
+		jr.started = true
+		token, err := jr.dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		if delim, ok := token.(json.Delim); !ok || delim != '[' {
+			return nil, fmt.Errorf("expected JSON array stream, got %v", token)
+		}
+	}
+
+	if !jr.dec.More() {
+		if _, err := jr.dec.Token(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+
+	var element json.RawMessage
+	if err := jr.dec.Decode(&element); err != nil {
+		return nil, err
+	}
+	return element, nil
+}
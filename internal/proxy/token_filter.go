@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"gemini-anti-truncate-go/internal/gemini"
+	"sort"
+	"strings"
+)
+
+// tokenFilter strips the finish token from a sequence of text fragments.
+// Any trailing text that could still be the beginning of the token is held back
+// until a later fragment (or Flush) disambiguates it, so a token that is split
+// across chunks never reaches the client.
+type tokenFilter struct {
+	held  string
+	found bool
+}
+
+// Write feeds the next fragment into the filter and returns the text that is safe to emit.
+func (f *tokenFilter) Write(text string) string {
+	buf := f.held + text
+	// Removing one token can join two halves into a new one, so loop until none are left.
+	for strings.Contains(buf, gemini.FinishToken) {
+		f.found = true
+		buf = strings.ReplaceAll(buf, gemini.FinishToken, "")
+	}
+
+	n := tokenPrefixSuffixLen(buf)
+	f.held = buf[len(buf)-n:]
+	return buf[:len(buf)-n]
+}
+
+// Flush returns the held-back text once no further fragment can complete the token.
+func (f *tokenFilter) Flush() string {
+	held := f.held
+	f.held = ""
+	return held
+}
+
+// tokenPrefixSuffixLen returns the length of the longest suffix of s that is a
+// proper prefix of the finish token. The token is ASCII, so the cut is always
+// on a rune boundary.
+func tokenPrefixSuffixLen(s string) int {
+	n := len(gemini.FinishToken) - 1
+	if len(s) < n {
+		n = len(s)
+	}
+	for ; n > 0; n-- {
+		if strings.HasPrefix(gemini.FinishToken, s[len(s)-n:]) {
+			return n
+		}
+	}
+	return 0
+}
+
+// filterKey identifies an independent text stream within a response: each
+// candidate has its own answer text and its own thought text.
+type filterKey struct {
+	index   int
+	thought bool
+}
+
+// streamRewriter removes the finish token from the text parts of streamed chunks.
+// It keeps one tokenFilter per candidate and text kind, so a token is detected
+// even when it spans chunk or part boundaries, and is never confused by the
+// interleaved output of other candidates.
+type streamRewriter struct {
+	filters map[filterKey]*tokenFilter
+}
+
+// newStreamRewriter creates a rewriter with no pending state.
+func newStreamRewriter() *streamRewriter {
+	return &streamRewriter{filters: make(map[filterKey]*tokenFilter)}
+}
+
+// filter returns the tokenFilter for the given key, creating it on first use.
+func (sr *streamRewriter) filter(key filterKey) *tokenFilter {
+	f, ok := sr.filters[key]
+	if !ok {
+		f = &tokenFilter{}
+		sr.filters[key] = f
+	}
+	return f
+}
+
+// found reports whether the finish token has been seen in the answer text of the first candidate.
+func (sr *streamRewriter) found() bool {
+	f, ok := sr.filters[filterKey{index: 0}]
+	return ok && f.found
+}
+
+// rewrite strips the finish token from every text part of the chunk in place and reports
+// whether the chunk was modified. A chunk whose text is all held back is still sent without it,
+// as it may carry other fields, such as usageMetadata or groundingMetadata.
+func (sr *streamRewriter) rewrite(chunk *gemini.GenerateContentResponse) (changed bool) {
+	for ci := range chunk.Candidates {
+		cand := &chunk.Candidates[ci]
+		parts := make([]gemini.Part, 0, len(cand.Content.Parts))
+		candHasFunctionCall := false
+
+		for _, part := range cand.Content.Parts {
+			if part.FunctionCall != nil {
+				candHasFunctionCall = true
+			}
+			if part.Text == "" {
+				parts = append(parts, part)
+				continue
+			}
+
+			cleaned := sr.filter(filterKey{index: cand.Index, thought: part.Thought}).Write(part.Text)
+			if cleaned != part.Text {
+				changed = true
+			}
+			// A part that also carries data (e.g. a thought signature) is kept without its text.
+			if cleaned == "" && part.IsText() {
+				continue
+			}
+			part.Text = cleaned
+			parts = append(parts, part)
+		}
+
+		// Once the candidate is finished (or hands over to a function call, after which
+		// chunks are forwarded untouched) nothing can complete a held-back prefix.
+		if cand.FinishReason != "" || candHasFunctionCall {
+			if flushed := sr.flushCandidate(cand.Index); len(flushed) > 0 {
+				parts = append(parts, flushed...)
+				changed = true
+			}
+		}
+
+		cand.Content.Parts = parts
+	}
+
+	return changed
+}
+
+// flushCandidate releases the held-back text of a single candidate as text parts.
+func (sr *streamRewriter) flushCandidate(index int) []gemini.Part {
+	var parts []gemini.Part
+	for _, thought := range []bool{true, false} {
+		f, ok := sr.filters[filterKey{index: index, thought: thought}]
+		if !ok {
+			continue
+		}
+		if held := f.Flush(); held != "" {
+			parts = append(parts, gemini.Part{Text: held, Thought: thought})
+		}
+	}
+	return parts
+}
+
+// flushAll releases all remaining held-back text at the end of a stream.
+// It returns nil if nothing was pending.
+func (sr *streamRewriter) flushAll() *gemini.GenerateContentResponse {
+	indexes := make([]int, 0, len(sr.filters))
+	seen := make(map[int]bool)
+	for key := range sr.filters {
+		if !seen[key.index] {
+			seen[key.index] = true
+			indexes = append(indexes, key.index)
+		}
+	}
+	sort.Ints(indexes)
+
+	var chunk gemini.GenerateContentResponse
+	for _, index := range indexes {
+		if parts := sr.flushCandidate(index); len(parts) > 0 {
+			chunk.Candidates = append(chunk.Candidates, gemini.Candidate{
+				Content: gemini.Content{Parts: parts, Role: "model"},
+				Index:   index,
+			})
+		}
+	}
+	if len(chunk.Candidates) == 0 {
+		return nil
+	}
+	return &chunk
+}
@@ -0,0 +1,221 @@
+package ratelimit
+
+import (
+	"fmt"
+	"gemini-anti-truncate-go/internal/config"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Scopes a limit applies to.
+const (
+	ScopeClient = "client" // The authenticated client identity
+	ScopeKey    = "key"    // The upstream API key
+	ScopeModel  = "model"  // The model the request is sent to
+)
+
+// maxBuckets bounds the number of buckets kept in memory. Beyond it, buckets that have
+// refilled completely are dropped, which does not change any decision.
+const maxBuckets = 10000
+
+// Limit is the rate allowed in one scope. Zero disables a dimension.
+type Limit struct {
+	RequestsPerMinute int
+	TokensPerMinute   int // Estimated input tokens, see EstimateTokens
+}
+
+// Limits are the limits of each scope.
+type Limits struct {
+	Client Limit
+	Key    Limit
+	Model  Limit
+}
+
+// Request describes an upstream attempt to be admitted.
+type Request struct {
+	Client      string // Client ID, empty for anonymous requests, which have no client limit
+	ClientLimit Limit  // Per-client override of the configured client limit, dimensions left at zero are not overridden
+	Key         string
+	Model       string
+	Tokens      int
+}
+
+// ExceededError is returned when an attempt would exceed a limit.
+type ExceededError struct {
+	Scope      string
+	Dimension  string // "requests" or "tokens"
+	RetryAfter time.Duration
+}
+
+// Error describes the exceeded limit without naming the key or client.
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("Rate limit exceeded: too many %s per minute for this %s, retry after %v", e.Dimension, e.Scope, e.RetryAfter.Round(time.Second))
+}
+
+// bucket is a token bucket that holds up to capacity units and refills at rate units per second.
+type bucket struct {
+	capacity float64
+	rate     float64
+	level    float64
+	updated  time.Time
+}
+
+// refill brings the bucket's level up to date.
+func (b *bucket) refill(now time.Time) {
+	b.level = min(b.capacity, b.level+now.Sub(b.updated).Seconds()*b.rate)
+	b.updated = now
+}
+
+// wait returns how long it takes until the bucket holds cost units. A cost larger than
+// the bucket is capped at its capacity, so that large requests pass once the bucket is full.
+func (b *bucket) wait(cost float64) time.Duration {
+	cost = min(cost, b.capacity)
+	if b.level >= cost {
+		return 0
+	}
+	return time.Duration((cost - b.level) / b.rate * float64(time.Second))
+}
+
+// Limiter admits upstream attempts against per-client, per-key and per-model token buckets.
+// An attempt is only admitted if every bucket it touches has room, and then draws on all of them.
+type Limiter struct {
+	limits Limits
+	now    func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+// NewLimiter creates a limiter with the given limits.
+func NewLimiter(limits Limits) *Limiter {
+	return &Limiter{limits: limits, now: time.Now, buckets: make(map[string]*bucket)}
+}
+
+// Load creates the limiter from the RATE_LIMIT_* configuration.
+func Load() *Limiter {
+	return NewLimiter(Limits{
+		Client: Limit{config.AppConfig.ClientRequestsPerMinute, config.AppConfig.ClientTokensPerMinute},
+		Key:    Limit{config.AppConfig.KeyRequestsPerMinute, config.AppConfig.KeyTokensPerMinute},
+		Model:  Limit{config.AppConfig.ModelRequestsPerMinute, config.AppConfig.ModelTokensPerMinute},
+	})
+}
+
+// Enabled reports whether any limit is configured.
+func (l *Limiter) Enabled() bool {
+	return l.limits != Limits{}
+}
+
+// check is one bucket an attempt draws on.
+type check struct {
+	scope     string
+	dimension string
+	name      string
+	perMinute int
+	cost      float64
+}
+
+// Allow admits an attempt, or returns an *ExceededError naming the limit that would be exceeded
+// and how long until the attempt would fit. A rejected attempt draws on no bucket.
+func (l *Limiter) Allow(req Request) error {
+	clientLimit := l.limits.Client
+	if req.ClientLimit.RequestsPerMinute > 0 {
+		clientLimit.RequestsPerMinute = req.ClientLimit.RequestsPerMinute
+	}
+	if req.ClientLimit.TokensPerMinute > 0 {
+		clientLimit.TokensPerMinute = req.ClientLimit.TokensPerMinute
+	}
+
+	var checks []check
+	add := func(scope, name string, limit Limit) {
+		if name == "" {
+			return
+		}
+		checks = append(checks,
+			check{scope, "requests", scope + "/requests/" + name, limit.RequestsPerMinute, 1},
+			check{scope, "tokens", scope + "/tokens/" + name, limit.TokensPerMinute, float64(req.Tokens)})
+	}
+	add(ScopeClient, req.Client, clientLimit)
+	add(ScopeKey, req.Key, l.limits.Key)
+	add(ScopeModel, req.Model, l.limits.Model)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	var exceeded *ExceededError
+	var admitted []*bucket
+	for _, c := range checks {
+		if c.perMinute <= 0 {
+			continue
+		}
+		b := l.bucket(c.name, c.perMinute, now)
+		if wait := b.wait(c.cost); wait > 0 {
+			if exceeded == nil || wait > exceeded.RetryAfter {
+				exceeded = &ExceededError{Scope: c.scope, Dimension: c.dimension, RetryAfter: wait}
+			}
+			continue
+		}
+		admitted = append(admitted, b)
+	}
+	if exceeded != nil {
+		return exceeded
+	}
+
+	i := 0
+	for _, c := range checks {
+		if c.perMinute > 0 {
+			admitted[i].level -= min(c.cost, admitted[i].capacity)
+			i++
+		}
+	}
+	return nil
+}
+
+// bucket returns the named bucket, refilled up to now, creating it full if needed.
+func (l *Limiter) bucket(name string, perMinute int, now time.Time) *bucket {
+	b, ok := l.buckets[name]
+	if !ok {
+		if len(l.buckets) >= maxBuckets {
+			l.prune(now)
+		}
+		capacity := float64(perMinute)
+		b = &bucket{capacity: capacity, rate: capacity / 60, level: capacity, updated: now}
+		l.buckets[name] = b
+	}
+	// A changed limit (such as a per-client override) takes effect on the existing bucket
+	if capacity := float64(perMinute); b.capacity != capacity {
+		b.capacity, b.rate = capacity, capacity/60
+	}
+	b.refill(now)
+	return b
+}
+
+// prune drops the buckets that have refilled completely.
+func (l *Limiter) prune(now time.Time) {
+	for name, b := range l.buckets {
+		if b.refill(now); b.level >= b.capacity {
+			delete(l.buckets, name)
+		}
+	}
+}
+
+// EstimateTokens estimates the input tokens of a request body at roughly four bytes per token.
+func EstimateTokens(body []byte) int {
+	return len(body)/4 + 1
+}
+
+var current atomic.Pointer[Limiter]
+
+// SetLimiter installs the limiter returned by Current.
+func SetLimiter(l *Limiter) {
+	current.Store(l)
+}
+
+// Current returns the installed limiter, or one without limits if none was installed.
+func Current() *Limiter {
+	if l := current.Load(); l != nil {
+		return l
+	}
+	return NewLimiter(Limits{})
+}
@@ -0,0 +1,131 @@
+package ratelimit
+
+import (
+	"errors"
+	"gemini-anti-truncate-go/internal/config"
+	"testing"
+	"time"
+)
+
+// Initialize config for tests
+func init() {
+	config.Load()
+}
+
+// newTestLimiter creates a limiter whose clock only moves when the test advances it.
+func newTestLimiter(limits Limits) (*Limiter, *time.Time) {
+	now := time.Unix(1700000000, 0)
+	l := NewLimiter(limits)
+	l.now = func() time.Time { return now }
+	return l, &now
+}
+
+func TestLimiter_RequestsPerMinute(t *testing.T) {
+	l, now := newTestLimiter(Limits{Client: Limit{RequestsPerMinute: 2}})
+	req := Request{Client: "alice", Key: "key", Model: "gemini-2.5-pro", Tokens: 10}
+
+	for i := 0; i < 2; i++ {
+		if err := l.Allow(req); err != nil {
+			t.Fatalf("Expected request %d to be allowed, got %v", i+1, err)
+		}
+	}
+
+	err := l.Allow(req)
+	var exceeded *ExceededError
+	if !errors.As(err, &exceeded) {
+		t.Fatalf("Expected an ExceededError, got %v", err)
+	}
+	if exceeded.Scope != ScopeClient || exceeded.Dimension != "requests" {
+		t.Errorf("Expected the client's request limit, got %s %s", exceeded.Scope, exceeded.Dimension)
+	}
+	if exceeded.RetryAfter != 30*time.Second {
+		t.Errorf("Expected to retry after 30s, got %v", exceeded.RetryAfter)
+	}
+
+	// Other clients have their own buckets
+	if err := l.Allow(Request{Client: "bob", Tokens: 10}); err != nil {
+		t.Errorf("Expected another client to be allowed, got %v", err)
+	}
+
+	*now = now.Add(30 * time.Second)
+	if err := l.Allow(req); err != nil {
+		t.Errorf("Expected the bucket to refill, got %v", err)
+	}
+}
+
+func TestLimiter_TokensPerMinute(t *testing.T) {
+	l, now := newTestLimiter(Limits{Model: Limit{TokensPerMinute: 600}})
+
+	if err := l.Allow(Request{Model: "gemini-2.5-pro", Tokens: 500}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	err := l.Allow(Request{Model: "gemini-2.5-pro", Tokens: 200})
+	var exceeded *ExceededError
+	if !errors.As(err, &exceeded) || exceeded.Scope != ScopeModel || exceeded.Dimension != "tokens" {
+		t.Fatalf("Expected the model's token limit to be exceeded, got %v", err)
+	}
+	if exceeded.RetryAfter != 10*time.Second {
+		t.Errorf("Expected to retry after 10s, got %v", exceeded.RetryAfter)
+	}
+
+	// Requests larger than the bucket pass once it is full
+	*now = now.Add(time.Minute)
+	if err := l.Allow(Request{Model: "gemini-2.5-pro", Tokens: 5000}); err != nil {
+		t.Errorf("Expected a large request to pass on a full bucket, got %v", err)
+	}
+}
+
+func TestLimiter_RejectionDrawsOnNoBucket(t *testing.T) {
+	l, _ := newTestLimiter(Limits{Client: Limit{RequestsPerMinute: 10}, Key: Limit{RequestsPerMinute: 1}})
+
+	if err := l.Allow(Request{Client: "alice", Key: "key-a"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := l.Allow(Request{Client: "alice", Key: "key-a"}); err == nil {
+			t.Fatal("Expected the key limit to be exceeded")
+		}
+	}
+	// The rejected attempts did not use up the client's budget
+	for i := 0; i < 9; i++ {
+		if err := l.Allow(Request{Client: "alice", Key: "key-" + string(rune('b'+i))}); err != nil {
+			t.Fatalf("Expected attempt %d with a fresh key to be allowed, got %v", i+1, err)
+		}
+	}
+	if err := l.Allow(Request{Client: "alice", Key: "key-z"}); err == nil {
+		t.Error("Expected the client limit to be exceeded")
+	}
+}
+
+func TestLimiter_ClientOverride(t *testing.T) {
+	l, _ := newTestLimiter(Limits{Client: Limit{RequestsPerMinute: 1}})
+	req := Request{Client: "batch", ClientLimit: Limit{RequestsPerMinute: 3}}
+
+	for i := 0; i < 3; i++ {
+		if err := l.Allow(req); err != nil {
+			t.Fatalf("Expected request %d to be allowed, got %v", i+1, err)
+		}
+	}
+	if err := l.Allow(req); err == nil {
+		t.Error("Expected the overridden limit to be exceeded")
+	}
+
+	// Anonymous requests have no client limit
+	for i := 0; i < 5; i++ {
+		if err := l.Allow(Request{Key: "key"}); err != nil {
+			t.Fatalf("Expected anonymous request %d to be allowed, got %v", i+1, err)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	defer func(cfg config.Config) { *config.AppConfig = cfg }(*config.AppConfig)
+
+	if Load().Enabled() {
+		t.Error("Expected rate limiting to be disabled by default")
+	}
+	config.AppConfig.KeyTokensPerMinute = 1000
+	if !Load().Enabled() {
+		t.Error("Expected rate limiting to be enabled")
+	}
+}
@@ -0,0 +1,120 @@
+package retry
+
+import (
+	"context"
+	"encoding/json"
+	"gemini-anti-truncate-go/internal/config"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// retryInfoType is the @type of the google.rpc.RetryInfo detail in a Gemini error body.
+const retryInfoType = "type.googleapis.com/google.rpc.RetryInfo"
+
+// Backoff computes the delay before retrying a failed upstream request: an exponentially
+// growing, jittered and capped delay, unless the upstream said how long to wait.
+type Backoff struct {
+	BaseDelay time.Duration  // Delay before the first retry
+	MaxDelay  time.Duration  // Cap on the computed delay
+	Jitter    float64        // Fraction of the delay that is randomized, between 0 and 1
+	Rand      func() float64 // Source of randomness in [0, 1), defaults to math/rand
+}
+
+// NewBackoff creates a Backoff from the application configuration.
+func NewBackoff() *Backoff {
+	return &Backoff{
+		BaseDelay: config.AppConfig.RetryBaseDelay,
+		MaxDelay:  config.AppConfig.RetryMaxDelay,
+		Jitter:    config.AppConfig.RetryJitter,
+	}
+}
+
+// Delay returns the computed delay before retry number attempt (starting at 0).
+// The exponential delay is capped at MaxDelay, then up to Jitter of it is taken off at random
+// so that concurrent clients do not retry in lockstep.
+func (b *Backoff) Delay(attempt int) time.Duration {
+	delay := b.BaseDelay
+	for i := 0; i < attempt && delay < b.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > b.MaxDelay {
+		delay = b.MaxDelay
+	}
+
+	jitter := min(max(b.Jitter, 0), 1)
+	random := rand.Float64
+	if b.Rand != nil {
+		random = b.Rand
+	}
+	return delay - time.Duration(jitter*random()*float64(delay))
+}
+
+// Next returns the delay before retry number attempt of a request that failed with the given
+// upstream response, and whether the retry can wait that long. A delay requested by the upstream,
+// through the Retry-After header or a RetryInfo detail in the error body, takes precedence over
+// the computed one, but only if it fits within MaxDelay and the time left before the request
+// deadline (remaining, zero for no deadline). A longer one is returned with ok set to false: the
+// request should then fail with the upstream's answer rather than wait past the deadline.
+func (b *Backoff) Next(attempt int, header http.Header, body []byte, remaining time.Duration) (delay time.Duration, ok bool) {
+	if delay, found := ServerDelay(header, body); found {
+		if delay > b.MaxDelay || (remaining > 0 && delay >= remaining) {
+			return delay, false
+		}
+		return delay, true
+	}
+	return b.Delay(attempt), true
+}
+
+// ServerDelay extracts the delay requested by the upstream, if any. The Retry-After header
+// may hold either a number of seconds or an HTTP date; the error body may carry a
+// google.rpc.RetryInfo detail with a retryDelay such as "12s".
+func ServerDelay(header http.Header, body []byte) (time.Duration, bool) {
+	if retryAfter := header.Get("Retry-After"); retryAfter != "" {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second, true
+		}
+		if date, err := http.ParseTime(retryAfter); err == nil {
+			return max(time.Until(date), 0), true
+		}
+	}
+
+	var errorBody struct {
+		Error struct {
+			Details []struct {
+				Type       string `json:"@type"`
+				RetryDelay string `json:"retryDelay"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &errorBody) != nil {
+		return 0, false
+	}
+	for _, detail := range errorBody.Error.Details {
+		if detail.Type != retryInfoType {
+			continue
+		}
+		if delay, err := time.ParseDuration(detail.RetryDelay); err == nil && delay >= 0 {
+			return delay, true
+		}
+	}
+	return 0, false
+}
+
+// Sleep waits for the given delay, returning early with the context's error if the client
+// goes away or the request deadline passes first.
+func Sleep(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
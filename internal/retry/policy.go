@@ -0,0 +1,304 @@
+package retry
+
+import (
+	"encoding/json"
+	"fmt"
+	"gemini-anti-truncate-go/internal/config"
+	"os"
+	"slices"
+	"sync/atomic"
+)
+
+// Action is what the proxy does after an attempt that did not produce a complete answer.
+type Action string
+
+const (
+	// ActionRetry resends the request: the same request after an upstream error, a continuation after a truncation.
+	ActionRetry Action = "retry"
+	// ActionFail gives up and reports the failure to the client.
+	ActionFail Action = "fail"
+	// ActionSwitchKey retries with another API key.
+	ActionSwitchKey Action = "switch_key"
+	// ActionSwitchModel retries with the next of the policy's fallback models.
+	ActionSwitchModel Action = "switch_model"
+	// ActionReturnPartial gives up and returns what has been generated so far as a successful response.
+	ActionReturnPartial Action = "return_partial"
+)
+
+// Budget names. Every action that sends another upstream request draws on one of them; retries
+// of upstream errors and continuations of truncated answers have independent budgets, so a burst
+// of 429s cannot use up the continuations of a long answer, or the other way round.
+const (
+	BudgetRetry        = "retry"
+	BudgetContinuation = "continuation"
+	BudgetSwitchKey    = "switch_key"
+	BudgetSwitchModel  = "switch_model"
+)
+
+// budgetNames lists the valid keys of Policy.Budgets.
+var budgetNames = []string{BudgetRetry, BudgetContinuation, BudgetSwitchKey, BudgetSwitchModel}
+
+// Rule maps a class of failed attempts to an action. Every criterion that is set must match;
+// a rule without criteria matches every event.
+type Rule struct {
+	Name        string   `json:"name,omitempty"`
+	Status      []int    `json:"status,omitempty"`      // Upstream HTTP status codes
+	ErrorStatus []string `json:"errorStatus,omitempty"` // error.status of the upstream error body, e.g. RESOURCE_EXHAUSTED
+	Transport   bool     `json:"transport,omitempty"`   // The request never got a response (connection refused, reset, ...)
+	Outcome     []string `json:"outcome,omitempty"`     // Completion decisions such as truncated-retry or terminal-stop
+	Action      Action   `json:"action"`
+}
+
+// Policy decides how failed attempts are handled. Rules are evaluated in order and the first
+// match wins; Default applies when none matches. Budgets caps how often each action that
+// sends another request may be taken for a single client request, see budgetFor.
+type Policy struct {
+	Rules          []Rule         `json:"rules"`
+	Default        Action         `json:"default,omitempty"`
+	Budgets        map[string]int `json:"budgets,omitempty"`
+	FallbackModels []string       `json:"fallbackModels,omitempty"` // Models tried in order by switch_model
+}
+
+// Event describes a failed attempt. Exactly one of StatusCode, Transport and Outcome is set.
+type Event struct {
+	StatusCode  int
+	ErrorStatus string
+	Transport   bool
+	Outcome     string
+}
+
+// StatusEvent describes an upstream error response, reading error.status from its body.
+func StatusEvent(statusCode int, body []byte) Event {
+	var errorBody struct {
+		Error struct {
+			Status string `json:"status"`
+		} `json:"error"`
+	}
+	json.Unmarshal(body, &errorBody)
+	return Event{StatusCode: statusCode, ErrorStatus: errorBody.Error.Status}
+}
+
+// TransportEvent describes a request that failed before any response was received.
+func TransportEvent() Event {
+	return Event{Transport: true}
+}
+
+// OutcomeEvent describes a successful response that did not complete the answer,
+// by the name of its completion decision.
+func OutcomeEvent(outcome string) Event {
+	return Event{Outcome: outcome}
+}
+
+// String describes the event for logs.
+func (e Event) String() string {
+	switch {
+	case e.Transport:
+		return "transport error"
+	case e.Outcome != "":
+		return "outcome " + e.Outcome
+	case e.ErrorStatus != "":
+		return fmt.Sprintf("status %d (%s)", e.StatusCode, e.ErrorStatus)
+	default:
+		return fmt.Sprintf("status %d", e.StatusCode)
+	}
+}
+
+// matches reports whether the rule applies to the event.
+func (rule *Rule) matches(e Event) bool {
+	if len(rule.Status) > 0 && !slices.Contains(rule.Status, e.StatusCode) {
+		return false
+	}
+	if len(rule.ErrorStatus) > 0 && !slices.Contains(rule.ErrorStatus, e.ErrorStatus) {
+		return false
+	}
+	if rule.Transport && !e.Transport {
+		return false
+	}
+	if len(rule.Outcome) > 0 && !slices.Contains(rule.Outcome, e.Outcome) {
+		return false
+	}
+	return true
+}
+
+// DefaultPolicy returns the built-in policy: rate limits, overloads and network errors are
+// retried, a 403 (usually a bad key) switches keys, truncated answers are continued, answers
+// that reached the output token limit or that the model will not finish are returned as they
+// are, and everything else fails.
+func DefaultPolicy() *Policy {
+	return &Policy{
+		Rules: []Rule{
+			{Name: "forbidden", Status: []int{403}, Action: ActionSwitchKey},
+			{Name: "rate-limited", Status: []int{429}, Action: ActionRetry},
+			{Name: "unavailable", Status: []int{503}, Action: ActionRetry},
+			{Name: "transport", Transport: true, Action: ActionRetry},
+			{Name: "truncated", Outcome: []string{"truncated-retry"}, Action: ActionRetry},
+			{Name: "max-tokens", Outcome: []string{"max-tokens"}, Action: ActionReturnPartial},
+			{Name: "unfinishable", Outcome: []string{"terminal-stop", "error", "prompt-blocked"}, Action: ActionReturnPartial},
+		},
+		Default: ActionFail,
+		Budgets: defaultBudgets(),
+	}
+}
+
+// defaultBudgets returns the budgets used for the budgets a policy does not set.
+func defaultBudgets() map[string]int {
+	return map[string]int{
+		BudgetRetry:        config.AppConfig.MaxErrorRetries,
+		BudgetContinuation: config.AppConfig.MaxContinuations,
+		BudgetSwitchKey:    3,
+		BudgetSwitchModel:  2,
+	}
+}
+
+// budgetFor returns the budget an action draws on for an event, or "" if it draws on none.
+// A retry after an upstream error resends the request, while a retry after an outcome asks
+// for a continuation.
+func budgetFor(action Action, e Event) string {
+	switch action {
+	case ActionRetry:
+		if e.Outcome != "" {
+			return BudgetContinuation
+		}
+		return BudgetRetry
+	case ActionSwitchKey:
+		return BudgetSwitchKey
+	case ActionSwitchModel:
+		return BudgetSwitchModel
+	}
+	return ""
+}
+
+// ParsePolicy decodes a JSON policy, filling in the default action and budgets it leaves out.
+func ParsePolicy(data []byte) (*Policy, error) {
+	var policy Policy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("invalid retry policy: %w", err)
+	}
+	if policy.Default == "" {
+		policy.Default = ActionFail
+	}
+	budgets := defaultBudgets()
+	for name, budget := range policy.Budgets {
+		budgets[name] = budget
+	}
+	policy.Budgets = budgets
+
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// Validate checks that the policy only uses known actions and non-negative budgets.
+func (p *Policy) Validate() error {
+	known := []Action{ActionRetry, ActionFail, ActionSwitchKey, ActionSwitchModel, ActionReturnPartial}
+	for i, rule := range p.Rules {
+		if !slices.Contains(known, rule.Action) {
+			return fmt.Errorf("invalid retry policy: rule %d has unknown action %q", i, rule.Action)
+		}
+	}
+	if !slices.Contains(known, p.Default) {
+		return fmt.Errorf("invalid retry policy: unknown default action %q", p.Default)
+	}
+	for name, budget := range p.Budgets {
+		if !slices.Contains(budgetNames, name) {
+			return fmt.Errorf("invalid retry policy: unknown budget %q", name)
+		}
+		if budget < 0 {
+			return fmt.Errorf("invalid retry policy: negative budget for %q", name)
+		}
+	}
+	return nil
+}
+
+// LoadPolicy loads the policy from the file named by RETRY_POLICY_FILE or the JSON in
+// RETRY_POLICY, in that order, and falls back to DefaultPolicy when neither is set.
+func LoadPolicy() (*Policy, error) {
+	if path := config.AppConfig.RetryPolicyFile; path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read retry policy: %w", err)
+		}
+		return ParsePolicy(data)
+	}
+	if inline := config.AppConfig.RetryPolicy; inline != "" {
+		return ParsePolicy([]byte(inline))
+	}
+	return DefaultPolicy(), nil
+}
+
+var activePolicy atomic.Pointer[Policy]
+
+// SetPolicy installs the policy used by CurrentPolicy.
+func SetPolicy(p *Policy) {
+	activePolicy.Store(p)
+}
+
+// CurrentPolicy returns the installed policy, or DefaultPolicy if none was installed.
+func CurrentPolicy() *Policy {
+	if p := activePolicy.Load(); p != nil {
+		return p
+	}
+	return DefaultPolicy()
+}
+
+// Verdict is the policy's answer for one event.
+type Verdict struct {
+	Action    Action
+	Rule      string // Name of the matching rule, empty for the default action
+	Budget    string // Budget the action was charged to, if any
+	Exhausted bool   // The budget was used up, so the verdict fell back to ActionFail
+}
+
+// Session applies a policy to the attempts of a single client request and tracks its budgets.
+type Session struct {
+	policy      *Policy
+	used        map[string]int
+	triedModels []string
+}
+
+// NewSession starts tracking the budgets of a new client request.
+func (p *Policy) NewSession() *Session {
+	return &Session{policy: p, used: make(map[string]int)}
+}
+
+// Decide returns the action for the event and charges it to its budget.
+func (s *Session) Decide(e Event) Verdict {
+	verdict := Verdict{Action: s.policy.Default}
+	for _, rule := range s.policy.Rules {
+		if rule.matches(e) {
+			verdict = Verdict{Action: rule.Action, Rule: rule.Name}
+			break
+		}
+	}
+
+	if budget := budgetFor(verdict.Action, e); budget != "" {
+		if s.used[budget] >= s.policy.Budgets[budget] {
+			return Verdict{Action: ActionFail, Rule: verdict.Rule, Budget: budget, Exhausted: true}
+		}
+		s.used[budget]++
+		verdict.Budget = budget
+	}
+	return verdict
+}
+
+// Used returns how much of a budget has been spent so far.
+func (s *Session) Used(budget string) int {
+	return s.used[budget]
+}
+
+// Limit returns the size of a budget.
+func (s *Session) Limit(budget string) int {
+	return s.policy.Budgets[budget]
+}
+
+// NextModel returns the first fallback model other than current that has not been tried yet.
+func (s *Session) NextModel(current string) (string, bool) {
+	s.triedModels = append(s.triedModels, current)
+	for _, model := range s.policy.FallbackModels {
+		if !slices.Contains(s.triedModels, model) {
+			return model, true
+		}
+	}
+	return "", false
+}
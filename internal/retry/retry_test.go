@@ -0,0 +1,257 @@
+package retry
+
+import (
+	"context"
+	"gemini-anti-truncate-go/internal/config"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Initialize config for tests
+func init() {
+	config.Load()
+}
+
+func TestBackoff_Delay(t *testing.T) {
+	backoff := &Backoff{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second, Jitter: 0}
+
+	expected := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	}
+	for attempt, want := range expected {
+		if got := backoff.Delay(attempt); got != want {
+			t.Errorf("Attempt %d: expected %v, got %v", attempt, want, got)
+		}
+	}
+
+	// A very large attempt number must not overflow past the cap
+	if got := backoff.Delay(1000); got != time.Second {
+		t.Errorf("Expected the delay to stay capped at %v, got %v", time.Second, got)
+	}
+}
+
+func TestBackoff_Jitter(t *testing.T) {
+	backoff := &Backoff{BaseDelay: time.Second, MaxDelay: time.Minute, Jitter: 0.5, Rand: func() float64 { return 1 }}
+	if got := backoff.Delay(0); got != 500*time.Millisecond {
+		t.Errorf("Expected full jitter to halve the delay, got %v", got)
+	}
+
+	backoff.Rand = func() float64 { return 0 }
+	if got := backoff.Delay(0); got != time.Second {
+		t.Errorf("Expected no jitter to keep the delay, got %v", got)
+	}
+
+	backoff = &Backoff{BaseDelay: time.Second, MaxDelay: time.Minute, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		if got := backoff.Delay(0); got < 500*time.Millisecond || got > time.Second {
+			t.Fatalf("Expected a delay between 500ms and 1s, got %v", got)
+		}
+	}
+}
+
+func TestServerDelay(t *testing.T) {
+	testCases := []struct {
+		name     string
+		header   http.Header
+		body     string
+		expected time.Duration
+		ok       bool
+	}{
+		{"Retry-After seconds", http.Header{"Retry-After": []string{"7"}}, "", 7 * time.Second, true},
+		{"Retry-After in the past", http.Header{"Retry-After": []string{"Wed, 21 Oct 2015 07:28:00 GMT"}}, "", 0, true},
+		{
+			"RetryInfo",
+			http.Header{},
+			`{"error": {"code": 429, "status": "RESOURCE_EXHAUSTED", "details": [{"@type": "type.googleapis.com/google.rpc.QuotaFailure"}, {"@type": "type.googleapis.com/google.rpc.RetryInfo", "retryDelay": "1.5s"}]}}`,
+			1500 * time.Millisecond,
+			true,
+		},
+		{"Header wins over body", http.Header{"Retry-After": []string{"2"}}, `{"error": {"details": [{"@type": "type.googleapis.com/google.rpc.RetryInfo", "retryDelay": "9s"}]}}`, 2 * time.Second, true},
+		{"Invalid header", http.Header{"Retry-After": []string{"soon"}}, "", 0, false},
+		{"No hint", http.Header{}, `{"error": {"code": 503, "message": "overloaded"}}`, 0, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			delay, ok := ServerDelay(tc.header, []byte(tc.body))
+			if ok != tc.ok || delay != tc.expected {
+				t.Errorf("Expected (%v, %v), got (%v, %v)", tc.expected, tc.ok, delay, ok)
+			}
+		})
+	}
+}
+
+func TestBackoff_NextPrefersServerDelay(t *testing.T) {
+	backoff := &Backoff{BaseDelay: time.Second, MaxDelay: time.Minute}
+	if got, ok := backoff.Next(3, http.Header{"Retry-After": []string{"1"}}, nil, 0); got != time.Second || !ok {
+		t.Errorf("Expected the Retry-After delay, got %v (ok %t)", got, ok)
+	}
+	if got, ok := backoff.Next(3, http.Header{}, nil, 0); got != 8*time.Second || !ok {
+		t.Errorf("Expected the computed delay, got %v (ok %t)", got, ok)
+	}
+}
+
+func TestBackoff_NextCapsServerDelay(t *testing.T) {
+	backoff := &Backoff{BaseDelay: time.Second, MaxDelay: time.Minute}
+	body := []byte(`{"error": {"details": [{"@type": "type.googleapis.com/google.rpc.RetryInfo", "retryDelay": "3600s"}]}}`)
+	if got, ok := backoff.Next(0, http.Header{}, body, 0); got != time.Hour || ok {
+		t.Errorf("Expected a delay beyond MaxDelay to be refused, got %v (ok %t)", got, ok)
+	}
+	if got, ok := backoff.Next(0, http.Header{"Retry-After": []string{"30"}}, nil, 10*time.Second); got != 30*time.Second || ok {
+		t.Errorf("Expected a delay beyond the deadline to be refused, got %v (ok %t)", got, ok)
+	}
+	if got, ok := backoff.Next(0, http.Header{"Retry-After": []string{"30"}}, nil, time.Minute); got != 30*time.Second || !ok {
+		t.Errorf("Expected a delay within the deadline to be accepted, got %v (ok %t)", got, ok)
+	}
+}
+
+func TestSleep_ContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+	if err := Sleep(ctx, time.Minute); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected Sleep to return immediately, took %v", elapsed)
+	}
+
+	if err := Sleep(context.Background(), time.Millisecond); err != nil {
+		t.Errorf("Expected nil, got %v", err)
+	}
+}
+
+func TestDefaultPolicy(t *testing.T) {
+	testCases := []struct {
+		event    Event
+		expected Action
+	}{
+		{StatusEvent(429, []byte(`{"error": {"status": "RESOURCE_EXHAUSTED"}}`)), ActionRetry},
+		{StatusEvent(503, nil), ActionRetry},
+		{StatusEvent(403, []byte(`{"error": {"status": "PERMISSION_DENIED"}}`)), ActionSwitchKey},
+		{StatusEvent(500, nil), ActionFail},
+		{StatusEvent(400, []byte(`{"error": {"status": "INVALID_ARGUMENT"}}`)), ActionFail},
+		{TransportEvent(), ActionRetry},
+		{OutcomeEvent("truncated-retry"), ActionRetry},
+		{OutcomeEvent("max-tokens"), ActionReturnPartial},
+		{OutcomeEvent("terminal-stop"), ActionReturnPartial},
+		{OutcomeEvent("prompt-blocked"), ActionReturnPartial},
+	}
+
+	for _, tc := range testCases {
+		session := DefaultPolicy().NewSession()
+		if verdict := session.Decide(tc.event); verdict.Action != tc.expected {
+			t.Errorf("For %s: expected %s, got %s", tc.event, tc.expected, verdict.Action)
+		}
+	}
+}
+
+func TestSession_Budgets(t *testing.T) {
+	policy, err := ParsePolicy([]byte(`{
+		"rules": [
+			{"name": "quota", "errorStatus": ["RESOURCE_EXHAUSTED"], "action": "switch_model"},
+			{"name": "overloaded", "status": [503], "action": "retry"}
+		],
+		"budgets": {"retry": 2, "continuation": 1, "switch_model": 1},
+		"fallbackModels": ["gemini-2.5-flash"]
+	}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	session := policy.NewSession()
+
+	quota := StatusEvent(429, []byte(`{"error": {"code": 429, "status": "RESOURCE_EXHAUSTED"}}`))
+	if verdict := session.Decide(quota); verdict.Action != ActionSwitchModel || verdict.Rule != "quota" {
+		t.Errorf("Expected switch_model from rule 'quota', got %+v", verdict)
+	}
+	if verdict := session.Decide(quota); verdict.Action != ActionFail || !verdict.Exhausted {
+		t.Errorf("Expected an exhausted switch_model budget, got %+v", verdict)
+	}
+
+	// Each action has its own budget
+	for i := 0; i < 2; i++ {
+		if verdict := session.Decide(StatusEvent(503, nil)); verdict.Action != ActionRetry {
+			t.Errorf("Retry %d: expected retry, got %+v", i+1, verdict)
+		}
+	}
+	if verdict := session.Decide(StatusEvent(503, nil)); verdict.Action != ActionFail || !verdict.Exhausted {
+		t.Errorf("Expected an exhausted retry budget, got %+v", verdict)
+	}
+	if session.Used(BudgetRetry) != 2 {
+		t.Errorf("Expected 2 retries used, got %d", session.Used(BudgetRetry))
+	}
+
+	// Unmatched events use the default action
+	if verdict := session.Decide(OutcomeEvent("terminal-stop")); verdict.Action != ActionFail || verdict.Exhausted {
+		t.Errorf("Expected the default action, got %+v", verdict)
+	}
+
+	if model, ok := session.NextModel("gemini-2.5-pro"); !ok || model != "gemini-2.5-flash" {
+		t.Errorf("Expected fallback 'gemini-2.5-flash', got '%s'", model)
+	}
+	if _, ok := session.NextModel("gemini-2.5-flash"); ok {
+		t.Error("Expected no fallback model to be left")
+	}
+}
+
+func TestParsePolicy_Invalid(t *testing.T) {
+	for _, data := range []string{
+		`not json`,
+		`{"rules": [{"status": [429], "action": "panic"}]}`,
+		`{"default": "retry_forever"}`,
+		`{"budgets": {"retry": -1}}`,
+		`{"budgets": {"fail": 3}}`,
+		`{"budgets": {"continuations": 3}}`,
+	} {
+		if _, err := ParsePolicy([]byte(data)); err == nil {
+			t.Errorf("Expected an error for policy %s", data)
+		}
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	originalFile, originalInline := config.AppConfig.RetryPolicyFile, config.AppConfig.RetryPolicy
+	defer func() {
+		config.AppConfig.RetryPolicyFile, config.AppConfig.RetryPolicy = originalFile, originalInline
+	}()
+
+	config.AppConfig.RetryPolicyFile, config.AppConfig.RetryPolicy = "", ""
+	policy, err := LoadPolicy()
+	if err != nil || len(policy.Rules) != len(DefaultPolicy().Rules) {
+		t.Errorf("Expected the default policy, got %+v (%v)", policy, err)
+	}
+
+	config.AppConfig.RetryPolicy = `{"rules": [{"status": [500], "action": "retry"}]}`
+	policy, err = LoadPolicy()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if policy.Default != ActionFail || policy.Budgets[BudgetRetry] != config.AppConfig.MaxErrorRetries {
+		t.Errorf("Expected defaults to be filled in, got %+v", policy)
+	}
+
+	// The file takes precedence over the inline policy
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(`{"rules": [], "default": "return_partial"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config.AppConfig.RetryPolicyFile = path
+	policy, err = LoadPolicy()
+	if err != nil || policy.Default != ActionReturnPartial {
+		t.Errorf("Expected the policy from the file, got %+v (%v)", policy, err)
+	}
+
+	config.AppConfig.RetryPolicyFile = filepath.Join(t.TempDir(), "missing.json")
+	if _, err := LoadPolicy(); err == nil {
+		t.Error("Expected an error for a missing policy file")
+	}
+}
@@ -0,0 +1,286 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"gemini-anti-truncate-go/internal/util"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// maxQueuedSpans bounds the finished spans waiting for export; more are dropped.
+	maxQueuedSpans = 2048
+	// maxBatchSpans is the number of spans that triggers an export before the interval.
+	maxBatchSpans = 512
+	// exportInterval is how often queued spans are exported.
+	exportInterval = 5 * time.Second
+	// exportTimeout bounds a single export request.
+	exportTimeout = 10 * time.Second
+)
+
+// scopeName names the instrumentation in exported spans.
+const scopeName = "gemini-anti-truncate-go"
+
+// Exporter sends finished spans in batches to an OTLP/HTTP collector, encoded as JSON.
+// Spans are queued in memory and exported in the background, so that a slow or unreachable
+// collector never delays requests; when the queue is full, spans are dropped.
+type Exporter struct {
+	url         string
+	headers     map[string]string
+	serviceName string
+	client      *http.Client
+
+	mu      sync.Mutex
+	queue   []*Span
+	dropped int64
+	closed  bool
+
+	wake     chan struct{}
+	flushReq chan chan error
+	done     chan struct{}
+}
+
+// NewExporter creates an exporter that posts to the OTLP traces URL of a collector, such as
+// http://localhost:4318/v1/traces, with the given extra headers, and starts its background loop.
+func NewExporter(url string, headers map[string]string, serviceName string) *Exporter {
+	e := &Exporter{
+		url:         url,
+		headers:     headers,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: exportTimeout},
+		wake:        make(chan struct{}, 1),
+		flushReq:    make(chan chan error),
+		done:        make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+// enqueue queues a finished span for export.
+func (e *Exporter) enqueue(s *Span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed || len(e.queue) >= maxQueuedSpans {
+		e.dropped++
+		return
+	}
+	e.queue = append(e.queue, s)
+	if len(e.queue) >= maxBatchSpans {
+		select {
+		case e.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Dropped returns the number of spans dropped because the queue was full or the exporter closed.
+func (e *Exporter) Dropped() int64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.dropped
+}
+
+// run exports the queued spans every interval, when a batch is full and when asked to flush,
+// until the exporter is shut down.
+func (e *Exporter) run() {
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.logError(e.exportQueued())
+		case <-e.wake:
+			e.logError(e.exportQueued())
+		case reply := <-e.flushReq:
+			reply <- e.exportQueued()
+		case <-e.done:
+			return
+		}
+	}
+}
+
+// logError logs a failed background export.
+func (e *Exporter) logError(err error) {
+	if err != nil {
+		util.Error(context.Background(), "Failed to export spans", "url", e.url, "error", err)
+	}
+}
+
+// exportQueued exports everything in the queue, in batches.
+func (e *Exporter) exportQueued() error {
+	var firstErr error
+	for {
+		e.mu.Lock()
+		n := min(len(e.queue), maxBatchSpans)
+		batch := e.queue[:n:n]
+		e.queue = e.queue[n:]
+		e.mu.Unlock()
+		if n == 0 {
+			return firstErr
+		}
+		if err := e.export(batch); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+}
+
+// Flush exports the queued spans and waits for the export to finish.
+func (e *Exporter) Flush(ctx context.Context) error {
+	reply := make(chan error, 1)
+	select {
+	case e.flushReq <- reply:
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-reply:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown exports the queued spans and stops the background loop. Spans ended afterwards are dropped.
+func (e *Exporter) Shutdown(ctx context.Context) error {
+	err := e.Flush(ctx)
+	e.mu.Lock()
+	if !e.closed {
+		e.closed = true
+		close(e.done)
+	}
+	e.mu.Unlock()
+	return err
+}
+
+// export posts a batch of spans to the collector.
+func (e *Exporter) export(spans []*Span) error {
+	body, err := json.Marshal(e.encode(spans))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range e.headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("exporting %d span(s): %w", len(spans), err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("exporting %d span(s): collector returned %s", len(spans), resp.Status)
+	}
+	return nil
+}
+
+// The OTLP/JSON encoding of an export request. IDs are hex, and 64-bit integers are strings.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              int            `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Status            otlpStatus     `json:"status"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"`
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+	}
+)
+
+// encode converts spans into an OTLP export request.
+func (e *Exporter) encode(spans []*Span) otlpRequest {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		span := otlpSpan{
+			TraceID:           s.sc.TraceID.String(),
+			SpanID:            s.sc.SpanID.String(),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        encodeAttrs(s.attrs),
+			Status:            otlpStatus{Code: s.statusCode, Message: s.statusMessage},
+		}
+		s.mu.Unlock()
+		if s.parent != (SpanID{}) {
+			span.ParentSpanID = s.parent.String()
+		}
+		encoded = append(encoded, span)
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: encodeAttrs([]Attr{String("service.name", e.serviceName)})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: scopeName}, Spans: encoded}},
+	}}}
+}
+
+// encodeAttrs converts attributes into OTLP key-values.
+func encodeAttrs(attrs []Attr) []otlpKeyValue {
+	encoded := make([]otlpKeyValue, 0, len(attrs))
+	for _, attr := range attrs {
+		var value otlpValue
+		switch v := attr.Value.(type) {
+		case string:
+			value.StringValue = &v
+		case int64:
+			s := strconv.FormatInt(v, 10)
+			value.IntValue = &s
+		case float64:
+			value.DoubleValue = &v
+		case bool:
+			value.BoolValue = &v
+		default:
+			s := fmt.Sprint(v)
+			value.StringValue = &s
+		}
+		encoded = append(encoded, otlpKeyValue{Key: attr.Key, Value: value})
+	}
+	return encoded
+}
@@ -0,0 +1,399 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"gemini-anti-truncate-go/internal/config"
+	"gemini-anti-truncate-go/internal/util"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TraceparentHeader is the W3C Trace Context header that carries the trace and parent span.
+const TraceparentHeader = "traceparent"
+
+// Span kinds, as numbered by OTLP.
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+// Span status codes, as numbered by OTLP.
+const (
+	statusUnset = 0
+	statusOK    = 1
+	statusError = 2
+)
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+// String returns the trace ID in lowercase hex.
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// String returns the span ID in lowercase hex.
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// SpanContext is the part of a span that is propagated to other services.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// IsValid reports whether the trace and span IDs are set, as the W3C format requires.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Traceparent formats the span context as a version 00 traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// ParseTraceparent parses a traceparent header value. Values of future versions are accepted
+// as long as they start with the fields of version 00.
+func ParseTraceparent(value string) (SpanContext, bool) {
+	var sc SpanContext
+	value = strings.TrimSpace(value)
+	if len(value) < 55 || (len(value) > 55 && value[55] != '-') {
+		return sc, false
+	}
+	version, traceID, spanID, flags := value[0:2], value[3:35], value[36:52], value[53:55]
+	if value[2] != '-' || value[35] != '-' || value[52] != '-' || version == "ff" || (version == "00" && len(value) != 55) {
+		return sc, false
+	}
+	var flagBytes [1]byte
+	if !decodeHex(sc.TraceID[:], traceID) || !decodeHex(sc.SpanID[:], spanID) || !decodeHex(flagBytes[:], flags) || !decodeHex(nil, version) {
+		return sc, false
+	}
+	sc.Sampled = flagBytes[0]&1 == 1
+	return sc, sc.IsValid()
+}
+
+// decodeHex decodes lowercase hex into dst, or only validates it if dst is nil.
+func decodeHex(dst []byte, s string) bool {
+	if strings.ToLower(s) != s {
+		return false
+	}
+	decoded, err := hex.DecodeString(s)
+	if err != nil {
+		return false
+	}
+	copy(dst, decoded)
+	return true
+}
+
+// Attr is a span attribute. Values are strings, int64s, float64s or bools.
+type Attr struct {
+	Key   string
+	Value interface{}
+}
+
+// String creates a string attribute.
+func String(key, value string) Attr {
+	return Attr{key, value}
+}
+
+// Int creates an integer attribute.
+func Int(key string, value int) Attr {
+	return Attr{key, int64(value)}
+}
+
+// Float creates a floating point attribute.
+func Float(key string, value float64) Attr {
+	return Attr{key, value}
+}
+
+// Bool creates a boolean attribute.
+func Bool(key string, value bool) Attr {
+	return Attr{key, value}
+}
+
+// Span is a timed operation of a trace. A nil span, as returned while tracing is disabled,
+// ignores all calls, so callers never need to check.
+type Span struct {
+	tracer *Tracer
+	name   string
+	kind   int
+	sc     SpanContext
+	parent SpanID
+	start  time.Time
+
+	mu            sync.Mutex
+	end           time.Time
+	attrs         []Attr
+	statusCode    int
+	statusMessage string
+	ended         bool
+}
+
+// SpanContext returns the span's context for propagation.
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// SetAttributes adds attributes to the span, replacing those with the same key.
+func (s *Span) SetAttributes(attrs ...Attr) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, attr := range attrs {
+		replaced := false
+		for i := range s.attrs {
+			if s.attrs[i].Key == attr.Key {
+				s.attrs[i] = attr
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			s.attrs = append(s.attrs, attr)
+		}
+	}
+}
+
+// SetError marks the span as failed, with a description of the error.
+func (s *Span) SetError(message string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statusCode = statusError
+	s.statusMessage = message
+}
+
+// End ends the span and hands it to the exporter if it is sampled. Only the first call counts.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+	if s.sc.Sampled && s.tracer.exporter != nil {
+		s.tracer.exporter.enqueue(s)
+	}
+}
+
+// Tracer creates spans and hands the finished ones to its exporter.
+type Tracer struct {
+	exporter *Exporter // Nil if tracing is disabled
+	ratio    float64   // Fraction of new traces that are sampled
+}
+
+// NewTracer creates a tracer that exports to exporter and samples the given fraction of the
+// traces it starts. Traces continued from a traceparent follow the caller's sampling decision.
+func NewTracer(exporter *Exporter, ratio float64) *Tracer {
+	return &Tracer{exporter: exporter, ratio: ratio}
+}
+
+// Load creates the tracer from the OTEL_* and TRACE_SAMPLE_RATIO configuration. Tracing is
+// disabled unless OTEL_EXPORTER_OTLP_ENDPOINT is set.
+func Load() (*Tracer, error) {
+	if config.AppConfig.OTLPEndpoint == "" {
+		return NewTracer(nil, 0), nil
+	}
+	headers := make(map[string]string)
+	for _, entry := range config.AppConfig.OTLPHeaders {
+		key, value, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("invalid OTLP header %q, expected key=value", entry)
+		}
+		headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	exporter := NewExporter(strings.TrimSuffix(config.AppConfig.OTLPEndpoint, "/")+"/v1/traces", headers, config.AppConfig.ServiceName)
+	return NewTracer(exporter, config.AppConfig.TraceSampleRatio), nil
+}
+
+// Enabled reports whether the tracer exports spans.
+func (t *Tracer) Enabled() bool {
+	return t.exporter != nil
+}
+
+// Start starts a span as a child of the span in ctx, or of the remote parent in ctx, and
+// returns a context that carries the new span. While tracing is disabled, it returns ctx and
+// a nil span.
+func (t *Tracer) Start(ctx context.Context, name string, kind int, attrs ...Attr) (context.Context, *Span) {
+	if !t.Enabled() {
+		return ctx, nil
+	}
+	s := &Span{tracer: t, name: name, kind: kind, start: time.Now()}
+	parent, ok := parentFromContext(ctx)
+	if ok {
+		s.sc.TraceID = parent.TraceID
+		s.parent = parent.SpanID
+		s.sc.Sampled = parent.Sampled
+	} else {
+		rand.Read(s.sc.TraceID[:])
+		s.sc.Sampled = t.sample(s.sc.TraceID)
+	}
+	rand.Read(s.sc.SpanID[:])
+	s.SetAttributes(attrs...)
+	return ContextWithSpan(ctx, s), s
+}
+
+// sample decides whether a new trace is sampled, from its ID so that the decision is stable.
+func (t *Tracer) sample(id TraceID) bool {
+	if t.ratio >= 1 {
+		return true
+	}
+	if t.ratio <= 0 {
+		return false
+	}
+	return float64(binary.BigEndian.Uint64(id[8:])>>11) < t.ratio*(1<<53)
+}
+
+// Flush exports the finished spans that are still queued.
+func (t *Tracer) Flush(ctx context.Context) error {
+	if !t.Enabled() {
+		return nil
+	}
+	return t.exporter.Flush(ctx)
+}
+
+// Shutdown exports the queued spans and stops the exporter.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if !t.Enabled() {
+		return nil
+	}
+	return t.exporter.Shutdown(ctx)
+}
+
+type spanKey struct{}
+
+type remoteKey struct{}
+
+// ContextWithSpan returns a copy of ctx that carries the span.
+func ContextWithSpan(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// SpanFromContext returns the span carried by ctx, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// ContextWithRemoteParent returns a copy of ctx that carries a parent span received from a client.
+func ContextWithRemoteParent(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// parentFromContext returns the span context new spans in ctx descend from.
+func parentFromContext(ctx context.Context) (SpanContext, bool) {
+	if s := SpanFromContext(ctx); s != nil {
+		return s.sc, true
+	}
+	sc, ok := ctx.Value(remoteKey{}).(SpanContext)
+	return sc, ok
+}
+
+// Inject sets the traceparent header for the span in ctx, so that the receiver can continue
+// the trace. Without a span, the header is left alone.
+func Inject(ctx context.Context, header http.Header) {
+	if s := SpanFromContext(ctx); s != nil {
+		header.Set(TraceparentHeader, s.sc.Traceparent())
+	}
+}
+
+// Middleware continues the trace of the client's traceparent header, if there is a valid one,
+// and wraps every request in a server span that records the method, path, request ID and
+// response status. It runs inside the request ID middleware. Responses with a 5xx status mark the span as failed.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if sc, ok := ParseTraceparent(r.Header.Get(TraceparentHeader)); ok {
+			ctx = ContextWithRemoteParent(ctx, sc)
+		}
+		ctx, span := Current().Start(ctx, r.Method+" "+r.URL.Path, KindServer,
+			String("http.request.method", r.Method), String("url.path", r.URL.Path),
+			String("gemini_proxy.request_id", util.RequestID(ctx)))
+		if span == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer span.End()
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+		span.SetAttributes(Int("http.response.status_code", sw.status))
+		if sw.status >= 500 {
+			span.SetError(http.StatusText(sw.status))
+		}
+	})
+}
+
+// statusWriter records the status code of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+// WriteHeader records the status code and passes it on.
+func (sw *statusWriter) WriteHeader(statusCode int) {
+	if !sw.wroteHeader {
+		sw.status = statusCode
+		sw.wroteHeader = true
+	}
+	sw.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write marks the header as written with the default status and passes the data on.
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	sw.wroteHeader = true
+	return sw.ResponseWriter.Write(p)
+}
+
+// Unwrap returns the wrapped ResponseWriter, so that http.ResponseController can flush it.
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+var current atomic.Pointer[Tracer]
+
+// SetTracer installs the tracer returned by Current.
+func SetTracer(t *Tracer) {
+	current.Store(t)
+}
+
+// Current returns the installed tracer, or a disabled one if none was installed.
+func Current() *Tracer {
+	if t := current.Load(); t != nil {
+		return t
+	}
+	return disabled
+}
+
+// disabled is used until a tracer is installed.
+var disabled = NewTracer(nil, 0)
@@ -0,0 +1,256 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"gemini-anti-truncate-go/internal/config"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// Initialize config for tests
+func init() {
+	config.Load()
+}
+
+// collector is an OTLP/HTTP collector stub that keeps the spans it receives.
+type collector struct {
+	mu      sync.Mutex
+	spans   []otlpSpan
+	service string
+	headers http.Header
+}
+
+// newCollector starts a collector stub, closed at the end of the test.
+func newCollector(t *testing.T) (*collector, *httptest.Server) {
+	c := &collector{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Unexpected export request %s with Content-Type '%s'", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		var req otlpRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Errorf("Invalid export request: %v", err)
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.headers = r.Header
+		for _, rs := range req.ResourceSpans {
+			c.service = *rs.Resource.Attributes[0].Value.StringValue
+			for _, ss := range rs.ScopeSpans {
+				c.spans = append(c.spans, ss.Spans...)
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return c, server
+}
+
+// span returns the received span with the given name.
+func (c *collector) span(t *testing.T, name string) otlpSpan {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range c.spans {
+		if s.Name == name {
+			return s
+		}
+	}
+	t.Fatalf("Expected a span named '%s', got %+v", name, c.spans)
+	return otlpSpan{}
+}
+
+// attr returns the value of a span attribute as a string.
+func attr(s otlpSpan, key string) string {
+	for _, kv := range s.Attributes {
+		if kv.Key == key {
+			switch {
+			case kv.Value.StringValue != nil:
+				return *kv.Value.StringValue
+			case kv.Value.IntValue != nil:
+				return *kv.Value.IntValue
+			}
+		}
+	}
+	return ""
+}
+
+func TestParseTraceparent(t *testing.T) {
+	sc, ok := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if !ok || sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7" || !sc.Sampled {
+		t.Errorf("Unexpected span context: %+v (ok %t)", sc, ok)
+	}
+	if got := sc.Traceparent(); got != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Errorf("Expected the traceparent to round-trip, got '%s'", got)
+	}
+
+	// A future version may append fields
+	if _, ok := ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra"); !ok {
+		t.Error("Expected a future version with extra fields to be accepted")
+	}
+
+	for _, value := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01",
+	} {
+		if _, ok := ParseTraceparent(value); ok {
+			t.Errorf("Expected '%s' to be rejected", value)
+		}
+	}
+}
+
+func TestDisabledTracer(t *testing.T) {
+	tracer := NewTracer(nil, 1)
+	ctx, span := tracer.Start(context.Background(), "test", KindInternal)
+	if span != nil || ctx != context.Background() {
+		t.Error("Expected a disabled tracer to return no span")
+	}
+	// A nil span ignores all calls
+	span.SetAttributes(String("key", "value"))
+	span.SetError("failed")
+	span.End()
+
+	header := http.Header{}
+	Inject(ctx, header)
+	if header.Get(TraceparentHeader) != "" {
+		t.Errorf("Expected no traceparent without a span, got '%s'", header.Get(TraceparentHeader))
+	}
+}
+
+func TestExport(t *testing.T) {
+	c, server := newCollector(t)
+	exporter := NewExporter(server.URL+"/v1/traces", map[string]string{"Authorization": "Bearer secret"}, "test-service")
+	tracer := NewTracer(exporter, 1)
+	defer tracer.Shutdown(context.Background())
+
+	remote, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, parent := tracer.Start(ContextWithRemoteParent(context.Background(), remote), "request", KindServer)
+	childCtx, child := tracer.Start(ctx, "attempt", KindClient, Int("attempt", 2), String("model", "gemini-2.5-pro"))
+	child.SetAttributes(Int("attempt", 3), Bool("complete", false))
+	child.SetError("truncated")
+
+	header := http.Header{}
+	Inject(childCtx, header)
+	if expected := child.SpanContext().Traceparent(); header.Get(TraceparentHeader) != expected {
+		t.Errorf("Expected traceparent '%s', got '%s'", expected, header.Get(TraceparentHeader))
+	}
+
+	child.End()
+	child.End() // Only the first call counts
+	parent.End()
+	if err := tracer.Flush(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if c.service != "test-service" || c.headers.Get("Authorization") != "Bearer secret" {
+		t.Errorf("Expected the service name and extra headers, got '%s' and %v", c.service, c.headers)
+	}
+	if len(c.spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %d", len(c.spans))
+	}
+	request, attempt := c.span(t, "request"), c.span(t, "attempt")
+	if request.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || request.ParentSpanID != "00f067aa0ba902b7" || request.Kind != KindServer {
+		t.Errorf("Expected the request span to continue the remote trace, got %+v", request)
+	}
+	if attempt.TraceID != request.TraceID || attempt.ParentSpanID != request.SpanID || attempt.Kind != KindClient {
+		t.Errorf("Expected the attempt span to be a child of the request span, got %+v", attempt)
+	}
+	if attr(attempt, "attempt") != "3" || attr(attempt, "model") != "gemini-2.5-pro" || len(attempt.Attributes) != 3 {
+		t.Errorf("Unexpected attributes: %+v", attempt.Attributes)
+	}
+	if attempt.Status.Code != statusError || attempt.Status.Message != "truncated" {
+		t.Errorf("Expected an error status, got %+v", attempt.Status)
+	}
+	if attempt.StartTimeUnixNano == "" || attempt.EndTimeUnixNano < attempt.StartTimeUnixNano {
+		t.Errorf("Unexpected times: %s to %s", attempt.StartTimeUnixNano, attempt.EndTimeUnixNano)
+	}
+}
+
+func TestSampling(t *testing.T) {
+	c, server := newCollector(t)
+	tracer := NewTracer(NewExporter(server.URL+"/v1/traces", nil, "test"), 0)
+	defer tracer.Shutdown(context.Background())
+
+	// New traces are not sampled at a ratio of 0, but their IDs are still propagated
+	ctx, span := tracer.Start(context.Background(), "unsampled", KindServer)
+	header := http.Header{}
+	Inject(ctx, header)
+	if sc, ok := ParseTraceparent(header.Get(TraceparentHeader)); !ok || sc.Sampled {
+		t.Errorf("Expected an unsampled traceparent, got '%s'", header.Get(TraceparentHeader))
+	}
+	span.End()
+
+	// A sampled caller overrides the ratio
+	remote, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	_, span = tracer.Start(ContextWithRemoteParent(context.Background(), remote), "sampled", KindServer)
+	span.End()
+
+	tracer.Flush(context.Background())
+	if len(c.spans) != 1 || c.spans[0].Name != "sampled" {
+		t.Errorf("Expected only the sampled span, got %+v", c.spans)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	c, server := newCollector(t)
+	tracer := NewTracer(NewExporter(server.URL+"/v1/traces", nil, "test"), 1)
+	SetTracer(tracer)
+	defer SetTracer(nil)
+
+	var inner *Span
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inner = SpanFromContext(r.Context())
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	req := httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:generateContent", nil)
+	req.Header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if inner == nil {
+		t.Fatal("Expected the handler to see the server span")
+	}
+
+	tracer.Flush(context.Background())
+	span := c.span(t, "POST /v1beta/models/gemini-2.5-pro:generateContent")
+	if span.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || span.SpanID != inner.SpanContext().SpanID.String() {
+		t.Errorf("Expected the server span to continue the client's trace, got %+v", span)
+	}
+	if attr(span, "http.response.status_code") != "502" || span.Status.Code != statusError {
+		t.Errorf("Expected a failed span with status 502, got %+v", span)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	defer func(cfg config.Config) { *config.AppConfig = cfg }(*config.AppConfig)
+
+	config.AppConfig.OTLPEndpoint = ""
+	tracer, err := Load()
+	if err != nil || tracer.Enabled() {
+		t.Errorf("Expected tracing to be disabled without an endpoint, got %v", err)
+	}
+
+	config.AppConfig.OTLPEndpoint = "http://localhost:4318/"
+	config.AppConfig.OTLPHeaders = []string{"Authorization=Bearer secret"}
+	tracer, err = Load()
+	if err != nil || !tracer.Enabled() {
+		t.Fatalf("Expected tracing to be enabled, got %v", err)
+	}
+	defer tracer.Shutdown(context.Background())
+	if tracer.exporter.url != "http://localhost:4318/v1/traces" || tracer.exporter.headers["Authorization"] != "Bearer secret" {
+		t.Errorf("Unexpected exporter: %s %v", tracer.exporter.url, tracer.exporter.headers)
+	}
+
+	config.AppConfig.OTLPHeaders = []string{"no-value"}
+	if _, err := Load(); err == nil {
+		t.Error("Expected an error for a header without a value")
+	}
+}
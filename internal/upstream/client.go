@@ -0,0 +1,133 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"gemini-anti-truncate-go/internal/config"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pingTimeout is how long an HTTP/2 health check ping may go unanswered before the connection
+// is closed, failing the streams on it.
+const pingTimeout = 15 * time.Second
+
+// Timeouts are the limits of the upstream client. A zero timeout disables the limit.
+type Timeouts struct {
+	Dial           time.Duration // Opening a TCP connection
+	TLSHandshake   time.Duration // The TLS handshake
+	ResponseHeader time.Duration // The response headers of a stream request, once the request is sent
+	IdleConn       time.Duration // An idle connection kept in the pool
+	StreamIdle     time.Duration // Silence on an HTTP/2 connection before it is health-checked with a ping
+}
+
+// NewClient creates a client for upstream requests. Connections are kept alive and pooled, and
+// HTTP/2 is used when the upstream offers it, so that attempts and continuations do not pay for
+// a new handshake. The client has no overall timeout: a streamed answer may take minutes, and
+// every request is bounded by its own context instead. The response header timeout only applies
+// to stream requests: a non-stream answer only gets its headers once it is fully generated, which
+// for a thinking model may take longer, so it is bounded by the request's context alone.
+func NewClient(timeouts Timeouts, maxIdleConnsPerHost int) *http.Client {
+	dialer := &net.Dialer{Timeout: timeouts.Dial, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   timeouts.TLSHandshake,
+		IdleConnTimeout:       timeouts.IdleConn,
+		MaxIdleConns:          max(maxIdleConnsPerHost, 100),
+		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		ExpectContinueTimeout: time.Second,
+	}
+	if timeouts.StreamIdle > 0 {
+		// A connection that went silent is detected by a ping instead of hanging the streams on it
+		transport.HTTP2 = &http.HTTP2Config{SendPingTimeout: timeouts.StreamIdle, PingTimeout: pingTimeout}
+	}
+	if timeouts.ResponseHeader <= 0 {
+		return &http.Client{Transport: transport}
+	}
+	return &http.Client{Transport: &streamHeaderTimeout{base: transport, timeout: timeouts.ResponseHeader}}
+}
+
+// errResponseHeaderTimeout is returned when a stream request gets no response headers in time.
+var errResponseHeaderTimeout = errors.New("timeout awaiting response headers")
+
+// streamHeaderTimeout limits how long stream requests wait for their response headers. Unlike
+// the transport's ResponseHeaderTimeout, it leaves non-stream requests alone.
+type streamHeaderTimeout struct {
+	base    http.RoundTripper
+	timeout time.Duration
+}
+
+// RoundTrip sends the request, canceling a stream request whose headers do not arrive in time.
+func (t *streamHeaderTimeout) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !IsStream(req.URL.Path) {
+		return t.base.RoundTrip(req)
+	}
+	ctx, cancel := context.WithCancelCause(req.Context())
+	timer := time.AfterFunc(t.timeout, func() { cancel(errResponseHeaderTimeout) })
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if !timer.Stop() {
+		// The timer fired, even if the headers arrived just in time
+		if err == nil {
+			resp.Body.Close()
+		}
+		cancel(nil)
+		return nil, errResponseHeaderTimeout
+	}
+	if err != nil {
+		cancel(nil)
+		return nil, err
+	}
+	// The context lives on until the body is closed, as the body is read through it
+	resp.Body = &cancelingBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelingBody releases the context of its request when it is closed.
+type cancelingBody struct {
+	io.ReadCloser
+	cancel context.CancelCauseFunc
+}
+
+// Close closes the body and releases the request's context.
+func (b *cancelingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel(nil)
+	return err
+}
+
+// LoadClient creates the upstream client from the UPSTREAM_* configuration.
+func LoadClient() *http.Client {
+	return NewClient(Timeouts{
+		Dial:           config.AppConfig.UpstreamDialTimeout,
+		TLSHandshake:   config.AppConfig.UpstreamTLSHandshakeTimeout,
+		ResponseHeader: config.AppConfig.UpstreamResponseHeaderTimeout,
+		IdleConn:       config.AppConfig.UpstreamIdleConnTimeout,
+		StreamIdle:     config.AppConfig.UpstreamStreamIdleTimeout,
+	}, config.AppConfig.UpstreamMaxIdleConnsPerHost)
+}
+
+var currentClient atomic.Pointer[http.Client]
+
+// defaultClient is used until a client is installed. It is created once, so that its
+// connections are shared too.
+var defaultClient = sync.OnceValue(LoadClient)
+
+// SetClient installs the client returned by CurrentClient.
+func SetClient(c *http.Client) {
+	currentClient.Store(c)
+}
+
+// CurrentClient returns the installed client, or one created from the configuration if none
+// was installed. All upstream requests are sent with it.
+func CurrentClient() *http.Client {
+	if c := currentClient.Load(); c != nil {
+		return c
+	}
+	return defaultClient()
+}
@@ -0,0 +1,114 @@
+package upstream
+
+import (
+	"bytes"
+	"gemini-anti-truncate-go/internal/config"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ForwardedHeaders lists the client request headers that are copied to the upstream request.
+// Credentials are deliberately absent: the API key is always sent as X-Goog-Api-Key.
+var ForwardedHeaders = []string{
+	"Accept",
+	"Accept-Language",
+	"User-Agent",
+	"X-Goog-Api-Client",
+	"X-Goog-User-Project",
+	"X-Server-Timeout",
+}
+
+// StreamErrorsParam is the query parameter with which a client opts into a terminal error
+// chunk at the end of a failed stream. Like the key, it is meant for the proxy and is not
+// forwarded upstream.
+const StreamErrorsParam = "proxy_stream_errors"
+
+// NewRequest creates the upstream request for an incoming client request.
+// It is shared by the stream, non-stream and passthrough handlers so that all of them
+// forward the same path, query string and headers.
+func NewRequest(r *http.Request, body []byte, apiKey string) (*http.Request, error) {
+	upstreamReq, err := http.NewRequestWithContext(r.Context(), http.MethodPost, URL(config.AppConfig.UpstreamURLBase, r.URL), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range ForwardedHeaders {
+		if values := r.Header.Values(name); len(values) > 0 {
+			upstreamReq.Header[http.CanonicalHeaderKey(name)] = append([]string(nil), values...)
+		}
+	}
+	upstreamReq.Header.Set("Content-Type", "application/json")
+	upstreamReq.Header.Set("X-Goog-Api-Key", apiKey)
+
+	return upstreamReq, nil
+}
+
+// URL joins the upstream base URL with the path and query string of a client URL.
+// Duplicate slashes are collapsed, and the "key" query parameter is dropped because
+// the key travels in the X-Goog-Api-Key header instead; so is StreamErrorsParam. The remaining parameters,
+// such as alt=sse, keep their original order and encoding.
+func URL(base string, u *url.URL) string {
+	path := u.EscapedPath()
+	for strings.Contains(path, "//") {
+		path = strings.ReplaceAll(path, "//", "/")
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	upstreamURL := strings.TrimRight(base, "/") + path
+	if query := forwardedQuery(u.RawQuery); query != "" {
+		upstreamURL += "?" + query
+	}
+	return upstreamURL
+}
+
+// forwardedQuery removes the API key and the proxy's own parameters from a raw query string
+// without re-encoding the rest.
+func forwardedQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	var kept []string
+	for _, param := range strings.Split(rawQuery, "&") {
+		name, _, _ := strings.Cut(param, "=")
+		if name == "" || name == "key" || name == StreamErrorsParam {
+			continue
+		}
+		kept = append(kept, param)
+	}
+	return strings.Join(kept, "&")
+}
+
+// ModelFromPath returns the model named in a Gemini API path such as
+// /v1beta/models/gemini-2.5-pro:generateContent, or "" if the path names none.
+func ModelFromPath(path string) string {
+	_, rest, found := strings.Cut(path, "/models/")
+	if !found {
+		return ""
+	}
+	model, _, _ := strings.Cut(rest, ":")
+	return model
+}
+
+// IsStream reports whether a Gemini API path asks for a streamed answer (streamGenerateContent).
+func IsStream(path string) bool {
+	return strings.Contains(path, ":streamGenerateContent")
+}
+
+// WithModel returns a shallow copy of r whose path targets another model with the same method,
+// so that a fallback model receives the same request as the original one.
+func WithModel(r *http.Request, model string) *http.Request {
+	current := ModelFromPath(r.URL.Path)
+	if current == "" || current == model {
+		return r
+	}
+
+	u := *r.URL
+	u.Path = strings.Replace(u.Path, "/models/"+current, "/models/"+model, 1)
+	u.RawPath = ""
+	switched := r.WithContext(r.Context())
+	switched.URL = &u
+	return switched
+}
@@ -0,0 +1,150 @@
+package upstream
+
+import (
+	"gemini-anti-truncate-go/internal/config"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Initialize config for tests
+func init() {
+	config.Load()
+}
+
+func TestURL(t *testing.T) {
+	tests := []struct {
+		base     string
+		rawURL   string
+		expected string
+	}{
+		{"https://example.com", "/v1beta/models/gemini-2.5-pro:generateContent", "https://example.com/v1beta/models/gemini-2.5-pro:generateContent"},
+		{"https://example.com/", "/v1beta//models/gemini-2.5-pro:streamGenerateContent?alt=sse", "https://example.com/v1beta/models/gemini-2.5-pro:streamGenerateContent?alt=sse"},
+		{"https://example.com/gemini", "/v1beta/models/gemini-2.5-pro:streamGenerateContent?key=secret&alt=sse", "https://example.com/gemini/v1beta/models/gemini-2.5-pro:streamGenerateContent?alt=sse"},
+		{"https://example.com", "/v1beta/models/m?key=secret", "https://example.com/v1beta/models/m"},
+		{"https://example.com", "/v1beta/models/m?b=2&a=%2F1", "https://example.com/v1beta/models/m?b=2&a=%2F1"},
+		{"https://example.com", "/v1beta/models/m?alt=sse&proxy_stream_errors=1&keyword=x", "https://example.com/v1beta/models/m?alt=sse&keyword=x"},
+	}
+
+	for _, tt := range tests {
+		u, err := url.Parse(tt.rawURL)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", tt.rawURL, err)
+		}
+		if got := URL(tt.base, u); got != tt.expected {
+			t.Errorf("URL(%q, %q): expected '%s', got '%s'", tt.base, tt.rawURL, tt.expected, got)
+		}
+	}
+}
+
+func TestNewRequest(t *testing.T) {
+	config.AppConfig.UpstreamURLBase = "https://upstream.example.com"
+
+	r := httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:streamGenerateContent?alt=sse&key=client-key", nil)
+	r.Header.Set("Authorization", "Bearer client-key")
+	r.Header.Set("User-Agent", "test-agent")
+	r.Header.Set("X-Goog-Api-Client", "genai-js/1.0")
+	r.Header.Set("Cookie", "session=1")
+
+	upstreamReq, err := NewRequest(r, []byte(`{"contents":[]}`), "client-key")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if upstreamReq.URL.String() != "https://upstream.example.com/v1beta/models/gemini-2.5-pro:streamGenerateContent?alt=sse" {
+		t.Errorf("Unexpected upstream URL: %s", upstreamReq.URL.String())
+	}
+	if upstreamReq.Header.Get("X-Goog-Api-Key") != "client-key" {
+		t.Error("Expected X-Goog-Api-Key header to be set")
+	}
+	if upstreamReq.Header.Get("User-Agent") != "test-agent" || upstreamReq.Header.Get("X-Goog-Api-Client") != "genai-js/1.0" {
+		t.Error("Expected allow-listed headers to be forwarded")
+	}
+	if upstreamReq.Header.Get("Authorization") != "" || upstreamReq.Header.Get("Cookie") != "" {
+		t.Error("Expected headers outside the allow-list to be dropped")
+	}
+
+	body, _ := io.ReadAll(upstreamReq.Body)
+	if !strings.Contains(string(body), "contents") {
+		t.Errorf("Expected body to be forwarded, got '%s'", body)
+	}
+}
+
+func TestWithModel(t *testing.T) {
+	r := httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:streamGenerateContent?alt=sse", nil)
+	if model := ModelFromPath(r.URL.Path); model != "gemini-2.5-pro" {
+		t.Errorf("Expected 'gemini-2.5-pro', got '%s'", model)
+	}
+
+	switched := WithModel(r, "gemini-2.5-flash")
+	if switched.URL.Path != "/v1beta/models/gemini-2.5-flash:streamGenerateContent" || switched.URL.RawQuery != "alt=sse" {
+		t.Errorf("Unexpected switched URL: %s", switched.URL.String())
+	}
+	if r.URL.Path != "/v1beta/models/gemini-2.5-pro:streamGenerateContent" {
+		t.Errorf("Expected the original request to be unchanged, got %s", r.URL.Path)
+	}
+	if WithModel(r, "gemini-2.5-pro") != r {
+		t.Error("Expected the same request when the model does not change")
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	var connections atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/slow") {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Write([]byte("ok"))
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections.Add(1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	client := NewClient(Timeouts{Dial: time.Second, ResponseHeader: 50 * time.Millisecond, IdleConn: time.Minute}, 4)
+
+	// Attempts share a kept-alive connection
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	if n := connections.Load(); n != 1 {
+		t.Errorf("Expected 1 connection, got %d", n)
+	}
+
+	if _, err := client.Get(server.URL + "/slow:streamGenerateContent"); err == nil || !strings.Contains(err.Error(), "timeout awaiting response headers") {
+		t.Errorf("Expected a response header timeout, got %v", err)
+	}
+
+	// A non-stream answer only gets its headers once it is generated, so it is not limited
+	resp, err := client.Get(server.URL + "/slow:generateContent")
+	if err != nil {
+		t.Fatalf("Expected the non-stream request to wait for its headers, got %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestCurrentClient(t *testing.T) {
+	if CurrentClient() != CurrentClient() {
+		t.Error("Expected the default client to be shared")
+	}
+	client := &http.Client{}
+	SetClient(client)
+	defer SetClient(nil)
+	if CurrentClient() != client {
+		t.Error("Expected the installed client")
+	}
+}
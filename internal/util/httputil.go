@@ -1,14 +1,16 @@
 package util
 
 import (
+	"context"
 	"encoding/json"
 	"gemini-anti-truncate-go/internal/gemini"
 	"net/http"
 	"strings"
 )
 
-// GetAPIKey extracts the Gemini API key from the request headers.
-// It checks for "Authorization: Bearer <key>" and "X-Goog-Api-Key: <key>".
+// GetAPIKey extracts the Gemini API key from the request.
+// It checks for "Authorization: Bearer <key>", "X-Goog-Api-Key: <key>" and finally the
+// "key" query parameter used by the official SDKs.
 func GetAPIKey(r *http.Request) string {
 	// Check Authorization header first
 	if authHeader := r.Header.Get("Authorization"); authHeader != "" {
@@ -22,10 +24,16 @@ func GetAPIKey(r *http.Request) string {
 		return apiKey
 	}
 
+	// Fallback to the ?key= query parameter
+	if apiKey := r.URL.Query().Get("key"); apiKey != "" {
+		return apiKey
+	}
+
 	return ""
 }
 
-// SendJSONError sends a standardized JSON error response to the client.
+// SendJSONError sends a standardized JSON error response to the client, in the format of
+// Gemini errors, e.g. with status RESOURCE_EXHAUSTED for a 429.
 func SendJSONError(w http.ResponseWriter, message string, statusCode int) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
@@ -38,13 +46,13 @@ func SendJSONError(w http.ResponseWriter, message string, statusCode int) {
 		}{
 			Code:    statusCode,
 			Message: message,
-			Status:  http.StatusText(statusCode),
+			Status:  gemini.StatusName(statusCode),
 		},
 	}
 
 	if err := json.NewEncoder(w).Encode(errorResponse); err != nil {
 		// If encoding fails, log it and fall back to a plain text response
-		Errorf("Failed to encode JSON error response: %v", err)
+		Error(context.Background(), "Failed to encode JSON error response", "error", err)
 		http.Error(w, `{"error": "Failed to serialize error message."}`, http.StatusInternalServerError)
 	}
 }
@@ -1,23 +1,79 @@
 package util
 
 import (
+	"context"
+	"fmt"
 	"gemini-anti-truncate-go/internal/config"
-	"log"
+	"io"
+	"log/slog"
+	"strings"
 )
 
-// Infof logs an informational message.
-func Infof(format string, v ...interface{}) {
-	log.Printf("[INFO] "+format, v...)
+// logLevel is the minimum level of the default logger, set by SetupLogger.
+var logLevel = new(slog.LevelVar)
+
+// SetupLogger installs the default slog logger, writing to w in the format of LOG_FORMAT
+// ("text" or "json") from the level of LOG_LEVEL. DEBUG_MODE lowers the level to debug.
+// Log lines written with a request's context carry its request ID.
+func SetupLogger(w io.Writer) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(config.AppConfig.LogLevel)); err != nil {
+		return fmt.Errorf("invalid log level %q: %w", config.AppConfig.LogLevel, err)
+	}
+	if config.AppConfig.DebugMode {
+		level = slog.LevelDebug
+	}
+	logLevel.Set(level)
+
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	switch strings.ToLower(config.AppConfig.LogFormat) {
+	case "text":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("invalid log format %q, expected text or json", config.AppConfig.LogFormat)
+	}
+	slog.SetDefault(slog.New(requestIDHandler{handler}))
+	return nil
+}
+
+// requestIDHandler adds the request ID of the context to every record.
+type requestIDHandler struct {
+	slog.Handler
 }
 
-// Debugf logs a debug message only if DebugMode is enabled.
-func Debugf(format string, v ...interface{}) {
-	if config.AppConfig != nil && config.AppConfig.DebugMode {
-		log.Printf("[DEBUG] "+format, v...)
+// Handle adds the request_id attribute if the context carries one.
+func (h requestIDHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
 	}
+	return h.Handler.Handle(ctx, r)
+}
+
+// WithAttrs keeps the request ID handling on derived handlers.
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+// WithGroup keeps the request ID handling on derived handlers.
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+// Info logs an informational message about the request of ctx. The arguments are attributes,
+// given as alternating keys and values or as slog.Attr, like those of slog.Logger.Info.
+func Info(ctx context.Context, msg string, args ...any) {
+	slog.Default().Log(ctx, slog.LevelInfo, msg, args...)
+}
+
+// Debug logs a debug message about the request of ctx, if the log level allows it.
+func Debug(ctx context.Context, msg string, args ...any) {
+	slog.Default().Log(ctx, slog.LevelDebug, msg, args...)
 }
 
-// Errorf logs an error message.
-func Errorf(format string, v ...interface{}) {
-	log.Printf("[ERROR] "+format, v...)
+// Error logs an error message about the request of ctx.
+func Error(ctx context.Context, msg string, args ...any) {
+	slog.Default().Log(ctx, slog.LevelError, msg, args...)
 }
@@ -1,11 +1,22 @@
 package util
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"gemini-anti-truncate-go/internal/config"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
+// Initialize config for tests
+func init() {
+	config.Load()
+}
+
 func TestGetAPIKey(t *testing.T) {
 	// Test with Authorization header (Bearer)
 	req := httptest.NewRequest("POST", "/", nil)
@@ -43,6 +54,23 @@ func TestGetAPIKey(t *testing.T) {
 		t.Errorf("Expected empty string, got '%s'", apiKey)
 	}
 	
+	// Test with the key query parameter
+	req = httptest.NewRequest("POST", "/?alt=sse&key=test-api-key-5", nil)
+	
+	apiKey = GetAPIKey(req)
+	if apiKey != "test-api-key-5" {
+		t.Errorf("Expected 'test-api-key-5', got '%s'", apiKey)
+	}
+	
+	// Test with headers taking precedence over the key query parameter
+	req = httptest.NewRequest("POST", "/?key=test-api-key-6", nil)
+	req.Header.Set("X-Goog-Api-Key", "test-api-key-7")
+	
+	apiKey = GetAPIKey(req)
+	if apiKey != "test-api-key-7" {
+		t.Errorf("Expected 'test-api-key-7', got '%s'", apiKey)
+	}
+	
 	// Test with malformed Authorization header
 	req = httptest.NewRequest("POST", "/", nil)
 	req.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
@@ -95,4 +123,86 @@ func findSubstring(s, substr string) int {
 		}
 	}
 	return -1
-}
\ No newline at end of file
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	var seen string
+	handler := RequestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestID(r.Context())
+	}))
+
+	// The client's ID is kept and echoed
+	req := httptest.NewRequest("POST", "/", nil)
+	req.Header.Set("X-Request-Id", "client-id-42")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if seen != "client-id-42" || rr.Header().Get("X-Request-Id") != "client-id-42" {
+		t.Errorf("Expected the client's request ID, got '%s' in the context and '%s' in the response", seen, rr.Header().Get("X-Request-Id"))
+	}
+
+	// Missing or unusable IDs are replaced by a generated one
+	for _, id := range []string{"", "has space", "line\nbreak", strings.Repeat("x", 129)} {
+		req := httptest.NewRequest("POST", "/", nil)
+		req.Header.Set("X-Request-Id", id)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if len(seen) != 32 || seen == id || rr.Header().Get("X-Request-Id") != seen {
+			t.Errorf("Expected a generated request ID for '%s', got '%s' in the context and '%s' in the response", id, seen, rr.Header().Get("X-Request-Id"))
+		}
+	}
+}
+
+func TestSetupLogger(t *testing.T) {
+	originalConfig := *config.AppConfig
+	originalLogger := slog.Default()
+	defer func() {
+		*config.AppConfig = originalConfig
+		slog.SetDefault(originalLogger)
+	}()
+
+	var buf bytes.Buffer
+	config.AppConfig.LogFormat = "json"
+	config.AppConfig.LogLevel = "warn"
+	config.AppConfig.DebugMode = false
+	if err := SetupLogger(&buf); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	ctx := WithRequestID(context.Background(), "req-1")
+	Info(ctx, "below the level")
+	Error(ctx, "Attempt failed", "attempt", 2)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected 1 log line, got %d: %s", len(lines), buf.String())
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("Expected a JSON log line, got '%s'", lines[0])
+	}
+	if record["level"] != "ERROR" || record["msg"] != "Attempt failed" || record["attempt"] != float64(2) || record["request_id"] != "req-1" {
+		t.Errorf("Unexpected log record: %v", record)
+	}
+
+	// DEBUG_MODE lowers the level to debug
+	buf.Reset()
+	config.AppConfig.LogFormat = "text"
+	config.AppConfig.DebugMode = true
+	if err := SetupLogger(&buf); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	Debug(context.Background(), "debug line")
+	if !strings.Contains(buf.String(), "level=DEBUG") || !strings.Contains(buf.String(), `msg="debug line"`) {
+		t.Errorf("Expected a debug line in text format, got '%s'", buf.String())
+	}
+
+	config.AppConfig.LogFormat = "xml"
+	if err := SetupLogger(&buf); err == nil {
+		t.Error("Expected an error for an unknown log format")
+	}
+	config.AppConfig.LogFormat = "json"
+	config.AppConfig.LogLevel = "verbose"
+	if err := SetupLogger(&buf); err == nil {
+		t.Error("Expected an error for an unknown log level")
+	}
+}
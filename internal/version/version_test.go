@@ -0,0 +1,26 @@
+package version
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestGet(t *testing.T) {
+	defer func(version, commit, buildTime string) {
+		Version, Commit, BuildTime = version, commit, buildTime
+	}(Version, Commit, BuildTime)
+
+	Version, Commit, BuildTime = "v1.2.0", "abc123", "2026-10-16T09:00:00Z"
+	info := Get()
+	if info.Version != "v1.2.0" || info.Commit != "abc123" || info.BuildTime != "2026-10-16T09:00:00Z" {
+		t.Errorf("Expected the build-time values, got %+v", info)
+	}
+	if info.GoVersion != runtime.Version() {
+		t.Errorf("Expected Go version '%s', got '%s'", runtime.Version(), info.GoVersion)
+	}
+
+	Commit = ""
+	if info := Get(); info.Commit == "" {
+		t.Error("Expected a commit, or 'unknown' if none is known")
+	}
+}